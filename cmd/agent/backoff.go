@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// errThrottled is returned when the server pushes back with 429 or 503
+var errThrottled = errors.New("throttled by server")
+
+// errRejected is returned for any other 4xx, sending the metric again won't help
+var errRejected = errors.New("rejected by server")
+
+const maxBackoff = 5 * time.Minute
+
+// backoff holds reports back after the server pushed back
+type backoff struct {
+	until    time.Time
+	failures int
+}
+
+// throttle delays the next report by the server's Retry-After or, when
+// it gives none, by an exponentially growing wait
+func (b *backoff) throttle(now time.Time, retryAfter time.Duration) time.Duration {
+	b.failures++
+	wait := retryAfter
+	if wait <= 0 {
+		shift := b.failures - 1
+		if shift > 8 {
+			shift = 8
+		}
+		wait = time.Second << uint(shift)
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	b.until = now.Add(wait)
+	return wait
+}
+
+// ready reports whether requests may be sent at now
+func (b *backoff) ready(now time.Time) bool {
+	return !now.Before(b.until)
+}
+
+// reset forgets past failures after a successful request
+func (b *backoff) reset() {
+	b.failures = 0
+}
+
+// isThrottled tells whether the response asks the agent to slow down
+func isThrottled(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// retryAfter parses the Retry-After header, in seconds or as an HTTP date
+func retryAfter(resp *resty.Response, now time.Time) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	v := resp.Header().Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -9,17 +13,41 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/go-resty/resty/v2"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/collector"
 	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
 	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/sidecar"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/tlsconf"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 type clientHTTP struct {
 	client resty.Client
+	// headers identify the agent on every request
+	headers map[string]string
+	// token is sent as bearer token when set
+	token string
+	// gzip compresses request bodies
+	gzip bool
+}
+
+// request starts a request carrying the agent headers and token
+func (client *clientHTTP) request() *resty.Request {
+	req := client.client.R().SetHeaders(client.headers)
+	if client.token != "" {
+		req.SetAuthToken(client.token)
+	}
+	return req
 }
 
 // MetricSend takes Server address and relative path from config struct
@@ -30,16 +58,32 @@ func (client *clientHTTP) MetricSend(endpoint string, metrics metric.Metric, tr
 		return nil, fmt.Errorf("error during marshaling in MetricSend %w", err)
 	}
 
-	resp, err := client.client.SetCloseConnection(true).
-		SetTransport(tr).
-		R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(jsonMetric).
-		Post(endpoint)
+	req := client.request().SetHeader("Content-Type", "application/json")
+	if client.gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(jsonMetric); err != nil {
+			return nil, fmt.Errorf("error during compressing in MetricSend %w", err)
+		}
+		if err := gz.Close(); err != nil {
+			return nil, fmt.Errorf("error during compressing in MetricSend %w", err)
+		}
+		jsonMetric = buf.Bytes()
+		req.SetHeader("Content-Encoding", "gzip")
+	}
+
+	client.client.SetCloseConnection(true).SetTransport(tr)
+	resp, err := req.SetBody(jsonMetric).Post(endpoint)
 
 	if err != nil {
 		return nil, fmt.Errorf("unable to send POST request:%w", err)
 	}
+	if isThrottled(resp.StatusCode()) {
+		return resp, fmt.Errorf("%w: status cod [%d]", errThrottled, resp.StatusCode())
+	}
+	if resp.StatusCode() >= http.StatusBadRequest && resp.StatusCode() < http.StatusInternalServerError {
+		return nil, fmt.Errorf("%w: status cod [%d]: %s", errRejected, resp.StatusCode(), string(resp.Body()))
+	}
 	if resp.StatusCode() != http.StatusOK {
 		return nil, fmt.Errorf("status cod [%d]: %s", resp.StatusCode(), string(resp.Body()))
 	}
@@ -47,6 +91,22 @@ func (client *clientHTTP) MetricSend(endpoint string, metrics metric.Metric, tr
 	return resp, nil
 }
 
+// Heartbeat tells the server the agent is alive even when it has nothing to report
+func (client *clientHTTP) Heartbeat(endpoint string, tr *http.Transport) (*resty.Response, error) {
+	client.client.SetTransport(tr)
+	resp, err := client.request().Post(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send heartbeat:%w", err)
+	}
+	if isThrottled(resp.StatusCode()) {
+		return resp, fmt.Errorf("%w: status cod [%d]", errThrottled, resp.StatusCode())
+	}
+	if resp.StatusCode() >= http.StatusBadRequest {
+		return nil, fmt.Errorf("status cod [%d]: %s", resp.StatusCode(), string(resp.Body()))
+	}
+	return resp, nil
+}
+
 func main() {
 
 	conf := config.NewConfigAgent()
@@ -54,32 +114,56 @@ func main() {
 	flag.StringVar(&conf.Address, "a", "http://localhost:8080", "server address")
 	flag.DurationVar(&conf.ReportInterval, "r", 10*time.Second, "duration of Report Interval")
 	flag.DurationVar(&conf.PollInterval, "i", 2*time.Second, "duration of Poll Interval")
+	flag.StringVar(&conf.Token, "t", "", "bearer token with the write role")
 
 	// read env variable
 	if err := env.Parse(conf); err != nil {
 		log.Fatal(err)
 	}
 
+	// stable identity, generated on first start
+	id, err := agents.LoadID(conf.IDFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	info := agents.Info{
+		ID:             id,
+		Hostname:       hostname,
+		OS:             runtime.GOOS + "/" + runtime.GOARCH,
+		Version:        version,
+		ReportInterval: conf.ReportInterval,
+	}
+	log.Printf("Agent ID: %s", id)
+
 	// init client
 	client := &clientHTTP{
-		client: *resty.New(),
+		client:  *resty.New(),
+		headers: info.Header(),
+		token:   conf.Token,
+		gzip:    conf.Compress,
 	}
 
-	// Stores agent data
-	mStorage := &metric.AgentStorage{
-		Stats: runtime.MemStats{},
-		Data:  make(map[string]metric.Metric),
+	// collected metrics wait in the buffer until reported
+	collectors, err := collector.FromConfig(conf)
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.Printf("Collectors: %s", strings.Join(collectors.Enabled(), ", "))
+	buf := collector.NewBuffer()
 	transport := &http.Transport{
 		MaxIdleConns:        20,
 		MaxIdleConnsPerHost: 20,
 	}
+	if conf.TLSCAFile != "" || conf.TLSCertFile != "" {
+		transport.TLSClientConfig, err = tlsconf.Client(conf.TLSCAFile, conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	// make endpoint
 	endpoint := conf.Address + conf.URLMetricPush
 	log.Println(endpoint)
-	// Create Ticker for populating
-	tickPoll := time.NewTicker(conf.PollInterval)
-	defer tickPoll.Stop()
 	// Create Ticker for report
 	tickReport := time.NewTicker(conf.ReportInterval)
 	defer tickReport.Stop()
@@ -91,7 +175,6 @@ func main() {
 	go func() {
 		for sig := range sigCh {
 			log.Println("Recieved sig:", sig)
-			tickPoll.Stop()
 			tickReport.Stop()
 			close(done)
 			return
@@ -100,26 +183,38 @@ func main() {
 	}()
 	log.Println("check")
 
-	// Poll every 2s
+	// every collector polls on its own interval
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
-		for {
-			select {
-			case <-done:
-				fmt.Println("Stopped")
-				return
-			case <-tickPoll.C:
-				mStorage.PopulateMetricStruct()
-				log.Println("Polled")
-				inc, ok := mStorage.Data["PollCount"]
-				if !ok {
-					log.Println("Value PollCount doesn't exist")
-				}
-				inc.Delta += 1
-				mStorage.Data["PollCount"] = inc
+		<-done
+		cancel()
+	}()
+	go collectors.Run(ctx, buf)
 
-			}
+	// local apps push into the same buffer, counters add up until the next report
+	if conf.SidecarAddress != "" {
+		ln, err := sidecar.Listen(conf.SidecarAddress)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+		srv := &http.Server{Handler: sidecar.Handler(buf, validate.Decoder{})}
+		// closing the listener removes the socket file
+		defer srv.Close()
+		go func() {
+			log.Println("Sidecar listening on", conf.SidecarAddress)
+			if err := srv.Serve(ln); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// back off when the server is overloaded, skipping reports until then
+	bo := &backoff{}
+	throttled := func(resp *resty.Response) {
+		wait := bo.throttle(time.Now(), retryAfter(resp, time.Now()))
+		log.Printf("Server is throttling, backing off for %s", wait)
+	}
 
 	// Report every 10s
 	for {
@@ -128,7 +223,19 @@ func main() {
 			fmt.Println("Stopped")
 			return
 		case <-tickReport.C:
-			for _, v := range mStorage.Data {
+			if !bo.ready(time.Now()) {
+				continue
+			}
+			if resp, err := client.Heartbeat(conf.Address+"/agents/heartbeat", transport); err != nil {
+				log.Println(err)
+				if errors.Is(err, errThrottled) {
+					throttled(resp)
+					continue
+				}
+			}
+			list := buf.Drain()
+		report:
+			for i, v := range list {
 				select {
 				case <-done:
 					return
@@ -136,12 +243,26 @@ func main() {
 					time.Sleep(500 * time.Microsecond)
 					resp, err := client.MetricSend(endpoint, v, transport)
 
+					if errors.Is(err, errThrottled) {
+						throttled(resp)
+						// keep the rest, counters must not lose their deltas
+						buf.Return(list[i:]...)
+						break report
+					}
+					if errors.Is(err, errRejected) {
+						// the server won't take it, keeping it would fail every report
+						log.Println(err)
+						log.Println("Dropped", v.ID)
+						continue
+					}
 					if err != nil {
+						// transport errors and 5xx, send it with the next report
 						log.Println(err)
 						log.Println("Failed to send", v.ID)
-
+						buf.Return(v)
 					}
 					if resp != nil {
+						bo.reset()
 						log.Println(resp.StatusCode(), v.ID)
 					}
 				}
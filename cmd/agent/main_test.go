@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -43,3 +47,76 @@ func TestMetricSend(t *testing.T) {
 	}
 	assert.Equal(t, http.StatusOK, resp.StatusCode())
 }
+
+func TestMetricSendThrottled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	testClient := &clientHTTP{client: *resty.New()}
+	resp, err := testClient.MetricSend(ts.URL, metric.Metric{ID: "test", MType: metric.MetricTypeGauge}, &http.Transport{})
+	assert.True(t, errors.Is(err, errThrottled))
+
+	now := time.Now()
+	bo := &backoff{}
+	assert.Equal(t, 7*time.Second, bo.throttle(now, retryAfter(resp, now)))
+	assert.False(t, bo.ready(now.Add(6*time.Second)))
+	assert.True(t, bo.ready(now.Add(7*time.Second)))
+
+	// without Retry-After the wait doubles
+	bo.reset()
+	assert.Equal(t, time.Second, bo.throttle(now, 0))
+	assert.Equal(t, 2*time.Second, bo.throttle(now, 0))
+	assert.Equal(t, 4*time.Second, bo.throttle(now, 0))
+}
+
+func TestMetricSendToken(t *testing.T) {
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	testClient := &clientHTTP{client: *resty.New(), token: "secret"}
+	_, err := testClient.MetricSend(ts.URL, metric.Metric{ID: "test", MType: metric.MetricTypeGauge}, &http.Transport{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer secret", auth)
+}
+
+func TestMetricSendGzip(t *testing.T) {
+	var got metric.Metric
+	ts := httptest.NewServer(validate.Gunzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	})))
+	defer ts.Close()
+
+	testClient := &clientHTTP{client: *resty.New(), gzip: true}
+	_, err := testClient.MetricSend(ts.URL, metric.Metric{ID: "test", MType: metric.MetricTypeCounter, Delta: 3}, &http.Transport{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), got.Delta)
+}
+
+func TestMetricSendRejected(t *testing.T) {
+	status := http.StatusBadRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", status)
+	}))
+	defer ts.Close()
+
+	testClient := &clientHTTP{client: *resty.New()}
+	send := func() error {
+		_, err := testClient.MetricSend(ts.URL, metric.Metric{ID: "test", MType: metric.MetricTypeGauge}, &http.Transport{})
+		return err
+	}
+	for _, status = range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict} {
+		assert.True(t, errors.Is(send(), errRejected), status)
+	}
+
+	// server errors are worth another try
+	status = http.StatusInternalServerError
+	err := send()
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, errRejected))
+}
@@ -0,0 +1,61 @@
+// certgen writes a self-signed dev CA with a server and a client certificate
+// signed by it, enough to run the server and an agent over mTLS locally.
+//
+//	go run ./cmd/certgen -dir certs -hosts localhost,127.0.0.1 -agent agent-1
+//	TLS_CERT_FILE=certs/server.pem TLS_KEY_FILE=certs/server-key.pem TLS_CLIENT_CA_FILE=certs/ca.pem go run ./cmd/server
+//	ADDRESS=https://localhost:8080 TLS_CA_FILE=certs/ca.pem TLS_CERT_FILE=certs/agent-1.pem TLS_KEY_FILE=certs/agent-1-key.pem go run ./cmd/agent
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/tlsconf"
+)
+
+func main() {
+	dir := flag.String("dir", "certs", "output directory")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma separated server host names and IPs")
+	agentsList := flag.String("agent", "agent", "comma separated agent IDs to issue client certificates for")
+	ttl := flag.Duration("ttl", 365*24*time.Hour, "certificate lifetime")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	path := func(name string) string { return filepath.Join(*dir, name) }
+
+	ca, err := tlsconf.NewCA("devops-metrics dev CA", *ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ca.Write(path("ca.pem"), path("ca-key.pem")); err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := ca.Server("devops-metrics server", strings.Split(*hosts, ","), *ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.Write(path("server.pem"), path("server-key.pem")); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, id := range strings.Split(*agentsList, ",") {
+		if id == "" {
+			continue
+		}
+		client, err := ca.Client(id, *ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := client.Write(path(id+".pem"), path(id+"-key.pem")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("Wrote certificates to %s", *dir)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// Routes the agents can send over
+const (
+	ModeURL   = "url"
+	ModeJSON  = "json"
+	ModeBatch = "batch"
+)
+
+// Config describes a run
+type Config struct {
+	Address  string
+	Agents   int
+	Metrics  int
+	Mode     string
+	Rate     float64
+	Duration time.Duration
+	Token    string
+}
+
+// Validate checks the config before a run
+func (c Config) Validate() error {
+	switch {
+	case c.Mode != ModeURL && c.Mode != ModeJSON && c.Mode != ModeBatch:
+		return fmt.Errorf("unknown mode %q, want url, json or batch", c.Mode)
+	case c.Agents < 1 || c.Metrics < 1:
+		return errors.New("agents and metrics must be positive")
+	case c.Rate < 0 || c.Duration <= 0:
+		return errors.New("rate must not be negative and duration must be positive")
+	case !(c.Rate <= float64(time.Second)):
+		// past one per nanosecond the tick interval rounds down to zero
+		return errors.New("rate must be at most 1e9 reports per second")
+	}
+	return nil
+}
+
+// Result sums up a run
+type Result struct {
+	Elapsed  time.Duration
+	Requests int
+	Metrics  int
+	// Errors counts failed requests by status, 0 for transport errors
+	Errors    map[int]int
+	Latencies []time.Duration
+}
+
+// Percentile returns the latency below which p percent of the requests finished
+func (res *Result) Percentile(p float64) time.Duration {
+	if len(res.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(res.Latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(res.Latencies) {
+		i = len(res.Latencies) - 1
+	}
+	return res.Latencies[i]
+}
+
+// Print writes a report of the run
+func (res *Result) Print(w io.Writer) {
+	secs := res.Elapsed.Seconds()
+	failed := 0
+	for _, n := range res.Errors {
+		failed += n
+	}
+	fmt.Fprintf(w, "elapsed      %s\n", res.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "requests     %d (%.1f/s), %d failed\n", res.Requests, float64(res.Requests)/secs, failed)
+	fmt.Fprintf(w, "metrics      %d (%.1f/s)\n", res.Metrics, float64(res.Metrics)/secs)
+	statuses := make([]int, 0, len(res.Errors))
+	for status := range res.Errors {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		name := strconv.Itoa(status)
+		if status == 0 {
+			name = "transport"
+		}
+		fmt.Fprintf(w, "  %-10s %d\n", name, res.Errors[status])
+	}
+	for _, p := range []float64{50, 90, 99, 100} {
+		fmt.Fprintf(w, "latency p%-3g %s\n", p, res.Percentile(p))
+	}
+}
+
+// agent is one simulated agent
+type agent struct {
+	id      string
+	conf    Config
+	client  *http.Client
+	metrics []metric.Metric
+
+	requests  int
+	sent      int
+	errors    map[int]int
+	latencies []time.Duration
+}
+
+func newAgent(i int, conf Config, client *http.Client) *agent {
+	a := &agent{
+		id:      fmt.Sprintf("loadgen-%04d", i),
+		conf:    conf,
+		client:  client,
+		metrics: make([]metric.Metric, conf.Metrics),
+		errors:  make(map[int]int),
+	}
+	for j := range a.metrics {
+		a.metrics[j] = metric.Metric{ID: fmt.Sprintf("Gauge%d", j), MType: metric.MetricTypeGauge}
+		if j%2 == 1 {
+			a.metrics[j] = metric.Metric{ID: fmt.Sprintf("Counter%d", j), MType: metric.MetricTypeCounter}
+		}
+		a.metrics[j].Labels = metric.Labels{"agent": a.id}
+	}
+	return a
+}
+
+// report sends every metric of the agent once
+func (a *agent) report(ctx context.Context, round int) {
+	for j := range a.metrics {
+		a.metrics[j].Value = float64(round)
+		a.metrics[j].Delta = 1
+	}
+	switch a.conf.Mode {
+	case ModeBatch:
+		body, _ := json.Marshal(a.metrics)
+		a.send(ctx, "/updates/", body, len(a.metrics))
+	case ModeJSON:
+		for _, m := range a.metrics {
+			body, _ := json.Marshal(m)
+			a.send(ctx, "/update/", body, 1)
+		}
+	case ModeURL:
+		// the URL route has no labels, so the agent ID goes in the name
+		for _, m := range a.metrics {
+			value := strconv.FormatFloat(m.Value, 'f', -1, 64)
+			if m.MType == metric.MetricTypeCounter {
+				value = strconv.FormatInt(m.Delta, 10)
+			}
+			a.send(ctx, fmt.Sprintf("/update/%s/%s_%s/%s", m.MType, m.ID, a.id, value), nil, 1)
+		}
+	}
+}
+
+func (a *agent) send(ctx context.Context, path string, body []byte, n int) {
+	if ctx.Err() != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.conf.Address+path, bytes.NewReader(body))
+	if err != nil {
+		a.errors[0]++
+		return
+	}
+	req.Header.Set(agents.HeaderID, a.id)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.conf.Token)
+	}
+
+	start := time.Now()
+	resp, err := a.client.Do(req)
+	if err != nil {
+		// requests cut by the end of the run don't count
+		if ctx.Err() == nil {
+			a.requests++
+			a.errors[0]++
+		}
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	a.latencies = append(a.latencies, time.Since(start))
+	a.requests++
+	if resp.StatusCode != http.StatusOK {
+		a.errors[resp.StatusCode]++
+		return
+	}
+	a.sent += n
+}
+
+// Run drives the agents until ctx is done
+func Run(ctx context.Context, client *http.Client, conf Config) *Result {
+	list := make([]*agent, conf.Agents)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range list {
+		a := newAgent(i, conf, client)
+		list[i] = a
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var tick <-chan time.Time
+			if conf.Rate > 0 {
+				t := time.NewTicker(time.Duration(float64(time.Second) / conf.Rate))
+				defer t.Stop()
+				tick = t.C
+			}
+			for round := 0; ctx.Err() == nil; round++ {
+				a.report(ctx, round)
+				if tick == nil {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+				case <-tick:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	res := &Result{Elapsed: time.Since(start), Errors: make(map[int]int)}
+	for _, a := range list {
+		res.Requests += a.requests
+		res.Metrics += a.sent
+		res.Latencies = append(res.Latencies, a.latencies...)
+		for status, n := range a.errors {
+			res.Errors[status] += n
+		}
+	}
+	sort.Slice(res.Latencies, func(i, j int) bool { return res.Latencies[i] < res.Latencies[j] })
+	return res
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	for _, mode := range []string{ModeURL, ModeJSON, ModeBatch} {
+		t.Run(mode, func(t *testing.T) {
+			s := config.NewService(&config.ConfigServer{})
+			mux := chi.NewRouter()
+			mux.Post("/update/", s.PostHandlerMetricsJSON)
+			mux.Post("/update/{type}/{id}/{value}", s.PostHandlerMetricByURL)
+			mux.Post("/updates/", s.PostHandlerMetricsBatchJSON)
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			conf := Config{Address: ts.URL, Agents: 3, Metrics: 4, Mode: mode, Rate: 50, Duration: 200 * time.Millisecond}
+			assert.NoError(t, conf.Validate())
+			ctx, cancel := context.WithTimeout(context.Background(), conf.Duration)
+			defer cancel()
+			res := Run(ctx, ts.Client(), conf)
+
+			assert.Empty(t, res.Errors)
+			assert.Greater(t, res.Metrics, 0)
+			assert.Equal(t, len(res.Latencies), res.Requests)
+			// 3 agents with 2 gauges and 2 counters each
+			assert.Equal(t, 12, s.Len())
+			assert.LessOrEqual(t, int64(res.Percentile(50)), int64(res.Percentile(99)))
+
+			var b bytes.Buffer
+			res.Print(&b)
+			assert.Contains(t, b.String(), "latency p99")
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+	conf := Config{Address: ts.URL, Agents: 1, Metrics: 2, Mode: ModeBatch, Rate: 100, Duration: 50 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Duration)
+	defer cancel()
+	res := Run(ctx, ts.Client(), conf)
+	assert.Zero(t, res.Metrics)
+	assert.Equal(t, res.Requests, res.Errors[http.StatusTooManyRequests])
+}
+
+func TestPercentile(t *testing.T) {
+	res := &Result{}
+	assert.Zero(t, res.Percentile(50))
+	for i := 1; i <= 100; i++ {
+		res.Latencies = append(res.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, res.Percentile(50))
+	assert.Equal(t, 99*time.Millisecond, res.Percentile(99))
+	assert.Equal(t, 100*time.Millisecond, res.Percentile(100))
+	assert.Equal(t, time.Millisecond, res.Percentile(0))
+
+	assert.Error(t, Config{Agents: 1, Metrics: 1, Mode: "grpc", Duration: time.Second}.Validate())
+	assert.Error(t, Config{Agents: 0, Metrics: 1, Mode: ModeURL, Duration: time.Second}.Validate())
+	assert.Error(t, Config{Agents: 1, Metrics: 1, Mode: ModeURL, Rate: 2e9, Duration: time.Second}.Validate())
+	assert.Error(t, Config{Agents: 1, Metrics: 1, Mode: ModeURL, Rate: math.NaN(), Duration: time.Second}.Validate())
+}
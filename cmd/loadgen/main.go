@@ -0,0 +1,55 @@
+// loadgen simulates many agents reporting to a server and reports the
+// throughput and latency it sees.
+//
+//	go run ./cmd/loadgen -a http://localhost:8080 -agents 200 -metrics 30 -mode batch -rate 1 -d 1m
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	conf := Config{}
+	flag.StringVar(&conf.Address, "a", "http://localhost:8080", "server address")
+	flag.IntVar(&conf.Agents, "agents", 10, "number of simulated agents")
+	flag.IntVar(&conf.Metrics, "metrics", 30, "metrics per agent, half gauges and half counters")
+	flag.StringVar(&conf.Mode, "mode", ModeJSON, "route to send over: url, json or batch")
+	flag.Float64Var(&conf.Rate, "rate", 1, "reports per second of every agent, zero sends as fast as possible")
+	flag.DurationVar(&conf.Duration, "d", 10*time.Second, "duration of the run")
+	flag.StringVar(&conf.Token, "t", "", "bearer token with the write role")
+	flag.Parse()
+
+	if err := conf.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Duration)
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConns:        conf.Agents,
+			MaxIdleConnsPerHost: conf.Agents,
+		},
+	}
+	log.Printf("Running %d agents with %d metrics each over %s for %s", conf.Agents, conf.Metrics, conf.Mode, conf.Duration)
+	res := Run(ctx, client, conf)
+	res.Print(os.Stdout)
+}
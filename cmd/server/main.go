@@ -5,22 +5,34 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/alert"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/audit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/auth"
 	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/expiry"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/forward"
 	"github.com/goethesum/-go-musthave-devops-tpl/internal/history"
-	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/meta"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/ratelimit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/rollup"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/stream"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/telemetry"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/tenant"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/tlsconf"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
 )
 
-var srv *config.Service
 var confServ *config.ConfigServer
 
 func main() {
@@ -43,91 +55,409 @@ func main() {
 
 	log.Printf("Address: %s, Path %s, Interval %s, Restore %t", confServ.Address, confServ.StoreFile, confServ.StoreInterval, confServ.Restore)
 
-	srv = config.NewService(confServ)
+	overrides, err := expiry.ParseOverrides(confServ.MetricTTLOverrides)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy := expiry.Policy{TTL: confServ.MetricTTL, Overrides: overrides, Grace: confServ.StaleGrace}
 
-	// Setup service
-	srv = &config.Service{
-		Storage: make(map[string]metric.Metric),
-		Mutex:   &sync.Mutex{},
-		Server:  *confServ,
+	var resolutions []rollup.Resolution
+	if confServ.RollupResolutions != "" {
+		resolutions, err = rollup.ParseResolutions(confServ.RollupResolutions)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// the sweep evicts expired series and rollup buckets past their retention
+	sweep := policy.Enabled() || len(resolutions) > 0
+	if sweep && confServ.SweepInterval <= 0 {
+		log.Fatalf("SWEEP_INTERVAL must be positive when a TTL or rollups are set, got %s", confServ.SweepInterval)
 	}
 
-	server := &http.Server{
-		Addr:    confServ.Address,
-		Handler: router(srv),
+	// One audit log for every tenant, each event names its tenant
+	var auditLog *audit.File
+	if confServ.AuditFile != "" {
+		auditLog, err = audit.NewFile(confServ.AuditFile, confServ.AuditMaxBytes, confServ.AuditMaxBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Handling signal, waiting for graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	go func() {
-		for sig := range sigCh {
-			log.Println("Recieved sig:", sig)
-			fmt.Println("Dying...")
-			server.Shutdown(context.Background())
+	// The server's own metrics, apart from the stored ones
+	tel := telemetry.NewServer(telemetry.NewRegistry())
+
+	// Alerting rules are evaluated for every tenant
+	var rules *alert.Rules
+	if confServ.AlertRulesFile != "" {
+		if confServ.AlertEvalInterval <= 0 {
+			log.Fatalf("ALERT_EVAL_INTERVAL must be positive, got %s", confServ.AlertEvalInterval)
+		}
+		rules, err = alert.LoadRules(confServ.AlertRulesFile)
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
 
-	}()
-	// Restore metrics from STOREFILE
-	if confServ.Restore {
-		r, err := history.NewRestorer(confServ.StoreFile)
+	// Relay updates to upstream servers
+	var fwd *forward.Forwarder
+	if len(confServ.ForwardUpstreams) > 0 {
+		fwd = forward.New(forward.Config{
+			Upstreams:     confServ.ForwardUpstreams,
+			Filter:        confServ.ForwardFilter,
+			Prefix:        confServ.ForwardPrefix,
+			MaxHops:       confServ.ForwardMaxHops,
+			BatchSize:     confServ.ForwardBatchSize,
+			FlushInterval: confServ.ForwardFlushInterval,
+			QueueSize:     confServ.ForwardQueueSize,
+			RetryCount:    confServ.ForwardRetryCount,
+		})
+		tel.Registry.Func("metrics_forward_sent_total", "Updates relayed upstream.", telemetry.KindCounter, func() []telemetry.Sample {
+			return []telemetry.Sample{{Value: float64(fwd.Stats().Sent)}}
+		})
+		tel.Registry.Func("metrics_forward_dropped_total", "Updates dropped because a queue was full.", telemetry.KindCounter, func() []telemetry.Sample {
+			return []telemetry.Sample{{Value: float64(fwd.Stats().Dropped)}}
+		})
+		tel.Registry.Func("metrics_forward_failed_total", "Updates given up on after retries.", telemetry.KindCounter, func() []telemetry.Sample {
+			return []telemetry.Sample{{Value: float64(fwd.Stats().Failed)}}
+		})
+		tel.Registry.Func("metrics_forward_queue_length", "Updates waiting to be relayed.", telemetry.KindGauge, func() []telemetry.Sample {
+			return []telemetry.Sample{{Value: float64(fwd.Stats().Queued)}}
+		})
+		tel.Registry.Func("metrics_forward_lag_seconds", "Age of the oldest update in the last relayed batch.", telemetry.KindGauge, func() []telemetry.Sample {
+			return []telemetry.Sample{{Value: fwd.Stats().Lag.Seconds()}}
+		})
+		log.Printf("Forwarding to %v", confServ.ForwardUpstreams)
+	}
+
+	// newService builds the isolated storage of a tenant
+	newService := func(t tenant.Tenant) *config.Service {
+		conf := *confServ
+		conf.StoreFile = tenant.StoreFile(confServ.StoreFile, t.Name)
+		s := config.NewService(&conf)
+		s.Tenant = t.Name
+		s.MaxMetrics = t.MaxMetrics
+		if t.UpdatesPerSecond > 0 {
+			s.Limiter = ratelimit.NewBucket(t.UpdatesPerSecond, int(math.Ceil(t.UpdatesPerSecond)))
+		}
+
+		// Restore metrics from STOREFILE
+		if conf.Restore && conf.StoreFile != "" {
+			start := time.Now()
+			r, err := history.NewRestorer(conf.StoreFile)
+			if err != nil {
+				log.Println("nothing to restore", err)
+			} else {
+				restored, err := r.RestoreMetrics()
+				if err != nil {
+					log.Fatalf("dying by...:%s", err)
+				}
+				r.Close()
+				for _, m := range restored {
+					s.Storage.Load(m)
+				}
+			}
+			tel.RestoredSeries.With(t.Name).Set(float64(s.Storage.Len()))
+			tel.RestoreDuration.With(t.Name).Set(time.Since(start).Seconds())
+		}
+		s.EnableTelemetry(tel)
+
+		// Lock metric types, implicitly registering the restored ones
+		md := meta.NewRegistry()
+		if conf.MetadataFile != "" {
+			var err error
+			md, err = meta.Load(tenant.StoreFile(conf.MetadataFile, t.Name))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, m := range s.Storage.Metrics(true) {
+			if err := md.Observe(m.ID, m.MType, "", ""); err != nil {
+				log.Printf("restored %s: %s", m.Key(), err)
+			}
+		}
+		s.Meta = md
+
+		// Keep downsampled history
+		if len(resolutions) > 0 {
+			s.EnableRollups(rollup.New(resolutions))
+		}
+		// Push updates to live subscribers
+		s.EnableStream(stream.NewHub(conf.StreamBacklog, conf.StreamBuffer))
+		// Track reporting agents
+		s.EnableAgents(agents.NewRegistry(conf.AgentStaleFactor, conf.AgentForgetAfter, conf.AgentMax))
+		// Evict series that stopped receiving updates
+		if policy.Enabled() {
+			s.Expiry = &policy
+		}
+		// Record every mutation
+		if auditLog != nil {
+			s.EnableAudit(auditLog)
+		}
+		// Relay updates upstream, labeled with the tenant unless it is the default one
+		if fwd != nil {
+			if t.Name == tenant.Default {
+				s.OnUpdate(fwd.Observe)
+			} else {
+				s.OnUpdate(fwd.ObserveTenant(t.Name))
+			}
+		}
+		// Evaluate alerting rules
+		if rules != nil {
+			e := alert.New(s, rules)
+			if t.Name != tenant.Default {
+				e.Tenant = t.Name
+			}
+			s.EnableAlerts(e)
+			e.Run(conf.AlertEvalInterval)
+		}
+		return s
+	}
+
+	var reg *tenant.Registry
+	if confServ.TenantsFile != "" {
+		reg, err = tenant.Load(confServ.TenantsFile, newService)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Tenancy enabled, %d tenants", len(reg.List()))
+	} else {
+		reg = tenant.NewSingle(newService)
+	}
+
+	tel.Registry.Func("metrics_storage_series", "Stored series by tenant.", telemetry.KindGauge, func() []telemetry.Sample {
+		var samples []telemetry.Sample
+		reg.Each(func(name string, svc *config.Service) {
+			samples = append(samples, telemetry.Sample{LabelValues: []string{name}, Value: float64(svc.Len())})
+		})
+		return samples
+	}, "tenant")
+
+	// Authenticate bearer tokens by role
+	var tokens *auth.Tokens
+	if confServ.AuthTokensFile != "" {
+		tokens, err = auth.Load(confServ.AuthTokensFile)
 		if err != nil {
-			log.Println("nothing to restore", err)
+			log.Fatal(err)
 		}
+		log.Printf("Loaded %d tokens from %s", tokens.Len(), confServ.AuthTokensFile)
+	}
 
-		srv.Storage, err = r.RestoreMetrics()
+	// SIGHUP rereads the alerting rules and the tokens file
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			if rules != nil {
+				reg.Each(func(name string, svc *config.Service) {
+					if err := svc.ReloadAlerts(); err != nil {
+						log.Println(err)
+					}
+				})
+			}
+			if tokens != nil {
+				if err := tokens.Reload(); err != nil {
+					log.Println(err)
+					continue
+				}
+				log.Printf("Loaded %d tokens from %s", tokens.Len(), confServ.AuthTokensFile)
+			}
+		}
+	}()
+
+	server := &http.Server{
+		Addr:    confServ.Address,
+		Handler: router(reg, tokens, tel, confServ),
+	}
+	if confServ.TLSCertFile != "" {
+		server.TLSConfig, err = tlsconf.Server(confServ.TLSCertFile, confServ.TLSKeyFile, confServ.TLSClientCAFile)
 		if err != nil {
-			log.Fatalf("dying by...:%s", err)
+			log.Fatal(err)
 		}
-		r.Close()
+		log.Printf("TLS enabled, client certificates required: %t", confServ.TLSClientCAFile != "")
 	}
 
+	// Handling signal, waiting for graceful shutdown
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-sigCh
+		log.Println("Recieved sig:", sig)
+		fmt.Println("Dying...")
+		server.Shutdown(context.Background())
+		if fwd != nil {
+			fwd.Close()
+		}
+		reg.Each(func(name string, svc *config.Service) {
+			if svc.Alerts != nil {
+				svc.Alerts.Close()
+			}
+		})
+		if auditLog != nil {
+			auditLog.Close()
+		}
+		close(stopped)
+	}()
 	if int64(confServ.StoreInterval) > 0 {
 		go func() {
 			tck := time.NewTicker(confServ.StoreInterval)
+			defer tck.Stop()
 
-			select {
-			case <-sigCh:
-				tck.Stop()
-				return
-			case <-tck.C:
-				s, _ := history.NewSaver(srv.Server.StoreFile)
-				s.StoreMetrics(&srv.Storage)
-				defer s.Close()
+			for {
+				select {
+				case <-stopped:
+					return
+				case <-tck.C:
+					reg.Each(func(name string, svc *config.Service) {
+						if err := svc.Save(); err != nil {
+							log.Println(err)
+						}
+					})
+				}
 			}
+		}()
+	}
 
+	if sweep {
+		go func() {
+			tck := time.NewTicker(confServ.SweepInterval)
+			defer tck.Stop()
+
+			for {
+				select {
+				case <-stopped:
+					return
+				case now := <-tck.C:
+					reg.Each(func(name string, svc *config.Service) {
+						svc.Sweep(now)
+					})
+				}
+			}
 		}()
 	}
 
 	log.Println("Starting on port:", confServ.Address)
-	log.Fatal(server.ListenAndServe())
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 
 }
 
-func router(s *config.Service) http.Handler {
+func router(reg *tenant.Registry, tokens *auth.Tokens, tel *telemetry.Server, conf *config.ConfigServer) http.Handler {
 	mux := chi.NewRouter()
 
 	mux.Use(
+		tel.Middleware,
 		middleware.Recoverer,
 		middleware.Logger,
+		forward.Hops,
+		agents.CertIdentity,
+		audit.Origin,
+		validate.Gunzip,
 	)
+	// Throttle every client, keyed by token, agent certificate or IP
+	if tokens != nil {
+		mux.Use(tokens.Identify)
+	}
+	if conf.ClientRate > 0 {
+		mux.Use(ratelimit.NewKeyed(conf.ClientRate, conf.ClientBurst).Middleware)
+	}
+	pass := func(next http.Handler) http.Handler { return next }
+	// Cap the writes handled at once
+	limit := pass
+	if conf.WriteConcurrency > 0 {
+		limit = ratelimit.NewConcurrency(conf.WriteConcurrency).Middleware
+	}
+	// Require a bearer token with the route's role
+	need := func(auth.Role) func(http.Handler) http.Handler { return pass }
+	if tokens != nil {
+		need = tokens.Require
+	}
+	read := need(auth.RoleRead)
+	// agents are recorded once their request passed auth, writes are all they send
+	write := func(next http.Handler) http.Handler { return need(auth.RoleWrite)(trackAgents(limit(next))) }
+	admin := func(next http.Handler) http.Handler { return need(auth.RoleAdmin)(limit(next)) }
 
-	mux.Route("/", func(mux chi.Router) {
-		mux.Get("/", s.GetMetricsAll)
-	})
-	mux.Route("/update", func(mux chi.Router) {
-		mux.Get("/", s.GetMetricsAll)
-		mux.Post("/", s.PostHandlerMetricsJSON)
-		mux.Post("/{type}/{id}/{value}", s.PostHandlerMetricByURL)
+	// The server's own metrics, kept apart from every tenant's metrics
+	mux.With(read).Get("/internal/metrics", tel.Registry.Handler().ServeHTTP)
+
+	// Tenant administration
+	mux.Route("/admin/tenants", func(mux chi.Router) {
+		mux.Use(tenant.AdminOnly(conf.AdminToken))
+		mux.Get("/", reg.GetTenants)
+		mux.Post("/", reg.PostTenant)
+		mux.Post("/{name}/tokens", reg.PostToken)
+		mux.Delete("/{name}/tokens/{id}", reg.DeleteToken)
 	})
-	mux.Route("/value", func(mux chi.Router) {
-		mux.Post("/", s.POSTMetricsByValueJSON)
-		mux.Get("/{type}/{id}", s.GetMetricsByValueURI)
+
+	// Every other route works on the storage of the request's tenant
+	mux.Group(func(mux chi.Router) {
+		mux.Use(reg.Middleware)
+		h := tenant.Handle
+
+		mux.Route("/", func(mux chi.Router) {
+			mux.With(read).Get("/", h((*config.Service).GetMetricsAll))
+		})
+		mux.Route("/update", func(mux chi.Router) {
+			mux.With(read).Get("/", h((*config.Service).GetMetricsAll))
+			mux.With(write).Post("/", h((*config.Service).PostHandlerMetricsJSON))
+			mux.With(write).Post("/{type}/{id}/{value}", h((*config.Service).PostHandlerMetricByURL))
+		})
+		mux.With(write).Post("/updates/", h((*config.Service).PostHandlerMetricsBatchJSON))
+		mux.Route("/value", func(mux chi.Router) {
+			mux.With(read).Post("/", h((*config.Service).POSTMetricsByValueJSON))
+			mux.With(admin).Delete("/", h((*config.Service).DeleteMetrics))
+			mux.With(read).Get("/{type}/{id}", h((*config.Service).GetMetricsByValueURI))
+			mux.With(admin).Delete("/{type}/{id}", h((*config.Service).DeleteMetricByURI))
+		})
+		mux.With(admin).Post("/reset/{id}", h((*config.Service).PostResetCounter))
+		mux.With(write).Post("/v1/metrics", h((*config.Service).PostHandlerOTLP))
+		mux.With(read).Get("/history", h((*config.Service).GetMetricHistory))
+		mux.With(read).Get("/query", h((*config.Service).GetQuery))
+		mux.With(read).Get("/query_range", h((*config.Service).GetQueryRange))
+		mux.Route("/stream", func(mux chi.Router) {
+			mux.Use(read)
+			mux.Get("/", h((*config.Service).GetStreamSSE))
+			mux.Get("/ws", h((*config.Service).GetStreamWS))
+		})
+		mux.Route("/alerts", func(mux chi.Router) {
+			mux.With(read).Get("/", h((*config.Service).GetAlerts))
+			mux.With(admin).Post("/reload", h((*config.Service).PostAlertsReload))
+		})
+		mux.With(read).Get("/api/v1/metrics", h((*config.Service).GetMetricsList))
+		mux.With(read).Get("/metrics", h((*config.Service).GetMetricsPrometheus))
+		mux.Route("/metadata", func(mux chi.Router) {
+			mux.With(read).Get("/", h((*config.Service).GetMetadata))
+			mux.With(write).Post("/", h((*config.Service).PostMetadata))
+			mux.With(read).Get("/{id}", h((*config.Service).GetMetadataByID))
+		})
+		mux.With(read).Get("/expiry", h((*config.Service).GetExpiry))
+		mux.With(need(auth.RoleAdmin)).Get("/audit", h((*config.Service).GetAudit))
+		mux.Route("/agents", func(mux chi.Router) {
+			mux.With(read).Get("/", h((*config.Service).GetAgents))
+			mux.With(write).Post("/heartbeat", h((*config.Service).PostAgentHeartbeat))
+		})
 	})
 
 	return mux
 }
 
+// trackAgents records the agent behind a request in its tenant's registry
+func trackAgents(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, svc, ok := tenant.FromContext(r.Context()); ok {
+			r = svc.AgentSeen(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // curl -X POST http://localhost:8080/value -H 'Content-Type: application/json' -d '{"id":"Sys","type":"gauge"}'
 // Post "http://localhost:8080/update/gauge/githubActionGauge/100"
 // Get "http://localhost:8080/value/gauge/BuckHashSys"
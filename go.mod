@@ -3,8 +3,9 @@ module github.com/goethesum/-go-musthave-devops-tpl
 go 1.16
 
 require (
-	github.com/caarlos0/env/v6 v6.7.1 // indirect
+	github.com/caarlos0/env/v6 v6.7.1
 	github.com/go-chi/chi/v5 v5.0.4
 	github.com/go-resty/resty/v2 v2.6.0
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 )
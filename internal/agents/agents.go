@@ -0,0 +1,245 @@
+package agents
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers an agent sends with every request
+const (
+	HeaderID             = "X-Agent-ID"
+	HeaderHostname       = "X-Agent-Hostname"
+	HeaderOS             = "X-Agent-OS"
+	HeaderVersion        = "X-Agent-Version"
+	HeaderReportInterval = "X-Agent-Report-Interval"
+)
+
+// DefaultReportInterval is assumed for agents that don't tell theirs
+const DefaultReportInterval = 10 * time.Second
+
+// Info describes an agent, as sent in its request headers
+type Info struct {
+	ID             string
+	Hostname       string
+	OS             string
+	Version        string
+	ReportInterval time.Duration
+}
+
+// Header returns the request headers carrying info
+func (info Info) Header() map[string]string {
+	h := map[string]string{
+		HeaderID:       info.ID,
+		HeaderHostname: info.Hostname,
+		HeaderOS:       info.OS,
+		HeaderVersion:  info.Version,
+	}
+	if info.ReportInterval > 0 {
+		h[HeaderReportInterval] = info.ReportInterval.String()
+	}
+	return h
+}
+
+// FromRequest reads the agent headers, ok is false for requests without an agent ID
+func FromRequest(r *http.Request) (Info, bool) {
+	info := Info{
+		ID:       r.Header.Get(HeaderID),
+		Hostname: r.Header.Get(HeaderHostname),
+		OS:       r.Header.Get(HeaderOS),
+		Version:  r.Header.Get(HeaderVersion),
+	}
+	if d, err := time.ParseDuration(r.Header.Get(HeaderReportInterval)); err == nil && d > 0 {
+		info.ReportInterval = d
+	}
+	return info, info.ID != ""
+}
+
+// CertIdentity makes the common name of a verified client certificate the
+// agent ID, overriding the ID the agent sent in its headers. The name is
+// also kept in the context, see CertIDFromContext.
+func CertIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+				r.Header.Set(HeaderID, cn)
+				r = r.WithContext(context.WithValue(r.Context(), certKey{}, cn))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LoadID returns the agent ID kept in path, generating and saving one on first start
+func LoadID(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Agent is the registry entry of an agent
+type Agent struct {
+	ID             string        `json:"id"`
+	Hostname       string        `json:"hostname,omitempty"`
+	OS             string        `json:"os,omitempty"`
+	Version        string        `json:"version,omitempty"`
+	ReportInterval time.Duration `json:"-"`
+	// ReportSeconds is the report interval in seconds
+	ReportSeconds float64   `json:"reportInterval"`
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+	Stale         bool      `json:"stale"`
+	Metrics       []string  `json:"metrics"`
+}
+
+type entry struct {
+	Agent
+	metrics map[string]struct{}
+}
+
+// Registry tracks the agents reporting to a server.
+// An agent is stale once it was silent for StaleFactor report intervals.
+type Registry struct {
+	mu          sync.Mutex
+	staleFactor float64
+	forgetAfter time.Duration
+	max         int
+	agents      map[string]*entry
+	swept       time.Time
+}
+
+// NewRegistry returns a registry that drops agents silent for forgetAfter
+// and tracks at most max agents, zero disables either limit
+func NewRegistry(staleFactor float64, forgetAfter time.Duration, max int) *Registry {
+	if staleFactor <= 0 {
+		staleFactor = 3
+	}
+	return &Registry{
+		staleFactor: staleFactor,
+		forgetAfter: forgetAfter,
+		max:         max,
+		agents:      make(map[string]*entry),
+	}
+}
+
+// sweepEvery bounds how often Seen looks for agents to forget
+const sweepEvery = time.Minute
+
+// Seen records a request of the agent at t. A new agent is ignored while
+// the registry is full.
+func (reg *Registry) Seen(info Info, t time.Time) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	e, ok := reg.agents[info.ID]
+	if !ok {
+		full := reg.max > 0 && len(reg.agents) >= reg.max
+		if full || t.Sub(reg.swept) > sweepEvery {
+			reg.forget(t)
+		}
+		if reg.max > 0 && len(reg.agents) >= reg.max {
+			return
+		}
+		e = &entry{Agent: Agent{ID: info.ID, FirstSeen: t}, metrics: make(map[string]struct{})}
+		reg.agents[info.ID] = e
+	}
+	e.Hostname = info.Hostname
+	e.OS = info.OS
+	e.Version = info.Version
+	e.ReportInterval = info.ReportInterval
+	if t.After(e.LastSeen) {
+		e.LastSeen = t
+	}
+}
+
+// forget drops the agents silent for forgetAfter, the lock must be held
+func (reg *Registry) forget(now time.Time) {
+	reg.swept = now
+	if reg.forgetAfter <= 0 {
+		return
+	}
+	for id, e := range reg.agents {
+		if now.Sub(e.LastSeen) > reg.forgetAfter {
+			delete(reg.agents, id)
+		}
+	}
+}
+
+// Reported records that the agent sent the metric with the given key
+func (reg *Registry) Reported(id, key string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if e, ok := reg.agents[id]; ok {
+		e.metrics[key] = struct{}{}
+	}
+}
+
+// List returns the agents ordered by ID, with staleness as of now
+func (reg *Registry) List(now time.Time) []Agent {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	list := make([]Agent, 0, len(reg.agents))
+	for _, e := range reg.agents {
+		a := e.Agent
+		interval := a.ReportInterval
+		if interval <= 0 {
+			interval = DefaultReportInterval
+		}
+		a.ReportSeconds = interval.Seconds()
+		a.Stale = now.Sub(a.LastSeen) > time.Duration(reg.staleFactor*float64(interval))
+		a.Metrics = make([]string, 0, len(e.metrics))
+		for k := range e.metrics {
+			a.Metrics = append(a.Metrics, k)
+		}
+		sort.Strings(a.Metrics)
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+type ctxKey struct{}
+
+// WithID returns a context carrying the ID of the agent behind a request
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// IDFromContext returns the agent ID put by WithID
+func IDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ctxKey{}).(string)
+	return id, ok
+}
+
+type certKey struct{}
+
+// CertIDFromContext returns the agent ID proven by a client certificate
+func CertIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(certKey{}).(string)
+	return id, ok
+}
@@ -0,0 +1,76 @@
+package agents
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent", "id")
+	id, err := LoadID(path)
+	require.NoError(t, err)
+	assert.Len(t, id, 32)
+
+	again, err := LoadID(path)
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+}
+
+func TestHeaders(t *testing.T) {
+	info := Info{ID: "a1", Hostname: "web-1", OS: "linux/amd64", Version: "1.2.0", ReportInterval: 5 * time.Second}
+	r := httptest.NewRequest("POST", "/update/", nil)
+	for k, v := range info.Header() {
+		r.Header.Set(k, v)
+	}
+	got, ok := FromRequest(r)
+	require.True(t, ok)
+	assert.Equal(t, info, got)
+
+	_, ok = FromRequest(httptest.NewRequest("POST", "/update/", nil))
+	assert.False(t, ok)
+}
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry(3, 0, 0)
+	start := time.Now()
+
+	reg.Seen(Info{ID: "b", ReportInterval: time.Second}, start)
+	reg.Seen(Info{ID: "a", Version: "1"}, start)
+	reg.Seen(Info{ID: "a", Version: "2"}, start.Add(time.Second))
+	reg.Reported("a", "Alloc")
+	reg.Reported("a", "Alloc")
+	reg.Reported("a", "PollCount")
+	reg.Reported("unknown", "Alloc")
+
+	list := reg.List(start.Add(5 * time.Second))
+	require.Len(t, list, 2)
+	assert.Equal(t, "a", list[0].ID)
+	assert.Equal(t, "2", list[0].Version)
+	assert.Equal(t, start, list[0].FirstSeen)
+	assert.Equal(t, start.Add(time.Second), list[0].LastSeen)
+	assert.Equal(t, []string{"Alloc", "PollCount"}, list[0].Metrics)
+	assert.False(t, list[0].Stale, "default interval of 10s")
+	assert.True(t, list[1].Stale, "3 intervals of 1s passed")
+}
+
+func TestRegistryLimits(t *testing.T) {
+	reg := NewRegistry(3, time.Hour, 2)
+	start := time.Now()
+
+	reg.Seen(Info{ID: "a"}, start)
+	reg.Seen(Info{ID: "b"}, start.Add(time.Minute))
+	reg.Seen(Info{ID: "c"}, start.Add(time.Minute))
+	assert.Len(t, reg.List(start), 2, "full")
+
+	// a is forgotten after an hour of silence, which makes room for c
+	reg.Seen(Info{ID: "c"}, start.Add(61*time.Minute))
+	list := reg.List(start)
+	require.Len(t, list, 2)
+	assert.Equal(t, "b", list[0].ID)
+	assert.Equal(t, "c", list[1].ID)
+}
@@ -0,0 +1,335 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+type State string
+
+const (
+	StateInactive State = "inactive"
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+// Source gives the evaluator access to the current metric values
+type Source interface {
+	Lookup(key string) (metric.Metric, bool)
+}
+
+// Status is the evaluation state of a rule as listed by /alerts
+type Status struct {
+	Rule        Rule       `json:"rule"`
+	State       State      `json:"state"`
+	Value       *float64   `json:"value,omitempty"`
+	ActiveSince *time.Time `json:"activeSince,omitempty"`
+	FiredAt     *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// Notification is the JSON body posted to webhooks on firing and resolving
+type Notification struct {
+	Tenant      string            `json:"tenant,omitempty"`
+	Status      State             `json:"status"`
+	Rule        string            `json:"rule"`
+	Metric      string            `json:"metric"`
+	Condition   Condition         `json:"condition"`
+	Op          string            `json:"op,omitempty"`
+	Threshold   float64           `json:"threshold"`
+	Value       *float64          `json:"value,omitempty"`
+	ActiveSince time.Time         `json:"activeSince"`
+	At          time.Time         `json:"at"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+type sample struct {
+	t time.Time
+	v float64
+}
+
+type ruleState struct {
+	state       State
+	value       float64
+	hasValue    bool
+	activeSince time.Time
+	firedAt     time.Time
+	resolvedAt  time.Time
+	samples     []sample
+}
+
+// Engine evaluates rules periodically and notifies webhooks about state changes
+type Engine struct {
+	// Tenant is named in notifications, set it before Run
+	Tenant string
+
+	mu     sync.Mutex
+	src    Source
+	rules  *Rules
+	states map[string]*ruleState
+	seen   map[string]time.Time
+	start  time.Time
+
+	client *resty.Client
+	sends  sync.WaitGroup
+	done   chan struct{}
+	loop   sync.WaitGroup
+}
+
+func New(src Source, rules *Rules) *Engine {
+	if rules == nil {
+		rules = &Rules{}
+	}
+	return &Engine{
+		src:    src,
+		rules:  rules,
+		states: make(map[string]*ruleState),
+		seen:   make(map[string]time.Time),
+		start:  time.Now(),
+		client: resty.New().
+			SetTimeout(10 * time.Second).
+			SetRetryCount(3).
+			SetRetryWaitTime(500 * time.Millisecond).
+			AddRetryCondition(func(r *resty.Response, err error) bool {
+				return err != nil || r.StatusCode() >= http.StatusInternalServerError || r.StatusCode() == http.StatusTooManyRequests
+			}),
+		done: make(chan struct{}),
+	}
+}
+
+// Reload replaces the rules, keeping the state of rules that kept their name
+func (e *Engine) Reload(rules *Rules) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = rules
+	keep := make(map[string]*ruleState)
+	for _, r := range rules.Rules {
+		if st, ok := e.states[r.Name]; ok {
+			keep[r.Name] = st
+		}
+	}
+	e.states = keep
+}
+
+// Seen records an update of the metric with the given key, used by absent rules
+func (e *Engine) Seen(key string, t time.Time) {
+	e.mu.Lock()
+	e.seen[key] = t
+	e.mu.Unlock()
+}
+
+// Run evaluates the rules every interval until Close
+func (e *Engine) Run(interval time.Duration) {
+	e.loop.Add(1)
+	go func() {
+		defer e.loop.Done()
+		tck := time.NewTicker(interval)
+		defer tck.Stop()
+		for {
+			select {
+			case <-e.done:
+				return
+			case now := <-tck.C:
+				e.Evaluate(now)
+			}
+		}
+	}()
+}
+
+// Close stops the evaluation and waits for pending notifications
+func (e *Engine) Close() {
+	close(e.done)
+	e.loop.Wait()
+	e.sends.Wait()
+}
+
+// Evaluate runs every rule once as of now
+func (e *Engine) Evaluate(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, r := range e.rules.Rules {
+		st, ok := e.states[r.Name]
+		if !ok {
+			st = &ruleState{state: StateInactive}
+			e.states[r.Name] = st
+		}
+
+		active, known := e.check(r, st, now)
+		if !known {
+			continue
+		}
+
+		switch {
+		case active && (st.state == StateInactive || st.state == StateResolved):
+			st.activeSince = now
+			st.state = StatePending
+			if r.For.Duration <= 0 {
+				e.fire(r, st, now)
+			}
+		case active && st.state == StatePending:
+			if now.Sub(st.activeSince) >= r.For.Duration {
+				e.fire(r, st, now)
+			}
+		case !active && st.state == StatePending:
+			st.state = StateInactive
+		case !active && st.state == StateFiring:
+			st.state = StateResolved
+			st.resolvedAt = now
+			e.notify(r, st, now)
+		}
+	}
+}
+
+func (e *Engine) fire(r Rule, st *ruleState, now time.Time) {
+	st.state = StateFiring
+	st.firedAt = now
+	e.notify(r, st, now)
+}
+
+// check tells whether the condition of r holds; known is false while
+// there isn't enough data to decide
+func (e *Engine) check(r Rule, st *ruleState, now time.Time) (active bool, known bool) {
+	m, ok := e.src.Lookup(r.Metric)
+
+	if r.Condition == ConditionAbsent {
+		last, seen := e.seen[r.Metric]
+		if !seen {
+			// give metrics restored or not yet reported a full window after start
+			last = e.start
+		}
+		return now.Sub(last) >= r.Window.Duration, true
+	}
+
+	if !ok {
+		st.hasValue = false
+		return false, false
+	}
+	v := m.Value
+	if m.MType == metric.MetricTypeCounter {
+		v = float64(m.Delta)
+	}
+
+	if r.Condition == ConditionValue {
+		st.value, st.hasValue = v, true
+		return ops[r.Op](v, r.Threshold), true
+	}
+
+	// rate over the samples taken during the window
+	st.samples = append(st.samples, sample{t: now, v: v})
+	cutoff := now.Add(-r.Window.Duration)
+	n := 0
+	for n < len(st.samples)-1 && st.samples[n].t.Before(cutoff) {
+		n++
+	}
+	st.samples = st.samples[n:]
+	first, last := st.samples[0], st.samples[len(st.samples)-1]
+	// the samples have to span most of the window
+	if last.t.Sub(first.t) < r.Window.Duration/2 {
+		return false, false
+	}
+	diff := last.v - first.v
+	if m.MType == metric.MetricTypeCounter && diff < 0 {
+		// counter reset
+		diff = last.v
+	}
+	rate := diff / last.t.Sub(first.t).Seconds()
+	st.value, st.hasValue = rate, true
+	return ops[r.Op](rate, r.Threshold), true
+}
+
+func (e *Engine) notify(r Rule, st *ruleState, now time.Time) {
+	n := Notification{
+		Tenant:      e.Tenant,
+		Status:      st.state,
+		Rule:        r.Name,
+		Metric:      r.Metric,
+		Condition:   r.Condition,
+		Op:          r.Op,
+		Threshold:   r.Threshold,
+		ActiveSince: st.activeSince,
+		At:          now,
+		Labels:      r.Labels,
+	}
+	if st.hasValue {
+		v := st.value
+		n.Value = &v
+	}
+
+	hooks := r.Webhooks
+	if len(hooks) == 0 {
+		hooks = e.rules.Webhooks
+	}
+	body, err := json.Marshal(&n)
+	if err != nil {
+		log.Printf("unable to marshal notification for %s: %s", r.Name, err)
+		return
+	}
+	for _, url := range hooks {
+		e.sends.Add(1)
+		go func(url string) {
+			defer e.sends.Done()
+			if err := e.post(url, body); err != nil {
+				log.Printf("unable to notify %s about %s: %s", url, r.Name, err)
+			}
+		}(url)
+	}
+}
+
+func (e *Engine) post(url string, body []byte) error {
+	resp, err := e.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(url)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() >= http.StatusMultipleChoices {
+		return fmt.Errorf("status code [%d]: %s", resp.StatusCode(), string(resp.Body()))
+	}
+	return nil
+}
+
+// Statuses lists the state of every rule ordered by name
+func (e *Engine) Statuses() []Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	list := make([]Status, 0, len(e.rules.Rules))
+	for _, r := range e.rules.Rules {
+		s := Status{Rule: r, State: StateInactive}
+		if st, ok := e.states[r.Name]; ok {
+			s.State = st.state
+			if st.hasValue {
+				v := st.value
+				s.Value = &v
+			}
+			if st.state == StatePending || st.state == StateFiring {
+				s.ActiveSince = timePtr(st.activeSince)
+			}
+			if !st.firedAt.IsZero() {
+				s.FiredAt = timePtr(st.firedAt)
+			}
+			if !st.resolvedAt.IsZero() {
+				s.ResolvedAt = timePtr(st.resolvedAt)
+			}
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Rule.Name < list[j].Rule.Name })
+	return list
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
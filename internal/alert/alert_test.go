@@ -0,0 +1,148 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSource map[string]metric.Metric
+
+func (ts testSource) Lookup(key string) (metric.Metric, bool) {
+	m, ok := ts[key]
+	return m, ok
+}
+
+type receiver struct {
+	mu   sync.Mutex
+	got  []Notification
+	fail int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.fail > 0 {
+		rc.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	n := Notification{}
+	if err := json.NewDecoder(r.Body).Decode(&n); err == nil {
+		rc.got = append(rc.got, n)
+	}
+}
+
+func (rc *receiver) notifications() []Notification {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]Notification(nil), rc.got...)
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"webhooks": ["http://localhost/hook"],
+		"rules": [
+			{"name": "HeapHigh", "metric": "HeapInuse", "condition": "value", "op": ">", "threshold": 100, "for": "5m"},
+			{"name": "PollStalled", "metric": "PollCount", "condition": "absent", "for": "2m"}
+		]
+	}`), 0644))
+
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+	require.Len(t, rules.Rules, 2)
+	assert.Equal(t, 5*time.Minute, rules.Rules[0].For.Duration)
+	assert.Equal(t, time.Minute, rules.Rules[0].Window.Duration)
+	assert.Equal(t, 2*time.Minute, rules.Rules[1].Window.Duration)
+	assert.Equal(t, time.Duration(0), rules.Rules[1].For.Duration)
+
+	bad := &Rules{Rules: []Rule{{Name: "x", Metric: "y", Condition: ConditionValue, Op: "=>"}}}
+	assert.Error(t, bad.Validate())
+}
+
+func TestThresholdLifecycle(t *testing.T) {
+	rc := &receiver{fail: 1}
+	hook := httptest.NewServer(rc)
+	defer hook.Close()
+
+	src := testSource{"HeapInuse": {ID: "HeapInuse", MType: metric.MetricTypeGauge, Value: 50}}
+	rules := &Rules{
+		Webhooks: []string{hook.URL},
+		Rules: []Rule{{
+			Name: "HeapHigh", Metric: "HeapInuse", Condition: ConditionValue,
+			Op: ">", Threshold: 100, For: Duration{time.Minute},
+		}},
+	}
+	require.NoError(t, rules.Validate())
+	e := New(src, rules)
+	e.client.SetRetryWaitTime(time.Millisecond)
+
+	now := time.Now()
+	e.Evaluate(now)
+	assert.Equal(t, StateInactive, e.Statuses()[0].State)
+
+	src["HeapInuse"] = metric.Metric{ID: "HeapInuse", MType: metric.MetricTypeGauge, Value: 150}
+	e.Evaluate(now.Add(15 * time.Second))
+	assert.Equal(t, StatePending, e.Statuses()[0].State)
+
+	e.Evaluate(now.Add(90 * time.Second))
+	assert.Equal(t, StateFiring, e.Statuses()[0].State)
+
+	src["HeapInuse"] = metric.Metric{ID: "HeapInuse", MType: metric.MetricTypeGauge, Value: 10}
+	e.Evaluate(now.Add(2 * time.Minute))
+	st := e.Statuses()[0]
+	assert.Equal(t, StateResolved, st.State)
+	assert.NotNil(t, st.ResolvedAt)
+
+	e.Close()
+	got := rc.notifications()
+	require.Len(t, got, 2)
+	statuses := []State{got[0].Status, got[1].Status}
+	assert.ElementsMatch(t, []State{StateFiring, StateResolved}, statuses)
+	for _, n := range got {
+		if n.Status == StateFiring {
+			assert.Equal(t, 150.0, *n.Value)
+		}
+	}
+}
+
+func TestRateAndAbsent(t *testing.T) {
+	src := testSource{"PollCount": {ID: "PollCount", MType: metric.MetricTypeCounter, Delta: 10}}
+	rules := &Rules{Rules: []Rule{
+		{Name: "PollStalled", Metric: "PollCount", Condition: ConditionRate, Op: "<=", Threshold: 0, Window: Duration{time.Minute}},
+		{Name: "PollGone", Metric: "PollCount", Condition: ConditionAbsent, For: Duration{2 * time.Minute}},
+	}}
+	require.NoError(t, rules.Validate())
+	e := New(src, rules)
+	defer e.Close()
+
+	now := e.start
+	for i := 0; i <= 4; i++ {
+		at := now.Add(time.Duration(i) * 15 * time.Second)
+		src["PollCount"] = metric.Metric{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: int64(10 + i*5)}
+		e.Seen("PollCount", at)
+		e.Evaluate(at)
+	}
+	st := e.Statuses()
+	assert.Equal(t, StateInactive, st[0].State)
+	assert.Equal(t, StateInactive, st[1].State)
+	assert.InDelta(t, 1.0/3, *st[1].Value, 1e-9)
+
+	// the counter stops moving and updates stop arriving
+	for i := 5; i <= 14; i++ {
+		e.Evaluate(now.Add(time.Duration(i) * 15 * time.Second))
+	}
+	st = e.Statuses()
+	assert.Equal(t, StateFiring, st[0].State, "PollGone")
+	assert.Equal(t, StateFiring, st[1].State, "PollStalled")
+}
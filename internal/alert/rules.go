@@ -0,0 +1,122 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type Condition string
+
+const (
+	// ConditionValue compares the current value with the threshold
+	ConditionValue Condition = "value"
+	// ConditionRate compares the per-second rate over Window with the threshold
+	ConditionRate Condition = "rate"
+	// ConditionAbsent holds when the metric got no update during Window
+	ConditionAbsent Condition = "absent"
+)
+
+// Duration is a time.Duration written as "5m" in the rules file
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Rule is a single alerting condition on a metric.
+// The condition has to hold for For before the alert fires.
+type Rule struct {
+	Name      string            `json:"name"`
+	Metric    string            `json:"metric"`
+	Condition Condition         `json:"condition"`
+	Op        string            `json:"op,omitempty"`
+	Threshold float64           `json:"threshold"`
+	Window    Duration          `json:"window"`
+	For       Duration          `json:"for"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	// Webhooks override the file-wide webhooks for this rule
+	Webhooks []string `json:"webhooks,omitempty"`
+}
+
+// Rules is the content of a rules file
+type Rules struct {
+	Webhooks []string `json:"webhooks"`
+	Rules    []Rule   `json:"rules"`
+}
+
+// LoadRules reads and validates a JSON rules file
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := &Rules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rules in %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Validate checks every rule and fills in the default windows
+func (rs *Rules) Validate() error {
+	names := make(map[string]bool)
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		if r.Name == "" {
+			return fmt.Errorf("rule %d has no name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+		if r.Metric == "" {
+			return fmt.Errorf("rule %q has no metric", r.Name)
+		}
+		switch r.Condition {
+		case ConditionValue, ConditionRate:
+			if _, ok := ops[r.Op]; !ok {
+				return fmt.Errorf("rule %q has unknown op %q", r.Name, r.Op)
+			}
+		case ConditionAbsent:
+		default:
+			return fmt.Errorf("rule %q has unknown condition %q", r.Name, r.Condition)
+		}
+		if r.Condition == ConditionAbsent && r.Window.Duration <= 0 && r.For.Duration > 0 {
+			// "absent for 2m" means no update in 2m, not 2m plus 2m pending
+			r.Window, r.For = r.For, Duration{}
+		}
+		if r.Window.Duration <= 0 {
+			r.Window.Duration = time.Minute
+		}
+	}
+	return nil
+}
+
+var ops = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
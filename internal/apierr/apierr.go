@@ -0,0 +1,82 @@
+package apierr
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Codes shared by the handlers, validation adds its own
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeBodyTooLarge     = "body_too_large"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeUnprocessable    = "unprocessable"
+	CodeRateLimited      = "rate_limited"
+	CodeInternal         = "internal"
+	CodeUnavailable      = "unavailable"
+)
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodeBodyTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMedia,
+	http.StatusUnprocessableEntity:   CodeUnprocessable,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// Err is an error with the response it should produce
+type Err struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Field names the offending input, if any
+	Field string `json:"field,omitempty"`
+}
+
+func (e *Err) Error() string {
+	if e.Field != "" {
+		return e.Field + ": " + e.Message
+	}
+	return e.Message
+}
+
+// New returns an error answered with status and code
+func New(status int, code, field, message string) *Err {
+	return &Err{Status: status, Code: code, Field: field, Message: message}
+}
+
+// Response is the body of every error response
+type Response struct {
+	Error *Err `json:"error"`
+}
+
+// Write answers with e as a JSON error body
+func Write(w http.ResponseWriter, e *Err) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(Response{Error: e}); err != nil {
+		log.Println(err)
+	}
+}
+
+// Error is the JSON counterpart of http.Error, the code follows from the status
+func Error(w http.ResponseWriter, message string, status int) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInternal
+	}
+	Write(w, New(status, code, "", message))
+}
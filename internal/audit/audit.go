@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// Actions recorded for mutations
+const (
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	ActionReset  = "reset"
+	ActionImport = "import"
+)
+
+// Event is a record of a change to a single series
+type Event struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Tenant string    `json:"tenant,omitempty"`
+	// ID and Key name the changed series
+	ID  string `json:"id"`
+	Key string `json:"key"`
+	// Old is nil for new series, New is nil for deleted ones
+	Old *metric.Metric `json:"old,omitempty"`
+	New *metric.Metric `json:"new,omitempty"`
+	// Addr, Agent and Token identify the client
+	Addr  string `json:"addr,omitempty"`
+	Agent string `json:"agent,omitempty"`
+	Token string `json:"token,omitempty"`
+	// Route is the method and route pattern of the request
+	Route  string `json:"route,omitempty"`
+	DryRun bool   `json:"dryRun,omitempty"`
+}
+
+// Sink receives audit events
+type Sink interface {
+	Record(e Event)
+}
+
+// Filter selects events, zero fields match everything
+type Filter struct {
+	Tenant string
+	// ID matches the metric ID or the series key
+	ID    string
+	Since time.Time
+	// Limit keeps the most recent events
+	Limit int
+}
+
+// Match reports whether e passes the filter
+func (f Filter) Match(e Event) bool {
+	if f.Tenant != "" && e.Tenant != f.Tenant {
+		return false
+	}
+	if f.ID != "" && e.ID != f.ID && e.Key != f.ID {
+		return false
+	}
+	return f.Since.IsZero() || !e.Time.Before(f.Since)
+}
+
+// Querier is a sink which can read its events back
+type Querier interface {
+	Query(f Filter) ([]Event, error)
+}
+
+// LogSink writes events as JSON to the standard logger
+type LogSink struct{}
+
+func (LogSink) Record(e Event) {
+	data, err := json.Marshal(&e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("audit: %s", data)
+}
+
+type addrKey struct{}
+type actionKey struct{}
+
+// Origin keeps the client address of a request in its context, so events
+// recorded away from the request still know who sent it
+func Origin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithAddr(r.Context(), r.RemoteAddr)))
+	})
+}
+
+// WithAddr returns a context carrying the client address
+func WithAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, addrKey{}, addr)
+}
+
+// AddrFromContext returns the address put by WithAddr
+func AddrFromContext(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(addrKey{}).(string)
+	return addr, ok
+}
+
+// WithAction returns a context recording updates made with it as action
+func WithAction(ctx context.Context, action string) context.Context {
+	return context.WithValue(ctx, actionKey{}, action)
+}
+
+// ActionFromContext returns the action put by WithAction, ActionUpdate by default
+func ActionFromContext(ctx context.Context) string {
+	if action, ok := ctx.Value(actionKey{}).(string); ok {
+		return action
+	}
+	return ActionUpdate
+}
@@ -0,0 +1,186 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// File appends events as JSON lines. Once the file would grow past MaxBytes
+// it is rotated to path.1, path.1 to path.2 and so on, keeping Backups files.
+type File struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	f        *os.File
+	size     int64
+}
+
+// NewFile opens path for appending, maxBytes of zero never rotates
+func NewFile(path string, maxBytes int64, backups int) (*File, error) {
+	if backups < 1 {
+		backups = 1
+	}
+	af := &File{path: path, maxBytes: maxBytes, backups: backups}
+	if err := af.open(); err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+func (af *File) open() error {
+	f, err := os.OpenFile(af.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	af.f, af.size = f, info.Size()
+	return nil
+}
+
+func (af *File) backup(i int) string {
+	return fmt.Sprintf("%s.%d", af.path, i)
+}
+
+func (af *File) rotate() error {
+	if err := af.f.Close(); err != nil {
+		return err
+	}
+	for i := af.backups - 1; i >= 1; i-- {
+		if err := os.Rename(af.backup(i), af.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(af.path, af.backup(1)); err != nil {
+		return err
+	}
+	return af.open()
+}
+
+// Record appends e, errors are logged as an audit log must not fail updates
+func (af *File) Record(e Event) {
+	data, err := json.Marshal(&e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	data = append(data, '\n')
+
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	if af.f == nil {
+		return
+	}
+	if af.maxBytes > 0 && af.size > 0 && af.size+int64(len(data)) > af.maxBytes {
+		if err := af.rotate(); err != nil {
+			log.Printf("unable to rotate %s: %s", af.path, err)
+			if af.f == nil {
+				return
+			}
+		}
+	}
+	n, err := af.f.Write(data)
+	af.size += int64(n)
+	if err != nil {
+		log.Printf("unable to write to %s: %s", af.path, err)
+	}
+}
+
+// Query reads the rotated files and the current one, oldest first, and
+// returns the matching events in the order they were recorded
+func (af *File) Query(f Filter) ([]Event, error) {
+	files, err := af.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, r := range files {
+			r.Close()
+		}
+	}()
+
+	var events []Event
+	for _, r := range files {
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var e Event
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				continue
+			}
+			if !f.Match(e) {
+				continue
+			}
+			events = append(events, e)
+			if f.Limit > 0 && len(events) > f.Limit {
+				events = events[1:]
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// limitedFile reads an open file up to the size it had when opened
+type limitedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (lf limitedFile) Close() error {
+	return lf.f.Close()
+}
+
+// snapshot opens the files oldest first under the lock, so reading them
+// later doesn't hold up Record. Open files survive a rotation, and the
+// current one is only read as far as it was written when opened.
+func (af *File) snapshot() ([]io.ReadCloser, error) {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	var files []io.ReadCloser
+	for i := af.backups; i >= 0; i-- {
+		path := af.path
+		if i > 0 {
+			path = af.backup(i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, r := range files {
+				r.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			files = append(files, limitedFile{Reader: io.LimitReader(file, af.size), f: file})
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Close closes the file, later events are dropped
+func (af *File) Close() error {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	if af.f == nil {
+		return nil
+	}
+	err := af.f.Close()
+	af.f = nil
+	return err
+}
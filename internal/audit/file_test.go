@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	af, err := NewFile(path, 400, 2)
+	require.NoError(t, err)
+	defer af.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		id := "a"
+		if i%2 == 1 {
+			id = "b"
+		}
+		m := metric.Metric{ID: id, MType: metric.MetricTypeCounter, Delta: int64(i)}
+		af.Record(Event{Time: start.Add(time.Duration(i) * time.Second), Action: ActionUpdate, ID: id, Key: id, New: &m})
+	}
+
+	// rotated, keeping two backups
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(400))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	events, err := af.Query(Filter{})
+	require.NoError(t, err)
+	require.NotEmpty(t, events)
+	assert.Equal(t, int64(19), events[len(events)-1].New.Delta)
+	for i := 1; i < len(events); i++ {
+		assert.True(t, events[i-1].Time.Before(events[i].Time))
+	}
+
+	events, err = af.Query(Filter{ID: "a", Since: start.Add(10 * time.Second), Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, int64(16), events[0].New.Delta)
+	assert.Equal(t, int64(18), events[1].New.Delta)
+
+	// reopening appends
+	require.NoError(t, af.Close())
+	af, err = NewFile(path, 400, 2)
+	require.NoError(t, err)
+	af.Record(Event{Time: start.Add(time.Minute), Action: ActionDelete, ID: "a", Key: "a"})
+	events, err = af.Query(Filter{Since: start.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, ActionDelete, events[0].Action)
+}
+
+func TestFileQueryWhileRecording(t *testing.T) {
+	af, err := NewFile(filepath.Join(t.TempDir(), "audit.jsonl"), 2000, 3)
+	require.NoError(t, err)
+	defer af.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			af.Record(Event{Time: start.Add(time.Duration(i) * time.Second), Action: ActionUpdate, ID: "a", Key: "a"})
+		}
+	}()
+
+	// queries see whole events in order while the file grows and rotates
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		events, err := af.Query(Filter{})
+		require.NoError(t, err)
+		for i := 1; i < len(events); i++ {
+			require.True(t, events[i-1].Time.Before(events[i].Time))
+		}
+	}
+}
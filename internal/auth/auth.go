@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+)
+
+// Role grants access to a group of routes
+type Role string
+
+const (
+	// RoleRead reads metrics, history, alerts and metadata
+	RoleRead Role = "read"
+	// RoleWrite sends updates
+	RoleWrite Role = "write"
+	// RoleAdmin deletes and resets metrics and implies every other role
+	RoleAdmin Role = "admin"
+)
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// Token is an entry of the tokens file. Only the hex SHA-256 of the secret is
+// kept, e.g. the output of `printf %s "$SECRET" | sha256sum`.
+type Token struct {
+	ID    string `json:"id"`
+	Hash  string `json:"hash"`
+	Roles []Role `json:"roles"`
+}
+
+// Has reports whether the token grants role
+func (t Token) Has(role Role) bool {
+	for _, r := range t.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens authenticates bearer tokens against a tokens file
+type Tokens struct {
+	mu     sync.RWMutex
+	path   string
+	byHash map[string]Token
+}
+
+// Hash returns the hash kept in the tokens file for secret
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Load reads the tokens file
+func Load(path string) (*Tokens, error) {
+	t := &Tokens{path: path}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload rereads the tokens file, keeping the current tokens when it is invalid
+func (t *Tokens) Reload() error {
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Tokens []Token `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("unable to parse %s: %w", t.path, err)
+	}
+	byHash := make(map[string]Token, len(file.Tokens))
+	for _, tok := range file.Tokens {
+		tok.Hash = strings.ToLower(strings.TrimSpace(tok.Hash))
+		if len(tok.Hash) != sha256.Size*2 {
+			return fmt.Errorf("%s: token %q: hash is not a hex SHA-256", t.path, tok.ID)
+		}
+		for _, r := range tok.Roles {
+			if r != RoleRead && r != RoleWrite && r != RoleAdmin {
+				return fmt.Errorf("%s: token %q: %w %q", t.path, tok.ID, ErrUnknownRole, r)
+			}
+		}
+		byHash[tok.Hash] = tok
+	}
+
+	t.mu.Lock()
+	t.byHash = byHash
+	t.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of tokens
+func (t *Tokens) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.byHash)
+}
+
+// Lookup returns the token with the given secret
+func (t *Tokens) Lookup(secret string) (Token, bool) {
+	if secret == "" {
+		return Token{}, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tok, ok := t.byHash[Hash(secret)]
+	return tok, ok
+}
+
+// Require answers 401 to requests without a known bearer token and 403 to
+// tokens lacking role
+func (t *Tokens) Require(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tok, ok := t.Lookup(bearer(r))
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				apierr.Error(w, "missing or unknown token", http.StatusUnauthorized)
+				return
+			}
+			if !tok.Has(role) {
+				apierr.Error(w, fmt.Sprintf("token lacks the %s role", role), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithTokenID(r.Context(), tok.ID)))
+		})
+	}
+}
+
+// Identify records the ID of a valid bearer token in the request context,
+// without rejecting requests that have none
+func (t *Tokens) Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tok, ok := t.Lookup(bearer(r)); ok {
+			r = r.WithContext(WithTokenID(r.Context(), tok.ID))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bearer(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+type ctxKey struct{}
+
+// WithTokenID returns a context carrying the ID of the token behind a request
+func WithTokenID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// TokenIDFromContext returns the token ID put by WithTokenID
+func TokenIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ctxKey{}).(string)
+	return id, ok
+}
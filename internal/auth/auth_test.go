@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTokens(t *testing.T, path, body string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(body), 0600))
+}
+
+func TestRequire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokens(t, path, `{"tokens":[
+		{"id":"grafana","hash":"`+Hash("r-secret")+`","roles":["read"]},
+		{"id":"agent","hash":"`+Hash("w-secret")+`","roles":["write"]},
+		{"id":"ops","hash":"`+Hash("a-secret")+`","roles":["admin"]}
+	]}`)
+	tokens, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, tokens.Len())
+
+	var actor string
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, _ = TokenIDFromContext(r.Context())
+	})
+	do := func(role Role, secret string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if secret != "" {
+			r.Header.Set("Authorization", "Bearer "+secret)
+		}
+		w := httptest.NewRecorder()
+		tokens.Require(role)(ok).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(RoleRead, ""))
+	assert.Equal(t, http.StatusUnauthorized, do(RoleRead, "nope"))
+	assert.Equal(t, http.StatusOK, do(RoleRead, "r-secret"))
+	assert.Equal(t, "grafana", actor)
+	assert.Equal(t, http.StatusForbidden, do(RoleWrite, "r-secret"))
+	assert.Equal(t, http.StatusOK, do(RoleWrite, "w-secret"))
+	assert.Equal(t, http.StatusForbidden, do(RoleRead, "w-secret"))
+	assert.Equal(t, http.StatusOK, do(RoleRead, "a-secret"))
+	assert.Equal(t, http.StatusOK, do(RoleAdmin, "a-secret"))
+	assert.Equal(t, http.StatusForbidden, do(RoleAdmin, "w-secret"))
+
+	// an invalid file keeps the loaded tokens
+	writeTokens(t, path, `{"tokens":[{"id":"x","hash":"`+Hash("x")+`","roles":["root"]}]}`)
+	assert.ErrorIs(t, tokens.Reload(), ErrUnknownRole)
+	assert.Equal(t, http.StatusOK, do(RoleRead, "r-secret"))
+
+	writeTokens(t, path, `{"tokens":[{"id":"grafana","hash":"`+Hash("r2-secret")+`","roles":["read"]}]}`)
+	require.NoError(t, tokens.Reload())
+	assert.Equal(t, http.StatusUnauthorized, do(RoleRead, "r-secret"))
+	assert.Equal(t, http.StatusOK, do(RoleRead, "r2-secret"))
+}
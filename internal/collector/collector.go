@@ -0,0 +1,280 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// Collector is a source of agent metrics
+type Collector interface {
+	Name() string
+	// Collect writes the current metrics into sink, it gives up once ctx is done
+	Collect(ctx context.Context, sink Sink) error
+}
+
+// Sink receives collected metrics, it must be safe for concurrent use
+type Sink interface {
+	Add(m metric.Metric)
+}
+
+// Factory builds a collector from the agent config
+type Factory func(conf *config.ConfigAgent) (Collector, error)
+
+var factories = make(map[string]Factory)
+
+// Register makes a collector available under name, registering a name twice panics
+func Register(name string, f Factory) {
+	if _, ok := factories[name]; ok {
+		panic("collector: " + name + " registered twice")
+	}
+	factories[name] = f
+}
+
+// Names returns the registered collector names, sorted
+func Names() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Settings control how often a collector runs and how long it may take
+type Settings struct {
+	Interval time.Duration
+	// Timeout cancels the context of a Collect, zero means the interval
+	Timeout time.Duration
+}
+
+type entry struct {
+	Collector
+	Settings
+	enabled uint32
+}
+
+// Registry runs collectors, each on its own interval
+type Registry struct {
+	mu      sync.Mutex
+	entries []*entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Add registers an enabled collector, adding a name twice is an error
+func (reg *Registry) Add(c Collector, s Settings) error {
+	if s.Interval <= 0 {
+		return fmt.Errorf("collector %s: interval must be positive", c.Name())
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = s.Interval
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, e := range reg.entries {
+		if e.Name() == c.Name() {
+			return fmt.Errorf("collector %s added twice", c.Name())
+		}
+	}
+	reg.entries = append(reg.entries, &entry{Collector: c, Settings: s, enabled: 1})
+	return nil
+}
+
+// Enable turns a collector on or off, a disabled collector skips its runs
+func (reg *Registry) Enable(name string, on bool) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, e := range reg.entries {
+		if e.Name() == name {
+			var v uint32
+			if on {
+				v = 1
+			}
+			atomic.StoreUint32(&e.enabled, v)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown collector %q", name)
+}
+
+// Enabled returns the names of the enabled collectors
+func (reg *Registry) Enabled() []string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var names []string
+	for _, e := range reg.entries {
+		if atomic.LoadUint32(&e.enabled) == 1 {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// Run collects into sink until ctx is done. Every collector runs once right
+// away and then on its interval, a run still going when the next is due
+// delays it rather than overlapping.
+func (reg *Registry) Run(ctx context.Context, sink Sink) {
+	reg.mu.Lock()
+	entries := append([]*entry(nil), reg.entries...)
+	reg.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+			tick := time.NewTicker(e.Interval)
+			defer tick.Stop()
+			for {
+				if atomic.LoadUint32(&e.enabled) == 1 {
+					e.collect(ctx, sink)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick.C:
+				}
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (e *entry) collect(ctx context.Context, sink Sink) {
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+	// a broken collector must not take the agent down
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("collector %s panicked: %v", e.Name(), p)
+		}
+	}()
+	if err := e.Collect(ctx, sink); err != nil {
+		log.Printf("collector %s: %s", e.Name(), err)
+	}
+}
+
+// FromConfig builds a registry of the collectors enabled in conf.
+// Collectors run every PollInterval unless conf overrides it.
+func FromConfig(conf *config.ConfigAgent) (*Registry, error) {
+	intervals, err := parseDurations(conf.CollectorIntervals)
+	if err != nil {
+		return nil, fmt.Errorf("collector intervals: %w", err)
+	}
+	timeouts, err := parseDurations(conf.CollectorTimeouts)
+	if err != nil {
+		return nil, fmt.Errorf("collector timeouts: %w", err)
+	}
+
+	reg := NewRegistry()
+	for _, name := range conf.Collectors {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, ok := factories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %q, known are %s", name, strings.Join(Names(), ", "))
+		}
+		c, err := f(conf)
+		if err != nil {
+			return nil, fmt.Errorf("collector %s: %w", name, err)
+		}
+		s := Settings{Interval: conf.PollInterval, Timeout: timeouts[name]}
+		if d, ok := intervals[name]; ok {
+			s.Interval = d
+		}
+		if err := reg.Add(c, s); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// parseDurations reads a "name:duration" list
+func parseDurations(list []string) (map[string]time.Duration, error) {
+	res := make(map[string]time.Duration, len(list))
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not name:duration", item)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("wrong duration in %q", item)
+		}
+		res[parts[0]] = d
+	}
+	return res, nil
+}
+
+// Buffer is a Sink keeping metrics until they are reported. Counter deltas
+// add up between reports, any other metric keeps its latest value.
+type Buffer struct {
+	mu      sync.Mutex
+	metrics map[string]metric.Metric
+}
+
+func NewBuffer() *Buffer {
+	return &Buffer{metrics: make(map[string]metric.Metric)}
+}
+
+func (b *Buffer) Add(m metric.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := m.Key()
+	if old, ok := b.metrics[key]; ok && m.MType == metric.MetricTypeCounter && old.MType == m.MType {
+		m.Delta += old.Delta
+	}
+	b.metrics[key] = m
+}
+
+// Drain returns the buffered metrics ordered by key. Counters are removed,
+// so the next Drain holds only the deltas collected in between, the other
+// metrics stay and are reported again.
+func (b *Buffer) Drain() []metric.Metric {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]metric.Metric, 0, len(b.metrics))
+	for key, m := range b.metrics {
+		list = append(list, m)
+		if m.MType == metric.MetricTypeCounter {
+			delete(b.metrics, key)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key() < list[j].Key() })
+	return list
+}
+
+// Return puts back drained metrics that were not reported. Counter deltas
+// are added to the ones collected since, other metrics only fill gaps.
+func (b *Buffer) Return(list ...metric.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range list {
+		key := m.Key()
+		old, ok := b.metrics[key]
+		switch {
+		case !ok:
+			b.metrics[key] = m
+		case m.MType == metric.MetricTypeCounter && old.MType == m.MType:
+			old.Delta += m.Delta
+			b.metrics[key] = old
+		}
+	}
+}
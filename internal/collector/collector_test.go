@@ -0,0 +1,137 @@
+package collector
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fake struct {
+	name  string
+	runs  int32
+	block bool
+	err   int32
+}
+
+func (f *fake) Name() string { return f.name }
+
+func (f *fake) Collect(ctx context.Context, sink Sink) error {
+	atomic.AddInt32(&f.runs, 1)
+	if f.block {
+		<-ctx.Done()
+		atomic.AddInt32(&f.err, 1)
+		return ctx.Err()
+	}
+	sink.Add(metric.Metric{ID: f.name, MType: metric.MetricTypeCounter, Delta: 1})
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	fast := &fake{name: "fast"}
+	slow := &fake{name: "slow", block: true}
+	off := &fake{name: "off"}
+
+	reg := NewRegistry()
+	require.NoError(t, reg.Add(fast, Settings{Interval: 10 * time.Millisecond}))
+	require.NoError(t, reg.Add(slow, Settings{Interval: time.Hour, Timeout: 20 * time.Millisecond}))
+	require.NoError(t, reg.Add(off, Settings{Interval: 10 * time.Millisecond}))
+	assert.Error(t, reg.Add(&fake{name: "fast"}, Settings{Interval: time.Second}))
+	assert.Error(t, reg.Add(&fake{name: "zero"}, Settings{}))
+	require.NoError(t, reg.Enable("off", false))
+	assert.Error(t, reg.Enable("nope", true))
+	assert.Equal(t, []string{"fast", "slow"}, reg.Enabled())
+
+	buf := NewBuffer()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	reg.Run(ctx, buf)
+
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&fast.runs), int32(5))
+	// the slow collector was cut off by its timeout, not by the end of the run
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slow.runs))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slow.err))
+	assert.Zero(t, atomic.LoadInt32(&off.runs))
+
+	list := buf.Drain()
+	require.Len(t, list, 1)
+	assert.Equal(t, int64(atomic.LoadInt32(&fast.runs)), list[0].Delta)
+}
+
+func TestBuffer(t *testing.T) {
+	buf := NewBuffer()
+	buf.Add(metric.Metric{ID: "c", MType: metric.MetricTypeCounter, Delta: 2})
+	buf.Add(metric.Metric{ID: "c", MType: metric.MetricTypeCounter, Delta: 3})
+	buf.Add(metric.Metric{ID: "g", MType: metric.MetricTypeGauge, Value: 1})
+	buf.Add(metric.Metric{ID: "g", MType: metric.MetricTypeGauge, Value: 2})
+
+	list := buf.Drain()
+	require.Len(t, list, 2)
+	assert.Equal(t, int64(5), list[0].Delta)
+	assert.Equal(t, 2.0, list[1].Value)
+
+	// counters start over, gauges are reported again
+	list = buf.Drain()
+	require.Len(t, list, 1)
+	assert.Equal(t, "g", list[0].ID)
+
+	// unreported deltas add to new ones, an old gauge doesn't replace a newer one
+	buf.Add(metric.Metric{ID: "c", MType: metric.MetricTypeCounter, Delta: 1})
+	buf.Add(metric.Metric{ID: "g", MType: metric.MetricTypeGauge, Value: 3})
+	buf.Return(
+		metric.Metric{ID: "c", MType: metric.MetricTypeCounter, Delta: 5},
+		metric.Metric{ID: "g", MType: metric.MetricTypeGauge, Value: 2},
+	)
+	list = buf.Drain()
+	require.Len(t, list, 2)
+	assert.Equal(t, int64(6), list[0].Delta)
+	assert.Equal(t, 3.0, list[1].Value)
+}
+
+func TestFromConfig(t *testing.T) {
+	conf := &config.ConfigAgent{
+		PollInterval:       2 * time.Second,
+		Collectors:         []string{"memstats", "pollcount", "random"},
+		CollectorIntervals: []string{"random:5s"},
+	}
+	reg, err := FromConfig(conf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"memstats", "pollcount", "random"}, reg.Enabled())
+	assert.Equal(t, 2*time.Second, reg.entries[0].Interval)
+	assert.Equal(t, 5*time.Second, reg.entries[2].Interval)
+	assert.Equal(t, 5*time.Second, reg.entries[2].Timeout)
+
+	conf.Collectors = []string{"nope"}
+	_, err = FromConfig(conf)
+	assert.Error(t, err)
+
+	conf.Collectors = []string{"random"}
+	conf.CollectorTimeouts = []string{"random"}
+	_, err = FromConfig(conf)
+	assert.Error(t, err)
+}
+
+func TestRuntime(t *testing.T) {
+	buf := NewBuffer()
+	for _, c := range []Collector{MemStats{}, PollCount{}, PollCount{}, RandomValue{}} {
+		require.NoError(t, c.Collect(context.Background(), buf))
+	}
+	byID := make(map[string]metric.Metric)
+	for _, m := range buf.Drain() {
+		byID[m.ID] = m
+	}
+	assert.Len(t, byID, len(memStats)+2)
+	assert.Greater(t, byID["Sys"].Value, 0.0)
+	// every memstat carries its value, a counter would only send Delta
+	for _, id := range []string{"GCSys", "Frees", "HeapObjects", "LastGC"} {
+		assert.Equal(t, metric.MetricTypeGauge, byID[id].MType, id)
+	}
+	assert.Greater(t, byID["HeapObjects"].Value, 0.0)
+	assert.Equal(t, int64(2), byID["PollCount"].Delta)
+	assert.Equal(t, metric.MetricTypeGauge, byID["RandomValue"].MType)
+}
@@ -0,0 +1,69 @@
+package collector
+
+import (
+	"sync"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// cumulative turns counters read as running totals into the deltas the
+// agent reports. Counters read by the first collection only set the
+// baseline, so a restarted agent doesn't count a total twice. Counters that
+// show up later report their whole total, and a counter going down was
+// reset and reports its new total.
+type cumulative struct {
+	mu sync.Mutex
+	// last holds the last total per series key of every source
+	last map[string]map[string]int64
+	// primed is set once the first collection is done
+	primed bool
+}
+
+func newCumulative() *cumulative {
+	return &cumulative{last: make(map[string]map[string]int64)}
+}
+
+// deltas rewrites the counters of list, read from source, into deltas
+func (c *cumulative) deltas(source string, list []metric.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.last[source]
+	next := make(map[string]int64)
+	for i := range list {
+		m := &list[i]
+		if m.MType != metric.MetricTypeCounter {
+			continue
+		}
+		key := m.Key()
+		total := m.Delta
+		next[key] = total
+		last, ok := prev[key]
+		switch {
+		case !ok && !c.primed:
+			m.Delta = 0
+		case !ok:
+			// new since the agent started, the whole total is reported
+		case total >= last:
+			m.Delta = total - last
+		}
+	}
+	c.last[source] = next
+}
+
+// prime ends the first collection, counters seen from now on are new
+func (c *cumulative) prime() {
+	c.mu.Lock()
+	c.primed = true
+	c.mu.Unlock()
+}
+
+// keep forgets the sources not in sources
+func (c *cumulative) keep(sources map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for source := range c.last {
+		if !sources[source] {
+			delete(c.last, source)
+		}
+	}
+}
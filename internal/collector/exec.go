@@ -0,0 +1,229 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
+)
+
+func init() {
+	Register("exec", func(conf *config.ConfigAgent) (Collector, error) {
+		if conf.ExecConfigFile == "" {
+			return nil, errors.New("EXEC_CONFIG_FILE is not set")
+		}
+		return LoadExec(conf.ExecConfigFile)
+	})
+}
+
+// maxOutputBytes bounds the stdout kept from a command, the rest is dropped
+const maxOutputBytes = 1 << 20
+
+// Duration is a time.Duration written as "5s" in config files
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Command is a program whose stdout is parsed with ParseLines
+type Command struct {
+	Name    string            `json:"name"`
+	Command []string          `json:"command"`
+	Dir     string            `json:"dir,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	// Timeout kills the command, the collector timeout applies when zero
+	Timeout Duration `json:"timeout,omitempty"`
+	// Prefix is prepended to the IDs the command prints
+	Prefix string `json:"prefix,omitempty"`
+	// Labels are added to the metrics the command prints
+	Labels metric.Labels `json:"labels,omitempty"`
+}
+
+// Exec runs commands concurrently on every Collect. Commands print counters
+// as running totals, like textfiles, and they are reported as deltas.
+// Next to their output it reports for each command, labeled command=<name>:
+//
+//	exec_exit_code         gauge, -1 when the command didn't start or was killed
+//	exec_duration_seconds  gauge
+//	exec_timeouts          counter
+//	exec_parse_errors      counter of output lines that didn't parse
+type Exec struct {
+	Commands []Command `json:"commands"`
+
+	counters *cumulative
+}
+
+// LoadExec reads and validates a JSON exec config file
+func LoadExec(path string) (*Exec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exec{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	if err := e.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid commands in %s: %w", path, err)
+	}
+	return e, nil
+}
+
+// Validate checks that every command has a unique name and a program to run
+// and readies the collector
+func (e *Exec) Validate() error {
+	names := make(map[string]bool)
+	for i, c := range e.Commands {
+		if c.Name == "" {
+			return fmt.Errorf("command %d has no name", i)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate command %q", c.Name)
+		}
+		names[c.Name] = true
+		if len(c.Command) == 0 || c.Command[0] == "" {
+			return fmt.Errorf("command %q has nothing to run", c.Name)
+		}
+		if c.Timeout.Duration < 0 {
+			return fmt.Errorf("command %q has a negative timeout", c.Name)
+		}
+		if verr := validate.Labels(c.Labels); verr != nil {
+			return fmt.Errorf("command %q: %w", c.Name, verr)
+		}
+	}
+	e.counters = newCumulative()
+	return nil
+}
+
+func (e *Exec) Name() string { return "exec" }
+
+func (e *Exec) Collect(ctx context.Context, sink Sink) error {
+	var wg sync.WaitGroup
+	for _, c := range e.Commands {
+		wg.Add(1)
+		go func(c Command) {
+			defer wg.Done()
+			c.run(ctx, sink, e.counters)
+		}(c)
+	}
+	wg.Wait()
+	e.counters.prime()
+	return nil
+}
+
+// limitedBuffer keeps the first maxOutputBytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxOutputBytes - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (c Command) run(ctx context.Context, sink Sink, counters *cumulative) {
+	if c.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout.Duration)
+		defer cancel()
+	}
+
+	cmd := exec.Command(c.Command[0], c.Command[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = os.Environ()
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, k+"="+c.Env[k])
+	}
+	var stdout, stderr limitedBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	setProcessGroup(cmd)
+
+	labels := metric.Labels{"command": c.Name}
+	start := time.Now()
+	exitCode, timedOut := -1, false
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			// kill the whole group, children holding stdout would keep Wait waiting
+			killProcessGroup(cmd)
+			err, timedOut = <-done, true
+		}
+		if !timedOut {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+	}
+	duration := time.Since(start)
+
+	switch {
+	case timedOut:
+		log.Printf("exec %s: killed after %s", c.Name, duration.Round(time.Millisecond))
+		sink.Add(metric.Metric{ID: "exec_timeouts", MType: metric.MetricTypeCounter, Delta: 1, Labels: labels})
+	case err != nil:
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		log.Printf("exec %s: %s", c.Name, err)
+	}
+	sink.Add(metric.Metric{ID: "exec_exit_code", MType: metric.MetricTypeGauge, Value: float64(exitCode), Labels: labels})
+	sink.Add(metric.Metric{ID: "exec_duration_seconds", MType: metric.MetricTypeGauge, Value: duration.Seconds(), Labels: labels})
+	if stdout.truncated {
+		log.Printf("exec %s: output cut at %d bytes", c.Name, maxOutputBytes)
+	}
+
+	// a killed command may have printed something useful before hanging
+	list, errs := ParseLines(&stdout.Buffer)
+	for _, perr := range errs {
+		log.Printf("exec %s: %s", c.Name, perr)
+	}
+	if len(errs) > 0 {
+		sink.Add(metric.Metric{ID: "exec_parse_errors", MType: metric.MetricTypeCounter, Delta: int64(len(errs)), Labels: labels})
+	}
+	counters.deltas(c.Name, list)
+	for _, m := range list {
+		m = relabel(m, c.Prefix, c.Labels)
+		if verr := validate.Metric(m); verr != nil {
+			log.Printf("exec %s: %s", c.Name, verr)
+			continue
+		}
+		sink.Add(m)
+	}
+}
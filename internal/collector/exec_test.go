@@ -0,0 +1,112 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLines(t *testing.T) {
+	in := strings.Join([]string{
+		"# comment",
+		"disk_free gauge 12.5",
+		"",
+		"jobs counter 3",
+		`{"id":"queue","type":"gauge","value":7,"labels":{"q":"mail"}}`,
+		"jobs counter 1.5",
+		"bad line",
+		"1bad gauge 1",
+		`{"id":"x","type":"summary"}`,
+	}, "\n")
+	list, errs := ParseLines(strings.NewReader(in))
+	require.Len(t, list, 3)
+	assert.Equal(t, metric.Metric{ID: "disk_free", MType: metric.MetricTypeGauge, Value: 12.5}, list[0])
+	assert.Equal(t, int64(3), list[1].Delta)
+	assert.Equal(t, "mail", list[2].Labels["q"])
+	require.Len(t, errs, 4)
+	assert.Contains(t, errs[0].Error(), "line 6")
+}
+
+func TestExec(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "value"), []byte("42"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "runs"), []byte("2"), 0644))
+
+	e := &Exec{Commands: []Command{
+		{
+			Name:    "ok",
+			Command: []string{"sh", "-c", `echo "files gauge $(cat value)"; echo "runs counter $(cat $RUNS)"; echo oops`},
+			Dir:     dir,
+			Env:     map[string]string{"RUNS": "runs"},
+			Prefix:  "ops.",
+			Labels:  metric.Labels{"team": "infra"},
+		},
+		{Name: "fail", Command: []string{"sh", "-c", "exit 3"}},
+		{
+			// the background sleep keeps stdout open, only killing the group ends it
+			Name:    "hang",
+			Command: []string{"sh", "-c", "echo early gauge 1; sleep 30 & wait"},
+			Timeout: Duration{200 * time.Millisecond},
+		},
+		{Name: "missing", Command: []string{filepath.Join(dir, "nope")}},
+	}}
+	require.NoError(t, e.Validate())
+
+	collect := func() map[string]metric.Metric {
+		buf := NewBuffer()
+		start := time.Now()
+		require.NoError(t, e.Collect(context.Background(), buf))
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+		got := make(map[string]metric.Metric)
+		for _, m := range buf.Drain() {
+			got[m.Key()] = m
+		}
+		return got
+	}
+
+	got := collect()
+	assert.Equal(t, 42.0, got[`ops.files{team="infra"}`].Value)
+	// counters are running totals, the first run sets the baseline
+	assert.Equal(t, int64(0), got[`ops.runs{team="infra"}`].Delta)
+	assert.Equal(t, int64(1), got[`exec_parse_errors{command="ok"}`].Delta)
+	assert.Equal(t, 0.0, got[`exec_exit_code{command="ok"}`].Value)
+	assert.Equal(t, 3.0, got[`exec_exit_code{command="fail"}`].Value)
+	assert.Equal(t, -1.0, got[`exec_exit_code{command="hang"}`].Value)
+	assert.Equal(t, int64(1), got[`exec_timeouts{command="hang"}`].Delta)
+	assert.Equal(t, 1.0, got["early"].Value)
+	assert.Equal(t, -1.0, got[`exec_exit_code{command="missing"}`].Value)
+	assert.Greater(t, got[`exec_duration_seconds{command="hang"}`].Value, 0.19)
+
+	// printing the same total again adds nothing
+	e.Commands = e.Commands[:1]
+	got = collect()
+	assert.Equal(t, int64(0), got[`ops.runs{team="infra"}`].Delta)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "runs"), []byte("5"), 0644))
+	got = collect()
+	assert.Equal(t, int64(3), got[`ops.runs{team="infra"}`].Delta)
+	// the collector's own counters stay increments
+	assert.Equal(t, int64(1), got[`exec_parse_errors{command="ok"}`].Delta)
+}
+
+func TestLoadExec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exec.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"commands":[{"name":"a","command":["true"],"timeout":"2s"}]}`), 0644))
+	e, err := LoadExec(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, e.Commands[0].Timeout.Duration)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"commands":[{"name":"a","command":["true"]},{"name":"a","command":["true"]}]}`), 0644))
+	_, err = LoadExec(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"commands":[{"name":"a","timeout":5}]}`), 0644))
+	_, err = LoadExec(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package collector
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in a group of its own, so its children can be killed with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
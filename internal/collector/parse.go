@@ -0,0 +1,89 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
+)
+
+// maxLineBytes bounds a single line of collected output
+const maxLineBytes = 64 << 10
+
+// ParseLines reads one metric per line, either as "name type value" or as a
+// JSON metric.Metric. Blank lines and lines starting with # are skipped.
+// Lines that don't parse are returned as errors, the rest is still read.
+func ParseLines(r io.Reader) ([]metric.Metric, []error) {
+	var (
+		list []metric.Metric
+		errs []error
+	)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), maxLineBytes)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		m, err := parseLine(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+		list = append(list, m)
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return list, errs
+}
+
+func parseLine(line string) (metric.Metric, error) {
+	var m metric.Metric
+	if line[0] == '{' {
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			return metric.Metric{}, err
+		}
+	} else {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return metric.Metric{}, fmt.Errorf("want \"name type value\", got %d fields", len(fields))
+		}
+		m.ID, m.MType = fields[0], metric.MetricType(fields[1])
+		var err error
+		switch m.MType {
+		case metric.MetricTypeCounter:
+			m.Delta, err = strconv.ParseInt(fields[2], 10, 64)
+		case metric.MetricTypeGauge:
+			m.Value, err = strconv.ParseFloat(fields[2], 64)
+		}
+		if err != nil {
+			return metric.Metric{}, fmt.Errorf("wrong value %q", fields[2])
+		}
+	}
+	if verr := validate.Metric(m); verr != nil {
+		return metric.Metric{}, verr
+	}
+	return m, nil
+}
+
+// relabel prefixes the ID of m and adds labels, which win over its own
+func relabel(m metric.Metric, prefix string, labels metric.Labels) metric.Metric {
+	m.ID = prefix + m.ID
+	if len(labels) > 0 {
+		merged := make(metric.Labels, len(m.Labels)+len(labels))
+		for k, v := range m.Labels {
+			merged[k] = v
+		}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		m.Labels = merged
+	}
+	return m
+}
@@ -0,0 +1,184 @@
+package collector
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
+)
+
+// ParsePrometheus reads the Prometheus text exposition format.
+// Counters, histogram buckets and counts come back as counters holding the
+// cumulative value rounded down, everything else as gauges. HELP lines end
+// up in Metric.Help. Samples that don't parse are returned as errors.
+func ParsePrometheus(r io.Reader) ([]metric.Metric, []error) {
+	var (
+		list  []metric.Metric
+		errs  []error
+		types = make(map[string]string)
+		helps = make(map[string]string)
+	)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), maxLineBytes)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) == 4 {
+				switch fields[1] {
+				case "TYPE":
+					types[fields[2]] = fields[3]
+				case "HELP":
+					helps[fields[2]] = fields[3]
+				}
+			}
+			continue
+		}
+		m, err := parseSample(line, types, helps)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+		list = append(list, m)
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return list, errs
+}
+
+func parseSample(line string, types, helps map[string]string) (metric.Metric, error) {
+	m := metric.Metric{}
+	i := strings.IndexAny(line, "{ \t")
+	if i < 0 {
+		return m, errors.New("sample has no value")
+	}
+	m.ID = line[:i]
+	rest := line[i:]
+	if rest[0] == '{' {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return m, err
+		}
+		if len(labels) > 0 {
+			m.Labels = labels
+		}
+		rest = rest[n:]
+	}
+	// the timestamp after the value is ignored, the agent reports its own time
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return m, errors.New("want a value and an optional timestamp")
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return m, fmt.Errorf("wrong value %q", fields[0])
+	}
+
+	family, typ := m.ID, types[m.ID]
+	if typ == "" {
+		for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+			if base := strings.TrimSuffix(m.ID, suffix); base != m.ID && types[base] != "" {
+				family, typ = base, types[base]
+				break
+			}
+		}
+	}
+	m.MType = metric.MetricTypeGauge
+	switch {
+	case typ == "counter",
+		(typ == "histogram" || typ == "summary") && m.ID != family+"_sum" && m.ID != family:
+		if math.IsNaN(v) || v < 0 || v >= math.MaxInt64 {
+			return m, fmt.Errorf("counter value %q out of range", fields[0])
+		}
+		m.MType, m.Delta = metric.MetricTypeCounter, int64(v)
+	default:
+		m.Value = v
+	}
+	if h, ok := helps[family]; ok {
+		m.Help = unescape(h, false)
+	}
+	if verr := validate.Metric(m); verr != nil {
+		return m, verr
+	}
+	return m, nil
+}
+
+// parseLabels reads a {name="value",...} block and returns its length
+func parseLabels(s string) (metric.Labels, int, error) {
+	labels := metric.Labels{}
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, errors.New("unterminated labels")
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 {
+			return nil, 0, errors.New("label without a value")
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		i += eq + 1
+		if i >= len(s) || s[i] != '"' {
+			return nil, 0, fmt.Errorf("value of label %q is not quoted", name)
+		}
+		i++
+		start, escaped := i, false
+		for ; i < len(s); i++ {
+			if escaped {
+				escaped = false
+			} else if s[i] == '\\' {
+				escaped = true
+			} else if s[i] == '"' {
+				break
+			}
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("value of label %q is not terminated", name)
+		}
+		labels[name] = unescape(s[start:i], true)
+		i++
+	}
+}
+
+// unescape resolves \\ and \n, and \" in label values
+func unescape(s string, quotes bool) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch next := s[i+1]; {
+			case next == '\\':
+				b.WriteByte('\\')
+				i++
+				continue
+			case next == 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			case next == '"' && quotes:
+				b.WriteByte('"')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package collector
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+func init() {
+	Register("memstats", func(*config.ConfigAgent) (Collector, error) { return MemStats{}, nil })
+	Register("pollcount", func(*config.ConfigAgent) (Collector, error) { return PollCount{}, nil })
+	Register("random", func(*config.ConfigAgent) (Collector, error) { return RandomValue{}, nil })
+}
+
+type memStat struct {
+	id    string
+	value func(ms *runtime.MemStats) float64
+}
+
+// memStats are the reported runtime.MemStats fields. They are all gauges,
+// the server keeps the last value rather than adding it up.
+var memStats = []memStat{
+	{"Alloc", func(ms *runtime.MemStats) float64 { return float64(ms.Alloc) }},
+	{"BuckHashSys", func(ms *runtime.MemStats) float64 { return float64(ms.BuckHashSys) }},
+	{"GCSys", func(ms *runtime.MemStats) float64 { return float64(ms.GCSys) }},
+	{"GCCPUFraction", func(ms *runtime.MemStats) float64 { return ms.GCCPUFraction }},
+	{"Frees", func(ms *runtime.MemStats) float64 { return float64(ms.Frees) }},
+	{"HeapAlloc", func(ms *runtime.MemStats) float64 { return float64(ms.HeapAlloc) }},
+	{"HeapIdle", func(ms *runtime.MemStats) float64 { return float64(ms.HeapIdle) }},
+	{"HeapInuse", func(ms *runtime.MemStats) float64 { return float64(ms.HeapInuse) }},
+	{"HeapObjects", func(ms *runtime.MemStats) float64 { return float64(ms.HeapObjects) }},
+	{"HeapReleased", func(ms *runtime.MemStats) float64 { return float64(ms.HeapReleased) }},
+	{"HeapSys", func(ms *runtime.MemStats) float64 { return float64(ms.HeapSys) }},
+	{"LastGC", func(ms *runtime.MemStats) float64 { return float64(ms.LastGC) }},
+	{"Lookups", func(ms *runtime.MemStats) float64 { return float64(ms.Lookups) }},
+	{"MCacheInuse", func(ms *runtime.MemStats) float64 { return float64(ms.MCacheInuse) }},
+	{"MCacheSys", func(ms *runtime.MemStats) float64 { return float64(ms.MCacheSys) }},
+	{"MSpanInuse", func(ms *runtime.MemStats) float64 { return float64(ms.MSpanInuse) }},
+	{"MSpanSys", func(ms *runtime.MemStats) float64 { return float64(ms.MSpanSys) }},
+	{"Mallocs", func(ms *runtime.MemStats) float64 { return float64(ms.Mallocs) }},
+	{"NextGC", func(ms *runtime.MemStats) float64 { return float64(ms.NextGC) }},
+	{"NumForcedGC", func(ms *runtime.MemStats) float64 { return float64(ms.NumForcedGC) }},
+	{"NumGC", func(ms *runtime.MemStats) float64 { return float64(ms.NumGC) }},
+	{"OtherSys", func(ms *runtime.MemStats) float64 { return float64(ms.OtherSys) }},
+	{"PauseTotalNs", func(ms *runtime.MemStats) float64 { return float64(ms.PauseTotalNs) }},
+	{"StackInuse", func(ms *runtime.MemStats) float64 { return float64(ms.StackInuse) }},
+	{"StackSys", func(ms *runtime.MemStats) float64 { return float64(ms.StackSys) }},
+	{"Sys", func(ms *runtime.MemStats) float64 { return float64(ms.Sys) }},
+}
+
+// MemStats reports the runtime memory statistics of the agent
+type MemStats struct{}
+
+func (MemStats) Name() string { return "memstats" }
+
+func (MemStats) Collect(ctx context.Context, sink Sink) error {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	for _, st := range memStats {
+		sink.Add(metric.Metric{ID: st.id, MType: metric.MetricTypeGauge, Value: st.value(&ms)})
+	}
+	return nil
+}
+
+// PollCount counts the polls of the agent
+type PollCount struct{}
+
+func (PollCount) Name() string { return "pollcount" }
+
+func (PollCount) Collect(ctx context.Context, sink Sink) error {
+	sink.Add(metric.Metric{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: 1})
+	return nil
+}
+
+// RandomValue reports a random gauge
+type RandomValue struct{}
+
+func (RandomValue) Name() string { return "random" }
+
+func (RandomValue) Collect(ctx context.Context, sink Sink) error {
+	sink.Add(metric.Metric{ID: "RandomValue", MType: metric.MetricTypeGauge, Value: rand.Float64()})
+	return nil
+}
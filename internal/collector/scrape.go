@@ -0,0 +1,270 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
+)
+
+func init() {
+	Register("scrape", func(conf *config.ConfigAgent) (Collector, error) {
+		if conf.ScrapeConfigFile == "" {
+			return nil, errors.New("SCRAPE_CONFIG_FILE is not set")
+		}
+		return LoadScrape(conf.ScrapeConfigFile)
+	})
+}
+
+// Formats of scrape targets
+const (
+	FormatPrometheus = "prometheus"
+	FormatExpvar     = "expvar"
+)
+
+// Target is an endpoint of a local app to scrape
+type Target struct {
+	URL string `json:"url"`
+	// Format is prometheus or expvar, empty picks it by the response Content-Type
+	Format string `json:"format,omitempty"`
+	// Flatten reports numbers nested in expvar maps as "<outer>.<inner>",
+	// otherwise only top level numbers are reported
+	Flatten bool `json:"flatten,omitempty"`
+	// Prefix is prepended to the scraped IDs
+	Prefix string `json:"prefix,omitempty"`
+	// Allow and Deny hold path.Match patterns of the scraped IDs, before
+	// the prefix. An empty Allow allows every ID, Deny wins over Allow.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Labels are added to every scraped metric
+	Labels  metric.Labels `json:"labels,omitempty"`
+	Timeout Duration      `json:"timeout,omitempty"`
+}
+
+// Scrape reads the Prometheus or expvar endpoints of local apps on every
+// Collect. Prometheus counters are running totals and reported as deltas.
+// For every target it reports, labeled target=<url>:
+//
+//	scrape_up                gauge, 1 when the target answered and parsed
+//	scrape_duration_seconds  gauge
+//	scrape_samples           gauge, the metrics reported after filtering
+type Scrape struct {
+	Targets []Target `json:"targets"`
+
+	client   *http.Client
+	counters *cumulative
+}
+
+// LoadScrape reads and validates a JSON scrape config file
+func LoadScrape(path string) (*Scrape, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &Scrape{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	if err := sc.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid targets in %s: %w", path, err)
+	}
+	return sc, nil
+}
+
+// Validate checks the targets and readies the scraper
+func (sc *Scrape) Validate() error {
+	urls := make(map[string]bool)
+	for i, t := range sc.Targets {
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("target %d has no http URL", i)
+		}
+		if urls[t.URL] {
+			return fmt.Errorf("duplicate target %q", t.URL)
+		}
+		urls[t.URL] = true
+		switch t.Format {
+		case "", FormatPrometheus, FormatExpvar:
+		default:
+			return fmt.Errorf("target %q has unknown format %q", t.URL, t.Format)
+		}
+		for _, p := range append(append([]string(nil), t.Allow...), t.Deny...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("target %q: bad pattern %q", t.URL, p)
+			}
+		}
+		if verr := validate.Labels(t.Labels); verr != nil {
+			return fmt.Errorf("target %q: %w", t.URL, verr)
+		}
+	}
+	sc.client = &http.Client{}
+	sc.counters = newCumulative()
+	return nil
+}
+
+func (sc *Scrape) Name() string { return "scrape" }
+
+func (sc *Scrape) Collect(ctx context.Context, sink Sink) error {
+	var wg sync.WaitGroup
+	for _, t := range sc.Targets {
+		wg.Add(1)
+		go func(t Target) {
+			defer wg.Done()
+			sc.scrape(ctx, t, sink)
+		}(t)
+	}
+	wg.Wait()
+	sc.counters.prime()
+	return nil
+}
+
+func (sc *Scrape) scrape(ctx context.Context, t Target, sink Sink) {
+	if t.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout.Duration)
+		defer cancel()
+	}
+	labels := metric.Labels{"target": t.URL}
+	start := time.Now()
+	list, err := sc.fetch(ctx, t)
+	duration := time.Since(start)
+
+	up := 1.0
+	if err != nil {
+		log.Printf("scrape %s: %s", t.URL, err)
+		up = 0
+	} else {
+		// a failed scrape keeps the totals, the next one reports what it missed
+		sc.counters.deltas(t.URL, list)
+	}
+	samples := 0
+	for _, m := range list {
+		if !t.allowed(m.ID) {
+			continue
+		}
+		m = relabel(m, t.Prefix, t.Labels)
+		if verr := validate.Metric(m); verr != nil {
+			log.Printf("scrape %s: %s", t.URL, verr)
+			continue
+		}
+		sink.Add(m)
+		samples++
+	}
+	sink.Add(metric.Metric{ID: "scrape_up", MType: metric.MetricTypeGauge, Value: up, Labels: labels})
+	sink.Add(metric.Metric{ID: "scrape_duration_seconds", MType: metric.MetricTypeGauge, Value: duration.Seconds(), Labels: labels})
+	sink.Add(metric.Metric{ID: "scrape_samples", MType: metric.MetricTypeGauge, Value: float64(samples), Labels: labels})
+}
+
+// fetch reads and parses a target, an error means the target is down
+func (sc *Scrape) fetch(ctx context.Context, t Target) ([]metric.Metric, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4, application/json;q=0.5")
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body := io.LimitReader(resp.Body, maxFileBytes)
+
+	format := t.Format
+	if format == "" {
+		format = FormatPrometheus
+		if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+			format = FormatExpvar
+		}
+	}
+	if format == FormatExpvar {
+		return parseExpvar(body, t.Flatten)
+	}
+	list, errs := ParsePrometheus(body)
+	for _, perr := range errs {
+		log.Printf("scrape %s: %s", t.URL, perr)
+	}
+	return list, nil
+}
+
+func (t Target) allowed(id string) bool {
+	for _, p := range t.Deny {
+		if ok, _ := path.Match(p, id); ok {
+			return false
+		}
+	}
+	if len(t.Allow) == 0 {
+		return true
+	}
+	for _, p := range t.Allow {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpvar reports the numbers and booleans of an expvar document as
+// gauges, strings and arrays are left out
+func parseExpvar(r io.Reader, flatten bool) ([]metric.Metric, error) {
+	vars := make(map[string]interface{})
+	if err := json.NewDecoder(r).Decode(&vars); err != nil {
+		return nil, fmt.Errorf("unable to parse expvar: %w", err)
+	}
+	var list []metric.Metric
+	var walk func(prefix string, vars map[string]interface{})
+	walk = func(prefix string, vars map[string]interface{}) {
+		for k, v := range vars {
+			id := prefix + sanitizeID(k)
+			switch v := v.(type) {
+			case float64:
+				list = append(list, metric.Metric{ID: id, MType: metric.MetricTypeGauge, Value: v})
+			case bool:
+				value := 0.0
+				if v {
+					value = 1
+				}
+				list = append(list, metric.Metric{ID: id, MType: metric.MetricTypeGauge, Value: value})
+			case map[string]interface{}:
+				if flatten {
+					walk(id+".", v)
+				}
+			}
+		}
+	}
+	walk("", vars)
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// sanitizeID replaces what a metric ID can't hold with "_"
+func sanitizeID(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		ok := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			i > 0 && (c >= '0' && c <= '9' || c == '.' || c == ':' || c == '/' || c == '-')
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
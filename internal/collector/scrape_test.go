@@ -0,0 +1,93 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrape(t *testing.T) {
+	var requests int64
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# TYPE http_requests_total counter\nhttp_requests_total{code=\"200\"} %d\n", 100+n*10)
+		fmt.Fprintln(w, "go_goroutines 12")
+		fmt.Fprintln(w, "go_threads 7")
+	}))
+	defer prom.Close()
+	expvar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprint(w, `{"cmdline":["app"],"requests":42,"ready":true,"memstats":{"Alloc":1024,"PauseNs":[1,2],"by size":{"x":1}}}`)
+	}))
+	defer expvar.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	sc := &Scrape{Targets: []Target{
+		{URL: prom.URL + "/metrics", Prefix: "app.", Deny: []string{"go_threads"}, Labels: metric.Labels{"app": "api"}},
+		{URL: expvar.URL + "/debug/vars", Flatten: true, Allow: []string{"requests", "ready", "memstats.*"}},
+		{URL: down.URL, Format: FormatPrometheus},
+	}}
+	require.NoError(t, sc.Validate())
+
+	// collected through a registry into the buffer the agent reports from
+	reg := NewRegistry()
+	require.NoError(t, reg.Add(sc, Settings{Interval: time.Hour}))
+	buf := NewBuffer()
+	collect := func() map[string]metric.Metric {
+		// one run right away, then the hour long interval outlasts the context
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		reg.Run(ctx, buf)
+		got := make(map[string]metric.Metric)
+		for _, m := range buf.Drain() {
+			got[m.Key()] = m
+		}
+		return got
+	}
+
+	got := collect()
+	assert.Equal(t, 12.0, got[`app.go_goroutines{app="api"}`].Value)
+	assert.NotContains(t, got, `app.go_threads{app="api"}`)
+	assert.Equal(t, int64(0), got[`app.http_requests_total{app="api",code="200"}`].Delta)
+	assert.Equal(t, 42.0, got["requests"].Value)
+	assert.Equal(t, 1.0, got["ready"].Value)
+	assert.Equal(t, 1024.0, got["memstats.Alloc"].Value)
+	assert.Equal(t, 1.0, got["memstats.by_size.x"].Value)
+	assert.NotContains(t, got, "cmdline")
+	assert.Equal(t, 1.0, got[fmt.Sprintf(`scrape_up{target=%q}`, prom.URL+"/metrics")].Value)
+	assert.Equal(t, 2.0, got[fmt.Sprintf(`scrape_samples{target=%q}`, prom.URL+"/metrics")].Value)
+	assert.Equal(t, 0.0, got[fmt.Sprintf(`scrape_up{target=%q}`, down.URL)].Value)
+
+	got = collect()
+	assert.Equal(t, int64(10), got[`app.http_requests_total{app="api",code="200"}`].Delta)
+}
+
+func TestParseExpvar(t *testing.T) {
+	in := `{"a":1,"nested":{"b":2,"deeper":{"c":3}},"0bad key":4}`
+	list, err := parseExpvar(strings.NewReader(in), false)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "_bad_key", list[0].ID)
+	assert.Equal(t, "a", list[1].ID)
+
+	list, err = parseExpvar(strings.NewReader(in), true)
+	require.NoError(t, err)
+	require.Len(t, list, 4)
+	assert.Equal(t, "nested.deeper.c", list[3].ID)
+
+	_, err = parseExpvar(strings.NewReader("[1]"), true)
+	assert.Error(t, err)
+}
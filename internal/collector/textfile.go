@@ -0,0 +1,147 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+func init() {
+	Register("textfile", func(conf *config.ConfigAgent) (Collector, error) {
+		if conf.TextfileDir == "" {
+			return nil, errors.New("TEXTFILE_DIR is not set")
+		}
+		return NewTextfile(conf.TextfileDir, conf.TextfileMinAge), nil
+	})
+}
+
+// maxFileBytes bounds a metrics file, larger files are skipped
+const maxFileBytes = 16 << 20
+
+// errChanged is returned for a file written to while it was read
+var errChanged = errors.New("file changed while reading")
+
+// Textfile reads the metrics files batch jobs leave in a directory:
+// *.prom files in the Prometheus text format and *.ndjson or *.jsonl files
+// with a JSON metric per line. Counters in the files are running totals.
+//
+// Writers should write to a hidden file, for example .job.prom.tmp, and rename
+// it into place. Hidden files, files modified less than MinAge ago and files
+// that change while read are skipped until a later run. For every file read
+// it reports, labeled file=<name>:
+//
+//	textfile_mtime_seconds  gauge, the modification time of the file
+//	textfile_parse_errors   gauge, the lines that didn't parse
+type Textfile struct {
+	Dir    string
+	MinAge time.Duration
+
+	counters *cumulative
+}
+
+func NewTextfile(dir string, minAge time.Duration) *Textfile {
+	return &Textfile{Dir: dir, MinAge: minAge, counters: newCumulative()}
+}
+
+func (tf *Textfile) Name() string { return "textfile" }
+
+func (tf *Textfile) Collect(ctx context.Context, sink Sink) error {
+	entries, err := os.ReadDir(tf.Dir)
+	if err != nil {
+		sink.Add(metric.Metric{ID: "textfile_scrape_error", MType: metric.MetricTypeGauge, Value: 1})
+		return err
+	}
+	sink.Add(metric.Metric{ID: "textfile_scrape_error", MType: metric.MetricTypeGauge, Value: 0})
+
+	seen := make(map[string]bool)
+	now := time.Now()
+	for _, de := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := de.Name()
+		parse := parserFor(name)
+		if parse == nil || !de.Type().IsRegular() {
+			continue
+		}
+		seen[name] = true
+
+		info, err := de.Info()
+		if err != nil || now.Sub(info.ModTime()) < tf.MinAge {
+			// gone or still being written
+			continue
+		}
+		data, mtime, err := readStable(filepath.Join(tf.Dir, name))
+		if err != nil {
+			log.Printf("textfile %s: %s", name, err)
+			continue
+		}
+
+		list, errs := parse(bytes.NewReader(data))
+		for _, perr := range errs {
+			log.Printf("textfile %s: %s", name, perr)
+		}
+		tf.counters.deltas(name, list)
+		for _, m := range list {
+			sink.Add(m)
+		}
+		labels := metric.Labels{"file": name}
+		sink.Add(metric.Metric{ID: "textfile_parse_errors", MType: metric.MetricTypeGauge, Value: float64(len(errs)), Labels: labels})
+		sink.Add(metric.Metric{ID: "textfile_mtime_seconds", MType: metric.MetricTypeGauge, Value: float64(mtime.Unix()), Labels: labels})
+	}
+	tf.counters.keep(seen)
+	tf.counters.prime()
+	return nil
+}
+
+// parserFor picks the parser of a file by its extension, nil for files to ignore
+func parserFor(name string) func(io.Reader) ([]metric.Metric, []error) {
+	if strings.HasPrefix(name, ".") {
+		return nil
+	}
+	switch filepath.Ext(name) {
+	case ".prom":
+		return ParsePrometheus
+	case ".ndjson", ".jsonl":
+		return ParseLines
+	}
+	return nil
+}
+
+// readStable reads a file and checks that it wasn't modified meanwhile
+func readStable(path string) ([]byte, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	before, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if before.Size() > maxFileBytes {
+		return nil, time.Time{}, fmt.Errorf("larger than %d bytes", maxFileBytes)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, maxFileBytes+1))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	after, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if int64(len(data)) != after.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return nil, time.Time{}, errChanged
+	}
+	return data, after.ModTime(), nil
+}
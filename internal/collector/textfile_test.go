@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const promText = `# HELP jobs_total Jobs done.
+# TYPE jobs_total counter
+jobs_total{queue="mail",note="a \"b\"\\c"} 12 1700000000000
+jobs_total{queue="sms"} 3.9
+jobs_total{queue="push"} 9223372036854775807
+# TYPE temperature gauge
+temperature 21.5
+untyped_thing -1
+# TYPE latency histogram
+latency_bucket{le="0.1"} 4
+latency_bucket{le="+Inf"} 5
+latency_sum 0.7
+latency_count 5
+# TYPE rpc summary
+rpc{quantile="0.5"} 0.02
+rpc_count 9
+broken{le="1"
+bad_value nope
+`
+
+func TestParsePrometheus(t *testing.T) {
+	list, errs := ParsePrometheus(strings.NewReader(promText))
+	// push overflows int64, broken and bad_value don't parse
+	assert.Len(t, errs, 3)
+	got := make(map[string]metric.Metric)
+	for _, m := range list {
+		got[m.Key()] = m
+	}
+	require.Len(t, got, 10)
+
+	jobs := got[`jobs_total{note="a \"b\"\\c",queue="mail"}`]
+	assert.Equal(t, metric.MetricTypeCounter, jobs.MType)
+	assert.Equal(t, int64(12), jobs.Delta)
+	assert.Equal(t, "Jobs done.", jobs.Help)
+	assert.Equal(t, int64(3), got[`jobs_total{queue="sms"}`].Delta)
+	assert.Equal(t, 21.5, got["temperature"].Value)
+	assert.Equal(t, -1.0, got["untyped_thing"].Value)
+	assert.Equal(t, metric.MetricTypeCounter, got[`latency_bucket{le="+Inf"}`].MType)
+	assert.Equal(t, int64(5), got["latency_count"].Delta)
+	assert.Equal(t, metric.MetricTypeGauge, got["latency_sum"].MType)
+	assert.Equal(t, 0.02, got[`rpc{quantile="0.5"}`].Value)
+	assert.Equal(t, int64(9), got["rpc_count"].Delta)
+}
+
+func TestTextfile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string, age time.Duration) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		mtime := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	write("backup.prom", "# TYPE backup_runs counter\nbackup_runs 10\nbackup_size 2048\n", time.Minute)
+	write("import.ndjson", `{"id":"imported","type":"counter","delta":5}`+"\nnot json\n", time.Minute)
+	write(".backup.prom.tmp", "half_written 1\n", time.Minute)
+	write("fresh.prom", "fresh 1\n", 0)
+	write("notes.txt", "ignored 1\n", time.Minute)
+
+	tf := NewTextfile(dir, 5*time.Second)
+	collect := func() map[string]metric.Metric {
+		buf := NewBuffer()
+		require.NoError(t, tf.Collect(context.Background(), buf))
+		got := make(map[string]metric.Metric)
+		for _, m := range buf.Drain() {
+			got[m.Key()] = m
+		}
+		return got
+	}
+
+	got := collect()
+	assert.Equal(t, 2048.0, got["backup_size"].Value)
+	// the first read of a running total only sets the baseline
+	assert.Equal(t, int64(0), got["backup_runs"].Delta)
+	assert.Equal(t, int64(0), got["imported"].Delta)
+	assert.Equal(t, 0.0, got[`textfile_parse_errors{file="backup.prom"}`].Value)
+	assert.Equal(t, 1.0, got[`textfile_parse_errors{file="import.ndjson"}`].Value)
+	assert.Equal(t, 0.0, got["textfile_scrape_error"].Value)
+	assert.NotContains(t, got, "half_written")
+	assert.NotContains(t, got, "fresh")
+	assert.NotContains(t, got, "ignored")
+
+	write("backup.prom", "# TYPE backup_runs counter\nbackup_runs 13\n", time.Minute)
+	write("fresh.prom", "fresh 1\n", time.Minute)
+	// a file written after the agent started reports its whole total
+	write("jobs.prom", "# TYPE jobs_done counter\njobs_done 42\n", time.Minute)
+	got = collect()
+	assert.Equal(t, int64(3), got["backup_runs"].Delta)
+	assert.Equal(t, int64(42), got["jobs_done"].Delta)
+	assert.Equal(t, int64(0), got["imported"].Delta)
+	assert.Equal(t, 1.0, got["fresh"].Value)
+
+	// a counter going down was reset
+	write("backup.prom", "# TYPE backup_runs counter\nbackup_runs 2\n", time.Minute)
+	got = collect()
+	assert.Equal(t, int64(2), got["backup_runs"].Delta)
+
+	require.NoError(t, os.RemoveAll(dir))
+	buf := NewBuffer()
+	assert.Error(t, tf.Collect(context.Background(), buf))
+	assert.Equal(t, 1.0, buf.Drain()[0].Value)
+}
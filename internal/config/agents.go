@@ -0,0 +1,66 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+)
+
+// EnableAgents tracks which agent reported which metric
+func (s *Service) EnableAgents(reg *agents.Registry) {
+	s.Agents = reg
+	s.OnUpdate(func(ctx context.Context, u Update) {
+		if id, ok := agents.IDFromContext(ctx); ok {
+			reg.Reported(id, u.New.Key())
+		}
+	})
+}
+
+// AgentSeen records the agent behind r, if any, and returns the request
+// with the agent ID in its context
+func (s *Service) AgentSeen(r *http.Request) *http.Request {
+	info, ok := agents.FromRequest(r)
+	if !ok || s.Agents == nil {
+		return r
+	}
+	s.Agents.Seen(info, time.Now())
+	return r.WithContext(agents.WithID(r.Context(), info.ID))
+}
+
+// GetAgents lists the known agents via GET /agents?stale=
+// stale=true or stale=false keeps only stale or live agents.
+func (s *Service) GetAgents(w http.ResponseWriter, r *http.Request) {
+	if s.Agents == nil {
+		apierr.Error(w, "agent registry is disabled", http.StatusNotFound)
+		return
+	}
+	list := s.Agents.List(time.Now())
+	if stale := r.URL.Query().Get("stale"); stale != "" {
+		want := stale == "true"
+		kept := list[:0]
+		for _, a := range list {
+			if a.Stale == want {
+				kept = append(kept, a)
+			}
+		}
+		list = kept
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Println(err)
+	}
+}
+
+// PostAgentHeartbeat lets an agent report liveness without metrics via POST /agents/heartbeat
+func (s *Service) PostAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if _, ok := agents.FromRequest(r); !ok {
+		apierr.Error(w, "missing "+agents.HeaderID, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
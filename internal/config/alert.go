@@ -0,0 +1,56 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/alert"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+)
+
+// EnableAlerts lets e see every update and serves its state on /alerts
+func (s *Service) EnableAlerts(e *alert.Engine) {
+	s.Alerts = e
+	s.OnUpdate(func(ctx context.Context, u Update) {
+		e.Seen(u.New.Key(), time.Now())
+	})
+}
+
+// ReloadAlerts rereads the rules file
+func (s *Service) ReloadAlerts() error {
+	rules, err := alert.LoadRules(s.Server.AlertRulesFile)
+	if err != nil {
+		return err
+	}
+	s.Alerts.Reload(rules)
+	log.Printf("Loaded %d alerting rules from %s", len(rules.Rules), s.Server.AlertRulesFile)
+	return nil
+}
+
+// GetAlerts lists the state of every alerting rule via GET /alerts
+func (s *Service) GetAlerts(w http.ResponseWriter, r *http.Request) {
+	if s.Alerts == nil {
+		apierr.Error(w, "alerting is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Alerts.Statuses()); err != nil {
+		log.Println(err)
+	}
+}
+
+// PostAlertsReload rereads the rules file via POST /alerts/reload
+func (s *Service) PostAlertsReload(w http.ResponseWriter, r *http.Request) {
+	if s.Alerts == nil {
+		apierr.Error(w, "alerting is disabled", http.StatusNotFound)
+		return
+	}
+	if err := s.ReloadAlerts(); err != nil {
+		log.Println(err)
+		apierr.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/audit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/auth"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// EnableAudit records every update in sink, next to deletes and resets.
+// Updates made outside a request, such as the forwarder stats, are not recorded.
+func (s *Service) EnableAudit(sink audit.Sink) {
+	s.Audit = sink
+	s.auditUpdates = true
+	s.OnUpdate(func(ctx context.Context, u Update) {
+		if _, ok := audit.AddrFromContext(ctx); !ok {
+			return
+		}
+		e := audit.Event{Action: audit.ActionFromContext(ctx), New: &u.New}
+		if u.Existed {
+			e.Old = &u.Old
+		}
+		s.record(ctx, e)
+	})
+}
+
+// record fills in who changed what and hands e to the audit sink
+func (s *Service) record(ctx context.Context, e audit.Event) {
+	sink := s.Audit
+	if sink == nil {
+		sink = audit.LogSink{}
+	}
+	e.Time = time.Now().UTC()
+	e.Tenant = s.Tenant
+	m := e.New
+	if m == nil {
+		m = e.Old
+	}
+	if m != nil {
+		e.ID, e.Key = m.ID, m.Key()
+	}
+	e.Addr, _ = audit.AddrFromContext(ctx)
+	e.Agent, _ = agents.IDFromContext(ctx)
+	e.Token, _ = auth.TokenIDFromContext(ctx)
+	if rctx := chi.RouteContext(ctx); rctx != nil {
+		e.Route = rctx.RouteMethod + " " + rctx.RoutePattern()
+	}
+	sink.Record(e)
+}
+
+// recordDeleted records the removal of every series in deleted
+func (s *Service) recordDeleted(ctx context.Context, deleted []metric.Metric, dryRun bool) {
+	for _, m := range deleted {
+		m := m
+		s.record(ctx, audit.Event{Action: audit.ActionDelete, Old: &m, DryRun: dryRun})
+	}
+}
+
+// GetAudit lists the recorded mutations via GET /audit?id=&since=&limit=
+// since is an RFC 3339 time or unix seconds, limit keeps the most recent events.
+func (s *Service) GetAudit(w http.ResponseWriter, r *http.Request) {
+	querier, ok := s.Audit.(audit.Querier)
+	if !ok {
+		apierr.Error(w, "audit log is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	f := audit.Filter{Tenant: s.Tenant, ID: q.Get("id"), Limit: 1000}
+	since, err := parseTime(q.Get("since"), time.Time{})
+	if err != nil {
+		apierr.Error(w, "wrong \"since\"", http.StatusBadRequest)
+		return
+	}
+	f.Since = since
+	if v := q.Get("limit"); v != "" {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit <= 0 {
+			apierr.Error(w, "wrong \"limit\"", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := querier.Query(f)
+	if err != nil {
+		log.Println(err)
+		apierr.Error(w, "unable to read the audit log", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.Println(err)
+	}
+}
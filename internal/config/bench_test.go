@@ -0,0 +1,123 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+func benchRouter(s *Service) http.Handler {
+	mux := chi.NewRouter()
+	mux.Post("/update/", s.PostHandlerMetricsJSON)
+	mux.Post("/update/{type}/{id}/{value}", s.PostHandlerMetricByURL)
+	mux.Post("/updates/", s.PostHandlerMetricsBatchJSON)
+	mux.Get("/value/{type}/{id}", s.GetMetricsByValueURI)
+	return mux
+}
+
+func BenchmarkPostMetricByURL(b *testing.B) {
+	router := benchRouter(NewService(&ConfigServer{}))
+	urls := make([]string, 100)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("/update/gauge/Gauge%d/%d.5", i, i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, urls[i%len(urls)], nil))
+	}
+}
+
+func BenchmarkPostMetricJSON(b *testing.B) {
+	router := benchRouter(NewService(&ConfigServer{}))
+	bodies := make([][]byte, 100)
+	for i := range bodies {
+		bodies[i], _ = json.Marshal(metric.Metric{ID: "Counter" + strconv.Itoa(i), MType: metric.MetricTypeCounter, Delta: 1})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(bodies[i%len(bodies)]))
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func BenchmarkPostMetricsBatch(b *testing.B) {
+	for _, size := range []int{10, 100} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			router := benchRouter(NewService(&ConfigServer{}))
+			batch := make([]metric.Metric, size)
+			for i := range batch {
+				batch[i] = metric.Metric{ID: "Gauge" + strconv.Itoa(i), MType: metric.MetricTypeGauge, Value: float64(i)}
+			}
+			body, _ := json.Marshal(batch)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+				router.ServeHTTP(httptest.NewRecorder(), r)
+			}
+		})
+	}
+}
+
+func BenchmarkGetMetricByURI(b *testing.B) {
+	s := NewService(&ConfigServer{})
+	for i := 0; i < 1000; i++ {
+		s.UpdateMetric(context.Background(), metric.Metric{ID: "Gauge" + strconv.Itoa(i), MType: metric.MetricTypeGauge, Value: 1})
+	}
+	router := benchRouter(s)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		url := "/value/gauge/Gauge" + strconv.Itoa(i%1000)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+}
+
+// BenchmarkUpdateMetric measures the storage alone, with every goroutine
+// writing its own series
+func BenchmarkUpdateMetric(b *testing.B) {
+	for _, series := range []int{1, 1000} {
+		b.Run(strconv.Itoa(series), func(b *testing.B) {
+			s := NewService(&ConfigServer{})
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					m := metric.Metric{ID: "Counter" + strconv.Itoa(i%series), MType: metric.MetricTypeCounter, Delta: 1}
+					if _, err := s.UpdateMetric(ctx, m); err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	s := NewService(&ConfigServer{})
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = "Gauge" + strconv.Itoa(i)
+		s.UpdateMetric(context.Background(), metric.Metric{ID: keys[i], MType: metric.MetricTypeGauge, Value: 1})
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.Lookup(keys[i%len(keys)])
+			i++
+		}
+	})
+}
@@ -12,8 +12,20 @@ import (
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/alert"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/audit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/expiry"
 	"github.com/goethesum/-go-musthave-devops-tpl/internal/history"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/meta"
 	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/ratelimit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/rollup"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/storage"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/stream"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/telemetry"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
 )
 
 type ConfigAgent struct {
@@ -21,6 +33,36 @@ type ConfigAgent struct {
 	URLMetricPush  string        `env:"URL_PATH" envDefault:"/update"`
 	PollInterval   time.Duration `env:"POLL_INTERVAL" envDefault:"2s"`
 	ReportInterval time.Duration `env:"REPORT_INTERVAL" envDefault:"10s"`
+	// IDFile keeps the agent ID across restarts
+	IDFile string `env:"AGENT_ID_FILE" envDefault:"/tmp/devops-agent-id"`
+	// Token is sent as bearer token, it needs the write role
+	Token string `env:"AGENT_TOKEN"`
+
+	// TLSCAFile is the CA bundle trusted for the server, empty uses the system roots
+	TLSCAFile string `env:"TLS_CA_FILE"`
+	// TLSCertFile and TLSKeyFile are the client certificate sent for mTLS
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+
+	// Collectors are the names of the enabled collectors
+	Collectors []string `env:"COLLECTORS" envSeparator:"," envDefault:"memstats,pollcount,random"`
+	// CollectorIntervals is a "name:duration" list overriding PollInterval per collector
+	CollectorIntervals []string `env:"COLLECTOR_INTERVALS" envSeparator:","`
+	// CollectorTimeouts is a "name:duration" list, a collector times out after its interval by default
+	CollectorTimeouts []string `env:"COLLECTOR_TIMEOUTS" envSeparator:","`
+	// ExecConfigFile lists the commands of the exec collector
+	ExecConfigFile string `env:"EXEC_CONFIG_FILE"`
+	// TextfileDir is scanned by the textfile collector
+	TextfileDir string `env:"TEXTFILE_DIR"`
+	// TextfileMinAge skips files modified more recently, they may still be written
+	TextfileMinAge time.Duration `env:"TEXTFILE_MIN_AGE" envDefault:"1s"`
+	// ScrapeConfigFile lists the endpoints of the scrape collector
+	ScrapeConfigFile string `env:"SCRAPE_CONFIG_FILE"`
+
+	// Compress gzips report bodies, the server must be recent enough to inflate them
+	Compress bool `env:"COMPRESS"`
+	// SidecarAddress accepts updates from local apps on "unix:<path>" or a loopback host:port
+	SidecarAddress string `env:"SIDECAR_ADDRESS"`
 }
 
 type ConfigServer struct {
@@ -28,19 +70,139 @@ type ConfigServer struct {
 	StoreInterval time.Duration `env:"STORE_INTERVAL"`
 	StoreFile     string        `env:"STORE_FILE"`
 	Restore       bool          `env:"RESTORE"`
+	OTLPIDPrefix  string        `env:"OTLP_ID_PREFIX"`
+
+	ForwardUpstreams     []string      `env:"FORWARD_UPSTREAMS" envSeparator:","`
+	ForwardFilter        []string      `env:"FORWARD_FILTER" envSeparator:","`
+	ForwardPrefix        string        `env:"FORWARD_PREFIX"`
+	ForwardMaxHops       int           `env:"FORWARD_MAX_HOPS" envDefault:"1"`
+	ForwardBatchSize     int           `env:"FORWARD_BATCH_SIZE" envDefault:"100"`
+	ForwardFlushInterval time.Duration `env:"FORWARD_FLUSH_INTERVAL" envDefault:"1s"`
+	ForwardQueueSize     int           `env:"FORWARD_QUEUE_SIZE" envDefault:"10000"`
+	ForwardRetryCount    int           `env:"FORWARD_RETRY_COUNT" envDefault:"3"`
+
+	// RollupResolutions is a "step:retention,..." list, empty disables history
+	RollupResolutions string `env:"ROLLUP_RESOLUTIONS" envDefault:"1m:24h,5m:168h,1h:720h"`
+
+	// AlertRulesFile enables alerting, the rules are evaluated for every tenant
+	AlertRulesFile    string        `env:"ALERT_RULES_FILE"`
+	AlertEvalInterval time.Duration `env:"ALERT_EVAL_INTERVAL" envDefault:"15s"`
+
+	StreamBuffer  int `env:"STREAM_BUFFER" envDefault:"256"`
+	StreamBacklog int `env:"STREAM_BACKLOG" envDefault:"1024"`
+	// StreamHeartbeat keeps idle streams open through proxies, zero disables it
+	StreamHeartbeat time.Duration `env:"STREAM_HEARTBEAT" envDefault:"15s"`
+
+	// TenantsFile enables tenancy, every request then needs a tenant token
+	TenantsFile string `env:"TENANTS_FILE"`
+	// AgentStaleFactor is how many report intervals an agent may miss before it is stale
+	AgentStaleFactor float64 `env:"AGENT_STALE_FACTOR" envDefault:"3"`
+	// AgentForgetAfter drops agents silent for that long, zero keeps them
+	AgentForgetAfter time.Duration `env:"AGENT_FORGET_AFTER" envDefault:"24h"`
+	// AgentMax caps the agents tracked per tenant, zero means no cap
+	AgentMax int `env:"AGENT_MAX" envDefault:"10000"`
+
+	// MetadataFile keeps registered metric metadata, empty keeps it in memory
+	MetadataFile string `env:"METADATA_FILE"`
+
+	// MetricTTL evicts series without updates for that long, zero keeps them forever
+	MetricTTL time.Duration `env:"METRIC_TTL"`
+	// MetricTTLOverrides is a "prefix=ttl,..." list of per-prefix TTLs
+	MetricTTLOverrides string `env:"METRIC_TTL_OVERRIDES"`
+	// StaleGrace keeps expired series marked stale for that long before evicting them
+	StaleGrace    time.Duration `env:"METRIC_STALE_GRACE"`
+	SweepInterval time.Duration `env:"SWEEP_INTERVAL" envDefault:"1m"`
+
+	// ClientRate caps the requests per second of every client, zero disables it
+	ClientRate  float64 `env:"CLIENT_RATE"`
+	ClientBurst int     `env:"CLIENT_BURST" envDefault:"20"`
+	// WriteConcurrency caps the write requests handled at once, zero disables it
+	WriteConcurrency int `env:"WRITE_CONCURRENCY" envDefault:"64"`
+
+	// MaxBodyBytes bounds request bodies, 1 MiB when zero
+	MaxBodyBytes int64 `env:"MAX_BODY_BYTES"`
+	// StrictJSON rejects request fields the API doesn't know
+	StrictJSON bool `env:"STRICT_JSON"`
+
+	// AdminToken guards the /admin routes, empty disables them
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// AuthTokensFile lists hashed bearer tokens and their roles, empty leaves
+	// the API open. With tenancy the tenant token goes in X-Tenant-Token.
+	AuthTokensFile string `env:"AUTH_TOKENS_FILE"`
+
+	// AuditFile keeps the audit log of every mutation, empty only logs
+	// deletes and resets to the standard logger
+	AuditFile string `env:"AUDIT_FILE"`
+	// AuditMaxBytes rotates the audit log once it grows past that size
+	AuditMaxBytes   int64 `env:"AUDIT_MAX_BYTES" envDefault:"104857600"`
+	AuditMaxBackups int   `env:"AUDIT_MAX_BACKUPS" envDefault:"5"`
+
+	// TLSCertFile and TLSKeyFile enable TLS, empty serves plain HTTP
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+	// TLSClientCAFile requires client certificates signed by it, their
+	// common name is the agent ID
+	TLSClientCAFile string `env:"TLS_CLIENT_CA_FILE"`
 }
 
 type Service struct {
-	Storage map[string]metric.Metric
+	// Tenant names the tenant owning the storage
+	Tenant string
+	// Storage holds the series, sharded by metric ID
+	Storage *storage.Store
 	Server  ConfigServer
-	*sync.Mutex
+	// Rollups keeps downsampled history, nil when disabled
+	Rollups *rollup.Engine
+	// Alerts evaluates alerting rules, nil when disabled
+	Alerts *alert.Engine
+	// Stream fans updates out to live subscribers, nil when disabled
+	Stream *stream.Hub
+	// Agents tracks the reporting agents, nil when disabled
+	Agents *agents.Registry
+	// Meta locks metric types and keeps units and help texts, nil when disabled
+	Meta *meta.Registry
+	// Audit receives deletes and resets, and updates once enabled by
+	// EnableAudit. The standard logger when nil.
+	Audit audit.Sink
+	// Expiry evicts series that stopped receiving updates, nil when disabled
+	Expiry *expiry.Policy
+	// Telemetry keeps the server's own metrics, nil when disabled
+	Telemetry *telemetry.Server
+
+	// MaxMetrics caps the number of stored series, zero means no cap
+	MaxMetrics int
+	// Limiter caps the rate of updates, nil means no cap
+	Limiter *ratelimit.Bucket
+
+	hooks []UpdateHook
+	// auditUpdates is set once the update hooks record to Audit
+	auditUpdates bool
+	// fileMu orders the writes of the store file, in synchronous saving mode
+	// it is held from storing an update until it is appended
+	fileMu  sync.Mutex
+	evicted uint64
+}
+
+var (
+	ErrQuotaExceeded = errors.New("metric quota exceeded")
+	ErrRateLimited   = errors.New("update rate limit exceeded")
+)
+
+// Update describes a change applied to the storage
+type Update struct {
+	Old     metric.Metric
+	Existed bool
+	New     metric.Metric
 }
 
+// UpdateHook is called after every applied update, outside of the storage lock.
+// ctx is the context of the request that caused the update.
+type UpdateHook func(ctx context.Context, u Update)
+
 func NewService(srv *ConfigServer) *Service {
 	return &Service{
-		Storage: make(map[string]metric.Metric),
+		Storage: storage.New(storage.DefaultShards),
 		Server:  *srv,
-		Mutex:   &sync.Mutex{},
 	}
 }
 
@@ -52,112 +214,116 @@ func NewConfigAgent() *ConfigAgent {
 	return &ConfigAgent{}
 }
 
+// Decoder reads request bodies with the configured size limit and strictness
+func (s *Service) Decoder() validate.Decoder {
+	return validate.Decoder{
+		MaxBodyBytes:          s.Server.MaxBodyBytes,
+		DisallowUnknownFields: s.Server.StrictJSON,
+	}
+}
+
 func (s *Service) PostHandlerMetricsJSON(w http.ResponseWriter, r *http.Request) {
-	m := metric.Metric{}
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&m); err != nil {
-		log.Printf("unable to decode params in PostHandlerMetricsJSON, %s", err)
+	m, verr := s.Decoder().Update(w, r)
+	if verr != nil {
+		log.Printf("unable to decode params in PostHandlerMetricsJSON, %s", verr)
+		apierr.Write(w, verr)
 		return
 	}
 
-	if m.MType == metric.MetricTypeCounter {
-		id1, ok := s.Storage[m.ID]
-		if ok {
-			newDelta := id1.Delta + m.Delta
-			m.Delta = newDelta
-		}
+	if _, err := s.UpdateMetric(r.Context(), m); err != nil {
+		updateError(w, err)
+		return
 	}
+}
 
-	s.Storage[m.ID] = m
-
-	if s.Server.StoreInterval == 0 {
-		s, _ := history.NewSaver(s.Server.StoreFile)
-		s.WriteMetric(m)
-		defer s.Close()
+// PostHandlerMetricsBatchJSON saves a JSON array of metrics via POST /updates/
+func (s *Service) PostHandlerMetricsBatchJSON(w http.ResponseWriter, r *http.Request) {
+	// the whole batch is checked before any of it is applied
+	batch, verr := s.Decoder().Batch(w, r)
+	if verr != nil {
+		log.Printf("unable to decode params in PostHandlerMetricsBatchJSON, %s", verr)
+		apierr.Write(w, verr)
+		return
 	}
 
+	// a rejected update stops the batch, the ones before it stay applied
+	for _, m := range batch {
+		if _, err := s.UpdateMetric(r.Context(), m); err != nil {
+			updateError(w, err)
+			return
+		}
+	}
 }
 
 // Validate and save metrics via POST URI
 func (s *Service) PostHandlerMetricByURL(w http.ResponseWriter, r *http.Request) {
-	m, err := metric.ParseMetricEntityFromURL(r)
-	if err != nil {
-		switch err {
-		case metric.ErrMissmatchedType:
-			log.Println(err)
-			http.Error(w, "Wrong type", http.StatusNotImplemented)
-			return
-		case metric.ErrDeltaAssign:
-			log.Println(err)
-			http.Error(w, "Wrong delta", http.StatusBadRequest)
-			return
-		case metric.ErrValueAssign:
-			log.Println(err)
-			http.Error(w, "Wrong value", http.StatusBadRequest)
-			return
-		default:
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	m, verr := validate.URL(r)
+	if verr != nil {
+		log.Println(verr)
+		apierr.Write(w, verr)
+		return
 	}
-	ID := chi.URLParam(r, "id")
-	if m.MType == metric.MetricTypeCounter {
-		id1, ok := s.Storage[ID]
-		if ok {
-			newDelta := id1.Delta + m.Delta
-			m.Delta = newDelta
-		}
+	if _, err := s.UpdateMetric(r.Context(), m); err != nil {
+		updateError(w, err)
+		return
 	}
-	s.Storage[ID] = m
 
 }
 
 // GetMetricsByValue return metrics via GET /value/{type}/{id}
 func (s *Service) GetMetricsByValueURI(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
-	if metricType != string(metric.MetricTypeGauge) && metricType != string(metric.MetricTypeCounter) {
+	if verr := validate.Type(metric.MetricType(metricType)); verr != nil {
 		log.Println("missmatched type")
-		http.Error(w, "missmatched type", http.StatusBadRequest)
+		verr.Status = http.StatusBadRequest
+		apierr.Write(w, verr)
 		return
 	}
 	ID := chi.URLParam(r, "id")
-	met, ok := s.Storage[ID]
+	met, ok := s.Lookup(ID)
 	if !ok {
-		http.Error(w, "not found", http.StatusNotFound)
+		apierr.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	switch met.MType {
-	case metric.MetricTypeGauge:
-		fmt.Fprintf(w, "%v", met.Value)
-	case metric.MetricTypeCounter:
-		fmt.Fprintf(w, "%v", met.Delta)
+	met = s.describe(met)
+	if met.Unit != "" {
+		w.Header().Set("X-Metric-Unit", met.Unit)
+	}
+	if met.Help != "" {
+		w.Header().Set("X-Metric-Help", met.Help)
+	}
+	switch format := negotiate(r, formatPlain); format {
+	case formatPlain:
+		w.Header().Set("Content-Type", formatTypes[formatPlain])
+		fmt.Fprint(w, metricValue(met))
+	case formatJSON:
+		writeJSONValue(w, &met)
+	default:
+		writeMetrics(w, format, metricFields, []metric.Metric{met})
 	}
-
 }
 
 // POSTMetricsByValueJSON return metrics via JSON
 func (s *Service) POSTMetricsByValueJSON(w http.ResponseWriter, r *http.Request) {
-	m := metric.Metric{}
-	enc := json.NewDecoder(r.Body)
-	if err := enc.Decode(&m); err != nil {
-		log.Println(err)
-		http.Error(w, "wrong format", http.StatusBadRequest)
+	m, verr := s.Decoder().Lookup(w, r)
+	if verr != nil {
+		log.Println(verr)
+		apierr.Write(w, verr)
 		return
 	}
-	if m.MType != metric.MetricTypeGauge && m.MType != metric.MetricTypeCounter {
-		log.Println("missmatched type")
-		http.Error(w, "bad request", http.StatusBadRequest)
+	stored, ok := s.Lookup(m.Key())
+	if !ok || stored.MType != m.MType {
+		apierr.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	metric, ok := s.Storage[m.ID]
-	if !ok {
-		http.Error(w, "not found", http.StatusNotFound)
+	stored = s.describe(stored)
+	if format := negotiate(r, formatJSON); format != formatJSON {
+		writeMetrics(w, format, metricFields, []metric.Metric{stored})
+		return
 	}
 	w.Header().Set("content-type", "application/json")
-	if err := json.NewEncoder(w).Encode(&metric); err != nil {
-		http.Error(w, "unable to marshal the struct", http.StatusBadRequest)
-		return
+	if err := json.NewEncoder(w).Encode(&stored); err != nil {
+		log.Println(err)
 	}
 
 }
@@ -169,31 +335,148 @@ func (s *Service) GetMetrics(w http.ResponseWriter, r *http.Request) {
 
 	value, err := s.GetMetricsByKey(context.Background(), key)
 	if err != nil {
-		http.Error(w, "metric not found", http.StatusBadRequest)
+		apierr.Error(w, "metric not found", http.StatusBadRequest)
 		log.Println(err)
 		return
 	}
 
 	if err := json.NewEncoder(w).Encode(&value); err != nil {
-		http.Error(w, "unable to marshal the struct", http.StatusBadRequest)
+		apierr.Error(w, "unable to marshal the struct", http.StatusBadRequest)
 		return
 	}
 
 }
 
-// Return metrics data in html
+// GetMetricsAll lists every metric, as an HTML table unless Accept asks for
+// JSON, plain text or CSV
 func (s *Service) GetMetricsAll(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	for _, v := range s.Storage {
-		fmt.Fprintf(w, "%v<br>", v)
+	list := s.Snapshot()
+	format := negotiate(r, formatHTML)
+	if format == formatJSON {
+		writeJSONValue(w, list)
+		return
 	}
+	writeMetrics(w, format, []string{"key", "type", "value", "unit", "help"}, list)
 }
 
-func (s *Service) GetMetricsByKey(ctx context.Context, key string) (metric.Metric, error) {
-	s.Lock()
-	defer s.Unlock()
+// describe fills in the registered unit and help of m
+func (s *Service) describe(m metric.Metric) metric.Metric {
+	if s.Meta == nil {
+		return m
+	}
+	if md, ok := s.Meta.Get(m.ID); ok {
+		m.Unit, m.Help = md.Unit, md.Help
+	}
+	return m
+}
+
+// OnUpdate registers h to be called after every update
+func (s *Service) OnUpdate(h UpdateHook) {
+	s.hooks = append(s.hooks, h)
+}
+
+// UpdateMetric stores m, adding counter deltas to the stored value,
+// and returns what was stored
+func (s *Service) UpdateMetric(ctx context.Context, m metric.Metric) (metric.Metric, error) {
+	return s.store(ctx, m, true)
+}
+
+// SetMetric stores m as is, counters included
+func (s *Service) SetMetric(ctx context.Context, m metric.Metric) (metric.Metric, error) {
+	return s.store(ctx, m, false)
+}
+
+func (s *Service) store(ctx context.Context, m metric.Metric, accumulate bool) (metric.Metric, error) {
+	if err := validate.Metric(m); err != nil {
+		return metric.Metric{}, err
+	}
+	if s.Limiter != nil && !s.Limiter.Allow() {
+		return metric.Metric{}, ErrRateLimited
+	}
+
+	// unit and help go to the metadata registry, not into the storage
+	unit, help := m.Unit, m.Help
+	m.Unit, m.Help = "", ""
+
+	opts := storage.Options{Accumulate: accumulate, Now: time.Now(), Max: s.MaxMetrics}
+	if s.Meta != nil {
+		// the type is checked under the lock of the metric's series
+		opts.Check = func() error { return s.Meta.Observe(m.ID, m.MType, unit, help) }
+	}
+	syncSave := s.Server.StoreInterval == 0
+	if syncSave {
+		s.fileMu.Lock()
+	}
+	c, err := s.Storage.Put(m, opts)
+	if err == nil && syncSave {
+		s.persist(c.New)
+	}
+	if syncSave {
+		s.fileMu.Unlock()
+	}
+	if errors.Is(err, storage.ErrFull) {
+		return metric.Metric{}, ErrQuotaExceeded
+	}
+	if err != nil {
+		return metric.Metric{}, err
+	}
+
+	u := Update{Old: c.Old, Existed: c.Existed, New: c.New}
+	for _, h := range s.hooks {
+		h(ctx, u)
+	}
+	return c.New, nil
+}
+
+// updateError responds to a rejected update
+func updateError(w http.ResponseWriter, err error) {
+	var verr *apierr.Err
+	if errors.As(err, &verr) {
+		apierr.Write(w, verr)
+		return
+	}
+	switch err {
+	case ErrRateLimited:
+		w.Header().Set("Retry-After", "1")
+		apierr.Write(w, apierr.New(http.StatusTooManyRequests, apierr.CodeRateLimited, "", err.Error()))
+	case ErrQuotaExceeded:
+		apierr.Write(w, apierr.New(http.StatusForbidden, "quota_exceeded", "", err.Error()))
+	case meta.ErrTypeConflict:
+		apierr.Write(w, apierr.New(http.StatusConflict, "type_conflict", "type", err.Error()))
+	default:
+		log.Println(err)
+		apierr.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	m, ok := s.Storage[key]
+// persist appends m to the store file in synchronous saving mode
+func (s *Service) persist(m metric.Metric) {
+	if s.Server.StoreFile == "" {
+		return
+	}
+	start := time.Now()
+	saver, err := history.NewSaver(s.Server.StoreFile)
+	if err != nil {
+		log.Printf("unable to open %s: %s", s.Server.StoreFile, err)
+		s.observePersist(persistAppend, start, err)
+		return
+	}
+	defer saver.Close()
+	err = saver.WriteMetric(m)
+	if err != nil {
+		log.Printf("unable to save %s: %s", m.ID, err)
+	}
+	s.observePersist(persistAppend, start, err)
+}
+
+// Lookup returns the stored metric with the given key
+func (s *Service) Lookup(key string) (metric.Metric, bool) {
+	sr, ok := s.Storage.Get(key)
+	return sr.Metric, ok
+}
+
+func (s *Service) GetMetricsByKey(ctx context.Context, key string) (metric.Metric, error) {
+	m, ok := s.Lookup(key)
 	if !ok {
 		return metric.Metric{}, errors.New("metric not found")
 	}
@@ -1,26 +1,40 @@
 package config
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
-	"sync"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/audit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/expiry"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/history"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/meta"
 	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/ratelimit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/storage"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/stream"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/telemetry"
 )
 
-var testCs = &Service{
-	Storage: map[string]metric.Metric{
-		"test": {
-			ID:    "test",
-			MType: metric.MetricTypeCounter,
-			Value: 456,
-		},
-	},
-	Mutex: &sync.Mutex{},
-}
+var testCs = func() *Service {
+	s := NewService(&ConfigServer{})
+	s.Storage.Load(metric.Metric{
+		ID:    "test",
+		MType: metric.MetricTypeCounter,
+		Value: 456,
+	})
+	return s
+}()
 
 type postData struct {
 	key   string
@@ -104,3 +118,499 @@ func TestHandlerPost(t *testing.T) {
 	}
 
 }
+
+func TestUpdateQuotas(t *testing.T) {
+	s := NewService(&ConfigServer{})
+	s.MaxMetrics = 1
+	router := getRouterChi(s)
+
+	for _, tt := range []struct {
+		url  string
+		code int
+	}{
+		{"/update/gauge/a/1", http.StatusOK},
+		{"/update/gauge/a/2", http.StatusOK},
+		{"/update/gauge/b/1", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("for %s, expected %d but got %d", tt.url, tt.code, w.Code)
+		}
+	}
+
+	s.Limiter = ratelimit.NewBucket(0, 1)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/update/gauge/a/3", nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/gauge/a/4", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After but got %d", w.Code)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	s := NewService(&ConfigServer{StoreFile: file})
+	s.Expiry = &expiry.Policy{TTL: time.Minute, Grace: time.Minute}
+	s.Meta = meta.NewRegistry()
+	ctx := context.Background()
+	for _, id := range []string{"a", "b"} {
+		if _, err := s.UpdateMetric(ctx, metric.Metric{ID: id, MType: metric.MetricTypeGauge, Value: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// backdate the last updates
+	for id, age := range map[string]time.Duration{"a": 90 * time.Second, "b": 3 * time.Minute} {
+		m := metric.Metric{ID: id, MType: metric.MetricTypeGauge, Value: 1}
+		if _, err := s.Storage.Put(m, storage.Options{Now: time.Now().Add(-age)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isStale := func(key string) bool {
+		sr, ok := s.Storage.Get(key)
+		return ok && sr.Stale
+	}
+
+	res := s.Sweep(time.Now())
+	if res.Stale != 1 || len(res.Evicted) != 1 || res.Evicted[0] != "b" {
+		t.Fatalf("expected a stale and b evicted, got %+v", res)
+	}
+	if _, ok := s.Lookup("b"); ok {
+		t.Error("b is still stored")
+	}
+	if !isStale("a") {
+		t.Error("a is not marked stale")
+	}
+	// the evicted metric may come back with another type
+	if _, err := s.UpdateMetric(ctx, metric.Metric{ID: "b", MType: metric.MetricTypeCounter, Delta: 1}); err != nil {
+		t.Errorf("b kept its type after eviction: %s", err)
+	}
+	s.Delete([]string{"b"})
+
+	// the store file no longer holds the evicted series
+	r, err := history.NewRestorer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	restored, err := r.RestoreMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored["b"]; ok || len(restored) != 1 {
+		t.Errorf("expected only a in the store file, got %v", restored)
+	}
+
+	// an update revives a stale series
+	if _, err := s.SetMetric(ctx, metric.Metric{ID: "a", MType: metric.MetricTypeGauge, Value: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if isStale("a") {
+		t.Error("a is still stale after an update")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	s := NewService(&ConfigServer{})
+	s.Meta = meta.NewRegistry()
+	ctx := context.Background()
+
+	_, err := s.UpdateMetric(ctx, metric.Metric{ID: "Alloc", MType: metric.MetricTypeGauge, Value: 1.5, Unit: "bytes", Help: "Allocated heap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := s.Lookup("Alloc"); m.Unit != "" {
+		t.Error("metadata leaked into the storage")
+	}
+	_, err = s.UpdateMetric(ctx, metric.Metric{ID: "Alloc", MType: metric.MetricTypeCounter, Delta: 1})
+	if err != meta.ErrTypeConflict {
+		t.Errorf("expected a type conflict, got %v", err)
+	}
+	s.UpdateMetric(ctx, metric.Metric{ID: "http.requests", MType: metric.MetricTypeCounter, Delta: 3, Labels: metric.Labels{"code": `2"x"`}})
+
+	w := httptest.NewRecorder()
+	getRouterChi(s).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/counter/Alloc/1", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409 but got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.GetMetricsPrometheus(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	// no UNIT, the 0.0.4 text format doesn't know it
+	want := "# HELP Alloc Allocated heap\n# TYPE Alloc gauge\nAlloc 1.5\n" +
+		"# TYPE http_requests counter\nhttp_requests{code=\"2\\\"x\\\"\"} 3\n"
+	if w.Body.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, w.Body.String())
+	}
+}
+
+func TestDeleteKeepsConcurrentWrite(t *testing.T) {
+	s := NewService(&ConfigServer{})
+	s.Meta = meta.NewRegistry()
+	ctx := context.Background()
+	m := metric.Metric{ID: "Alloc", MType: metric.MetricTypeGauge, Value: 1}
+
+	for i := 0; i < 200; i++ {
+		if _, err := s.UpdateMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Delete([]string{"Alloc"})
+		}()
+		if _, err := s.UpdateMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		// a stored series always has its type registered
+		_, stored := s.Lookup("Alloc")
+		_, registered := s.Meta.Get("Alloc")
+		if stored && !registered {
+			t.Fatalf("run %d: Alloc is stored without metadata", i)
+		}
+		s.Delete([]string{"Alloc"})
+	}
+}
+
+func TestDeleteAndReset(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	s := NewService(&ConfigServer{StoreFile: file})
+	s.Meta = meta.NewRegistry()
+	s.Audit = discardAudit{}
+	ctx := context.Background()
+	for _, m := range []metric.Metric{
+		{ID: "Alloc", MType: metric.MetricTypeGauge, Value: 1},
+		{ID: "Allocs", MType: metric.MetricTypeCounter, Delta: 7},
+		{ID: "Load", MType: metric.MetricTypeGauge, Value: 1, Labels: metric.Labels{"host": "a"}},
+		{ID: "Load", MType: metric.MetricTypeGauge, Value: 2, Labels: metric.Labels{"host": "b"}},
+	} {
+		if _, err := s.UpdateMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := chi.NewRouter()
+	mux.Delete("/value/", s.DeleteMetrics)
+	mux.Delete("/value/{type}/{id}", s.DeleteMetricByURI)
+	mux.Post("/reset/{id}", s.PostResetCounter)
+	do := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	if w := do(http.MethodDelete, "/value/?selector="+url.QueryEscape(`{host="a"}`)+"&dry_run=true"); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `"count":1`) {
+		t.Errorf("dry run: %d %s", w.Code, w.Body)
+	}
+	if _, ok := s.Lookup(`Load{host="a"}`); !ok {
+		t.Error("dry run deleted a series")
+	}
+	if w := do(http.MethodDelete, "/value/?id=Load"); !strings.Contains(w.Body.String(), `"count":2`) {
+		t.Errorf("bulk delete: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodDelete, "/value/"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unbounded delete, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/value/counter/Alloc"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a wrong type, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/value/gauge/Alloc"); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	// the type of a deleted metric is free again
+	if _, err := s.UpdateMetric(ctx, metric.Metric{ID: "Alloc", MType: metric.MetricTypeCounter, Delta: 1}); err != nil {
+		t.Error(err)
+	}
+
+	if w := do(http.MethodPost, "/reset/Allocs"); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/reset/Load"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+
+	// tombstones keep deleted series out of a restore
+	r, err := history.NewRestorer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	restored, err := r.RestoreMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 || restored["Allocs"].Delta != 0 || restored["Alloc"].MType != metric.MetricTypeCounter {
+		t.Errorf("unexpected restore %v", restored)
+	}
+}
+
+type discardAudit struct{}
+
+func (discardAudit) Record(audit.Event) {}
+
+func TestNegotiate(t *testing.T) {
+	for _, tt := range []struct {
+		accept, def, want string
+	}{
+		{"", formatHTML, formatHTML},
+		{"application/json", formatHTML, formatJSON},
+		{"text/csv;q=0.5, application/json;q=0.9", formatPlain, formatJSON},
+		{"*/*", formatPlain, formatPlain},
+		{"text/*", formatJSON, formatPlain},
+		{"image/png", formatJSON, formatJSON},
+		{"text/html, text/plain", formatPlain, formatPlain},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := negotiate(r, tt.def); got != tt.want {
+			t.Errorf("Accept %q: expected %s but got %s", tt.accept, tt.want, got)
+		}
+	}
+}
+
+func TestMetricsList(t *testing.T) {
+	s := NewService(&ConfigServer{})
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		s.UpdateMetric(ctx, metric.Metric{ID: fmt.Sprintf("g%d", i), MType: metric.MetricTypeGauge, Value: float64(5 - i)})
+	}
+	s.UpdateMetric(ctx, metric.Metric{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: 3})
+
+	page := func(query string) listResponse {
+		w := httptest.NewRecorder()
+		s.GetMetricsList(w, httptest.NewRequest(http.MethodGet, "/api/v1/metrics?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", query, w.Code, w.Body)
+		}
+		resp := listResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	var ids []interface{}
+	resp := page("type=gauge&sort=-value&limit=2&fields=id")
+	for {
+		for _, m := range resp.Metrics {
+			ids = append(ids, m["id"])
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		resp = page("type=gauge&sort=-value&limit=2&fields=id&cursor=" + resp.NextCursor)
+	}
+	if fmt.Sprint(ids) != "[g0 g1 g2 g3 g4]" || resp.Total != 5 {
+		t.Errorf("unexpected pages %v, total %d", ids, resp.Total)
+	}
+
+	resp = page("match=^g[34]$")
+	if resp.Total != 2 || len(resp.Metrics[0]) != len(metricFields) {
+		t.Errorf("unexpected match result %+v", resp)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/metrics?prefix=Poll&fields=id,value", nil)
+	r.Header.Set("Accept", "text/csv")
+	s.GetMetricsList(w, r)
+	if w.Body.String() != "id,value\nPollCount,3\n" {
+		t.Errorf("unexpected csv %q", w.Body.String())
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	s := NewService(&ConfigServer{StrictJSON: true})
+	router := getRouterChi(s)
+
+	for _, tt := range []struct {
+		body   string
+		status int
+		code   string
+		field  string
+	}{
+		{`{"id":"Alloc","type":"gauge","value":1}`, http.StatusOK, "", ""},
+		{`{"id":"Alloc","type":"gauge"}`, http.StatusBadRequest, "missing_value", "value"},
+		{`{"id":"1Alloc","type":"gauge","value":1}`, http.StatusBadRequest, "invalid_id", "id"},
+		{`{"id":"Alloc","type":"gauge","value":1,"x":1}`, http.StatusBadRequest, "unknown_field", "x"},
+		{`{"id":"Alloc","type":"summary","value":1}`, http.StatusNotImplemented, "unknown_type", "type"},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("for %s, expected %d but got %d: %s", tt.body, tt.status, w.Code, w.Body)
+			continue
+		}
+		if tt.code == "" {
+			continue
+		}
+		var resp struct {
+			Error struct {
+				Code  string `json:"code"`
+				Field string `json:"field"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("for %s, error body is not JSON: %s", tt.body, w.Body)
+			continue
+		}
+		if resp.Error.Code != tt.code || resp.Error.Field != tt.field {
+			t.Errorf("for %s, expected %s/%s but got %+v", tt.body, tt.code, tt.field, resp.Error)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	af, err := audit.NewFile(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	s := NewService(&ConfigServer{})
+	s.Tenant = "default"
+	s.EnableAudit(af)
+	// updates outside a request aren't recorded
+	if _, err := s.UpdateMetric(context.Background(), metric.Metric{ID: "internal", MType: metric.MetricTypeGauge, Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := chi.NewRouter()
+	mux.Use(audit.Origin)
+	mux.Post("/update/{type}/{id}/{value}", s.PostHandlerMetricByURL)
+	mux.Post("/reset/{id}", s.PostResetCounter)
+	mux.Delete("/value/{type}/{id}", s.DeleteMetricByURI)
+	mux.Get("/audit", s.GetAudit)
+	do := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, url, nil)
+		mux.ServeHTTP(w, r.WithContext(agents.WithID(r.Context(), "agent-1")))
+		return w
+	}
+	do(http.MethodPost, "/update/counter/PollCount/5")
+	do(http.MethodPost, "/update/counter/PollCount/2")
+	do(http.MethodPost, "/reset/PollCount")
+	do(http.MethodDelete, "/value/counter/PollCount")
+
+	w := do(http.MethodGet, "/audit?id=PollCount")
+	var events []audit.Event
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+	want := []struct {
+		action   string
+		old, new int64
+	}{
+		{audit.ActionUpdate, -1, 5},
+		{audit.ActionUpdate, 5, 7},
+		{audit.ActionReset, 7, 0},
+		{audit.ActionDelete, 0, -1},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events but got %d: %s", len(want), len(events), w.Body)
+	}
+	for i, e := range events {
+		if e.Action != want[i].action || e.Agent != "agent-1" || e.Addr == "" || e.Tenant != "default" {
+			t.Errorf("event %d: %+v", i, e)
+		}
+		if (e.Old == nil) != (want[i].old < 0) || (e.Old != nil && e.Old.Delta != want[i].old) {
+			t.Errorf("event %d: wrong old value %+v", i, e.Old)
+		}
+		if (e.New == nil) != (want[i].new < 0) || (e.New != nil && e.New.Delta != want[i].new) {
+			t.Errorf("event %d: wrong new value %+v", i, e.New)
+		}
+	}
+	if events[0].Route != "POST /update/{type}/{id}/{value}" {
+		t.Errorf("wrong route %q", events[0].Route)
+	}
+
+	since := url.QueryEscape(events[3].Time.Format(time.RFC3339Nano))
+	if err := json.Unmarshal(do(http.MethodGet, "/audit?since="+since).Body.Bytes(), &events); err != nil || len(events) != 1 {
+		t.Errorf("expected the delete only since its time, got %v %v", events, err)
+	}
+	if w := do(http.MethodGet, "/audit?since=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	tel := telemetry.NewServer(telemetry.NewRegistry())
+	s := NewService(&ConfigServer{StoreFile: filepath.Join(t.TempDir(), "metrics.json")})
+	s.Tenant = "default"
+	s.EnableTelemetry(tel)
+	ctx := context.Background()
+	for _, m := range []metric.Metric{
+		{ID: "Alloc", MType: metric.MetricTypeGauge, Value: 1},
+		{ID: "Alloc", MType: metric.MetricTypeGauge, Value: 2},
+		{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: 1},
+	} {
+		if _, err := s.UpdateMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := tel.Registry.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`metrics_updates_total{tenant="default",type="gauge"} 2`,
+		`metrics_updates_total{tenant="default",type="counter"} 1`,
+		`metrics_persist_duration_seconds_count{tenant="default",op="append"} 3`,
+		`metrics_persist_duration_seconds_count{tenant="default",op="snapshot"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "metrics_persist_errors_total{") {
+		t.Errorf("unexpected persist errors in\n%s", b.String())
+	}
+}
+
+func TestStreamNoHeartbeat(t *testing.T) {
+	s := NewService(&ConfigServer{})
+	s.EnableStream(stream.NewHub(16, 16))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "/stream", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	// a zero heartbeat disables it rather than panicking in NewTicker
+	s.GetStreamSSE(w, r)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "heartbeat") {
+		t.Errorf("expected a stream without heartbeats, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestPrometheusFamilies(t *testing.T) {
+	s := NewService(&ConfigServer{})
+	ctx := context.Background()
+	for _, m := range []metric.Metric{
+		{ID: "cpu", MType: metric.MetricTypeGauge, Value: 1},
+		{ID: "cpu_x", MType: metric.MetricTypeGauge, Value: 2},
+		{ID: "cpu", MType: metric.MetricTypeGauge, Value: 3, Labels: metric.Labels{"host": "a"}},
+		// a.b and a_b are both exposed as a_b
+		{ID: "a_b", MType: metric.MetricTypeGauge, Value: 4, Labels: metric.Labels{"host": "a"}},
+		{ID: "a.b", MType: metric.MetricTypeGauge, Value: 5},
+		{ID: "a.b", MType: metric.MetricTypeGauge, Value: 6, Labels: metric.Labels{"host": "a"}},
+		{ID: "x.y", MType: metric.MetricTypeGauge, Value: 7},
+		{ID: "x_y", MType: metric.MetricTypeCounter, Delta: 8},
+	} {
+		if _, err := s.UpdateMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.GetMetricsPrometheus(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := "# TYPE a_b gauge\na_b 5\na_b{host=\"a\"} 6\n" +
+		"# TYPE cpu gauge\ncpu 1\ncpu{host=\"a\"} 3\n" +
+		"# TYPE cpu_x gauge\ncpu_x 2\n" +
+		"# TYPE x_y gauge\nx_y 7\n"
+	if w.Body.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, w.Body.String())
+	}
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/audit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/history"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/query"
+)
+
+// Match returns the stored series whose ID matches the glob and which match sel,
+// ordered by key. An empty glob or a nil selector matches everything.
+func (s *Service) Match(glob string, sel *query.Selector) ([]metric.Metric, error) {
+	if glob != "" {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, err
+		}
+	}
+	var list []metric.Metric
+	for _, m := range s.Storage.Metrics(true) {
+		if glob != "" {
+			if ok, _ := path.Match(glob, m.ID); !ok {
+				continue
+			}
+		}
+		if sel != nil && !sel.Matches(m) {
+			continue
+		}
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key() < list[j].Key() })
+	return list, nil
+}
+
+// Delete removes the series with the given keys from memory, history and
+// the store file, and returns the removed ones. The metadata of a metric
+// name goes with its last series, so a deleted metric can come back with
+// another type.
+func (s *Service) Delete(keys []string) []metric.Metric {
+	var last func(id string)
+	if s.Meta != nil {
+		// forgotten under the shard lock, so a concurrent write keeps its registration
+		last = s.forget
+	}
+	s.fileMu.Lock()
+	var deleted []metric.Metric
+	for _, key := range keys {
+		m, _, ok := s.Storage.Delete(key, last)
+		if !ok {
+			continue
+		}
+		deleted = append(deleted, m)
+	}
+	if len(deleted) > 0 && s.Server.StoreInterval == 0 {
+		s.tombstone(deleted)
+	}
+	s.fileMu.Unlock()
+
+	for _, m := range deleted {
+		if s.Rollups != nil {
+			s.Rollups.Delete(m.Key())
+		}
+	}
+	return deleted
+}
+
+// forget drops the metadata of a metric name once its last series is gone
+func (s *Service) forget(id string) {
+	if err := s.Meta.Delete(id); err != nil {
+		log.Println(err)
+	}
+}
+
+// tombstone appends deletion marks to the store file in synchronous saving mode
+func (s *Service) tombstone(deleted []metric.Metric) {
+	if s.Server.StoreFile == "" {
+		return
+	}
+	start := time.Now()
+	saver, err := history.NewSaver(s.Server.StoreFile)
+	if err != nil {
+		log.Printf("unable to open %s: %s", s.Server.StoreFile, err)
+		s.observePersist(persistTombstone, start, err)
+		return
+	}
+	defer saver.Close()
+	for _, m := range deleted {
+		if werr := saver.WriteTombstone(m); werr != nil {
+			log.Printf("unable to save the deletion of %s: %s", m.Key(), werr)
+			err = werr
+		}
+	}
+	s.observePersist(persistTombstone, start, err)
+}
+
+// DeleteMetricByURI removes an unlabeled metric via DELETE /value/{type}/{id}
+func (s *Service) DeleteMetricByURI(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "id")
+	m, ok := s.Lookup(key)
+	if !ok || string(m.MType) != chi.URLParam(r, "type") {
+		apierr.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	deleted := s.Delete([]string{key})
+	if len(deleted) == 0 {
+		apierr.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.recordDeleted(r.Context(), deleted, false)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&deleted[0]); err != nil {
+		log.Println(err)
+	}
+}
+
+type bulkDeleteResponse struct {
+	DryRun  bool     `json:"dryRun"`
+	Count   int      `json:"count"`
+	Deleted []string `json:"deleted"`
+}
+
+// DeleteMetrics removes every series matching an ID glob and/or a label selector
+// via DELETE /value/?id=&selector=&dry_run=
+// One of id and selector is required; dry_run=true only lists what would go.
+func (s *Service) DeleteMetrics(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	glob, selector := q.Get("id"), q.Get("selector")
+	if glob == "" && selector == "" {
+		apierr.Error(w, "id or selector is required", http.StatusBadRequest)
+		return
+	}
+	var sel *query.Selector
+	if selector != "" {
+		var err error
+		sel, err = query.ParseSelector(selector)
+		if err != nil {
+			apierr.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	matched, err := s.Match(glob, sel)
+	if err != nil {
+		apierr.Error(w, "wrong \"id\" pattern", http.StatusBadRequest)
+		return
+	}
+
+	resp := bulkDeleteResponse{DryRun: q.Get("dry_run") == "true", Deleted: []string{}}
+	deleted := matched
+	if !resp.DryRun {
+		keys := make([]string, 0, len(matched))
+		for _, m := range matched {
+			keys = append(keys, m.Key())
+		}
+		deleted = s.Delete(keys)
+	}
+	for _, m := range deleted {
+		resp.Deleted = append(resp.Deleted, m.Key())
+	}
+	resp.Count = len(resp.Deleted)
+	s.recordDeleted(r.Context(), deleted, resp.DryRun)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Println(err)
+	}
+}
+
+// PostResetCounter zeroes a counter via POST /reset/{id}
+func (s *Service) PostResetCounter(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "id")
+	m, ok := s.Lookup(key)
+	if !ok {
+		apierr.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if m.MType != metric.MetricTypeCounter {
+		apierr.Error(w, "only counters can be reset", http.StatusBadRequest)
+		return
+	}
+	old := m
+	m.Delta = 0
+	m, err := s.SetMetric(audit.WithAction(r.Context(), audit.ActionReset), m)
+	if err != nil {
+		updateError(w, err)
+		return
+	}
+	// with an audit log the update hook already recorded the reset
+	if !s.auditUpdates {
+		s.record(r.Context(), audit.Event{Action: audit.ActionReset, Old: &old, New: &m})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&m); err != nil {
+		log.Println(err)
+	}
+}
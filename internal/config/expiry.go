@@ -0,0 +1,141 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/expiry"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/history"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/storage"
+)
+
+// SweepResult is the outcome of a sweep
+type SweepResult struct {
+	Stale   int
+	Evicted []string
+}
+
+// Sweep marks series past their TTL as stale and evicts the ones past
+// the grace period, from memory, history and the store file.
+// Series restored from a file start their TTL at the first sweep.
+// Rollup buckets past their retention are dropped as well.
+func (s *Service) Sweep(now time.Time) SweepResult {
+	res := SweepResult{}
+	if s.Rollups != nil {
+		s.Rollups.Expire(now)
+	}
+	if s.Expiry == nil {
+		return res
+	}
+
+	// as with Delete, the name goes with its last series
+	var last func(id string)
+	if s.Meta != nil {
+		last = s.forget
+	}
+	// hold the file until it is rewritten, so no synchronous save lands in the replaced file
+	s.fileMu.Lock()
+	evicted := s.Storage.Scan(now, func(sr storage.Series) storage.Action {
+		if sr.Updated.IsZero() {
+			return storage.Touch
+		}
+		switch s.Expiry.State(sr.ID, sr.Updated, now) {
+		case expiry.Stale:
+			res.Stale++
+			return storage.MarkStale
+		case expiry.Expired:
+			return storage.Evict
+		}
+		return storage.Keep
+	}, last)
+	if len(evicted) > 0 && s.Server.StoreFile != "" {
+		start := time.Now()
+		err := history.Rewrite(s.Server.StoreFile, s.snapshot())
+		if err != nil {
+			log.Printf("unable to rewrite %s: %s", s.Server.StoreFile, err)
+		}
+		s.observePersist(persistSnapshot, start, err)
+	}
+	s.fileMu.Unlock()
+
+	for _, m := range evicted {
+		res.Evicted = append(res.Evicted, m.Key())
+	}
+	if s.Rollups != nil {
+		for _, key := range res.Evicted {
+			s.Rollups.Delete(key)
+		}
+	}
+	if len(res.Evicted) > 0 {
+		atomic.AddUint64(&s.evicted, uint64(len(res.Evicted)))
+		sort.Strings(res.Evicted)
+		log.Printf("Evicted %d expired series", len(res.Evicted))
+	}
+	return res
+}
+
+// Save rewrites the store file with the current storage
+func (s *Service) Save() error {
+	if s.Server.StoreFile == "" {
+		return nil
+	}
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	start := time.Now()
+	err := history.Rewrite(s.Server.StoreFile, s.snapshot())
+	s.observePersist(persistSnapshot, start, err)
+	return err
+}
+
+// snapshot copies the storage at a single point in time, ordered by key
+func (s *Service) snapshot() []metric.Metric {
+	return s.Storage.Metrics(true)
+}
+
+type expiryOverride struct {
+	Prefix string  `json:"prefix"`
+	TTL    float64 `json:"ttl"`
+}
+
+type expiryResponse struct {
+	TTL       float64          `json:"ttl"`
+	Grace     float64          `json:"grace"`
+	Overrides []expiryOverride `json:"overrides"`
+	Stale     []string         `json:"stale"`
+	Evicted   uint64           `json:"evictedTotal"`
+}
+
+// GetExpiry shows the TTL policy, the stale series and the eviction count via GET /expiry
+// Durations are in seconds.
+func (s *Service) GetExpiry(w http.ResponseWriter, r *http.Request) {
+	if s.Expiry == nil {
+		apierr.Error(w, "expiry is disabled", http.StatusNotFound)
+		return
+	}
+	resp := expiryResponse{
+		TTL:       s.Expiry.TTL.Seconds(),
+		Grace:     s.Expiry.Grace.Seconds(),
+		Overrides: []expiryOverride{},
+		Stale:     []string{},
+		Evicted:   atomic.LoadUint64(&s.evicted),
+	}
+	for _, o := range s.Expiry.Overrides {
+		resp.Overrides = append(resp.Overrides, expiryOverride{Prefix: o.Prefix, TTL: o.TTL.Seconds()})
+	}
+	for _, sr := range s.Storage.Snapshot() {
+		if sr.Stale {
+			resp.Stale = append(resp.Stale, sr.Key())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type listResponse struct {
+	Metrics    []map[string]interface{} `json:"metrics"`
+	Total      int                      `json:"total"`
+	NextCursor string                   `json:"nextCursor,omitempty"`
+}
+
+// metricOrders are the sort orders of the listing, ties are broken by key
+var metricOrders = map[string]func(a, b metric.Metric) bool{
+	"key": func(a, b metric.Metric) bool { return a.Key() < b.Key() },
+	"id": func(a, b metric.Metric) bool {
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Key() < b.Key()
+	},
+	"type": func(a, b metric.Metric) bool {
+		if a.MType != b.MType {
+			return a.MType < b.MType
+		}
+		return a.Key() < b.Key()
+	},
+	"value": func(a, b metric.Metric) bool {
+		av, bv := numeric(a), numeric(b)
+		if av != bv {
+			return av < bv
+		}
+		return a.Key() < b.Key()
+	},
+}
+
+func numeric(m metric.Metric) float64 {
+	if m.MType == metric.MetricTypeCounter {
+		return float64(m.Delta)
+	}
+	return m.Value
+}
+
+// GetMetricsList lists metrics page by page via
+// GET /api/v1/metrics?type=&prefix=&match=&sort=&limit=&cursor=&fields=
+// match is a regular expression on IDs, sort is key, id, type or value with
+// a leading "-" for descending order, fields a comma separated subset of
+// key,id,type,value,labels,unit,help. The cursor of the next page comes in
+// nextCursor, or the X-Next-Cursor header for non-JSON formats.
+func (s *Service) GetMetricsList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	typ := metric.MetricType(q.Get("type"))
+	if typ != "" && typ != metric.MetricTypeGauge && typ != metric.MetricTypeCounter {
+		apierr.Error(w, "wrong \"type\"", http.StatusBadRequest)
+		return
+	}
+	var re *regexp.Regexp
+	if v := q.Get("match"); v != "" {
+		var err error
+		if re, err = regexp.Compile(v); err != nil {
+			apierr.Error(w, "wrong \"match\": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	order := strings.TrimPrefix(q.Get("sort"), "-")
+	if order == "" {
+		order = "key"
+	}
+	less, ok := metricOrders[order]
+	if !ok {
+		apierr.Error(w, "wrong \"sort\"", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(q.Get("sort"), "-") {
+		asc := less
+		less = func(a, b metric.Metric) bool { return asc(b, a) }
+	}
+
+	limit := defaultPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			apierr.Error(w, "wrong \"limit\"", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	fields := metricFields
+	if v := q.Get("fields"); v != "" {
+		fields = strings.Split(v, ",")
+		for _, f := range fields {
+			if fieldValue(metric.Metric{}, f) == nil {
+				apierr.Error(w, "unknown field "+strconv.Quote(f), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	var after *metric.Metric
+	if v := q.Get("cursor"); v != "" {
+		m, err := decodeCursor(v)
+		if err != nil {
+			apierr.Error(w, "wrong \"cursor\"", http.StatusBadRequest)
+			return
+		}
+		after = &m
+	}
+
+	prefix := q.Get("prefix")
+	list := s.Snapshot()
+	kept := list[:0]
+	for _, m := range list {
+		if typ != "" && m.MType != typ || !strings.HasPrefix(m.ID, prefix) || re != nil && !re.MatchString(m.ID) {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	list = kept
+	sortMetrics(list, less)
+
+	resp := listResponse{Total: len(list)}
+	start := 0
+	if after != nil {
+		// resume after the last metric of the previous page, wherever
+		// inserts and deletes have moved it since
+		for start < len(list) && !less(*after, list[start]) {
+			start++
+		}
+	}
+	end := start + limit
+	if end > len(list) {
+		end = len(list)
+	}
+	page := list[start:end]
+	if end < len(list) {
+		resp.NextCursor = encodeCursor(page[len(page)-1])
+	}
+
+	format := negotiate(r, formatJSON)
+	if format != formatJSON {
+		if resp.NextCursor != "" {
+			w.Header().Set("X-Next-Cursor", resp.NextCursor)
+		}
+		writeMetrics(w, format, fields, page)
+		return
+	}
+	resp.Metrics = selectFields(page, fields)
+	writeJSONValue(w, &resp)
+}
+
+// cursor holds the sort keys of the last metric of a page
+type cursor struct {
+	ID     string            `json:"i"`
+	Type   metric.MetricType `json:"t"`
+	Labels metric.Labels     `json:"l,omitempty"`
+	Value  float64           `json:"v,omitempty"`
+	Delta  int64             `json:"d,omitempty"`
+}
+
+func encodeCursor(m metric.Metric) string {
+	data, _ := json.Marshal(cursor{ID: m.ID, Type: m.MType, Labels: m.Labels, Value: m.Value, Delta: m.Delta})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(v string) (metric.Metric, error) {
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return metric.Metric{}, err
+	}
+	c := cursor{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return metric.Metric{}, err
+	}
+	return metric.Metric{ID: c.ID, MType: c.Type, Labels: c.Labels, Value: c.Value, Delta: c.Delta}, nil
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/meta"
+)
+
+// GetMetadata lists the registered metric metadata via GET /metadata
+func (s *Service) GetMetadata(w http.ResponseWriter, r *http.Request) {
+	if s.Meta == nil {
+		apierr.Error(w, "metadata registry is disabled", http.StatusNotFound)
+		return
+	}
+	writeMeta(w, http.StatusOK, s.Meta.List())
+}
+
+// GetMetadataByID returns the metadata of a metric via GET /metadata/{id}
+func (s *Service) GetMetadataByID(w http.ResponseWriter, r *http.Request) {
+	if s.Meta == nil {
+		apierr.Error(w, "metadata registry is disabled", http.StatusNotFound)
+		return
+	}
+	m, ok := s.Meta.Get(chi.URLParam(r, "id"))
+	if !ok {
+		apierr.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeMeta(w, http.StatusOK, m)
+}
+
+// PostMetadata registers a metric's type, unit and help via POST /metadata
+func (s *Service) PostMetadata(w http.ResponseWriter, r *http.Request) {
+	if s.Meta == nil {
+		apierr.Error(w, "metadata registry is disabled", http.StatusNotFound)
+		return
+	}
+	m := meta.Meta{}
+	dec := s.Decoder()
+	if verr := dec.Decode(dec.Body(w, r), &m); verr != nil {
+		apierr.Write(w, verr)
+		return
+	}
+	m, err := s.Meta.Register(m)
+	switch err {
+	case nil:
+		writeMeta(w, http.StatusOK, m)
+	case meta.ErrInvalid:
+		apierr.Error(w, err.Error(), http.StatusBadRequest)
+	case meta.ErrTypeConflict:
+		apierr.Write(w, apierr.New(http.StatusConflict, "type_conflict", "type", err.Error()))
+	default:
+		log.Println(err)
+		apierr.Error(w, "unable to save metadata", http.StatusInternalServerError)
+	}
+}
+
+func writeMeta(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
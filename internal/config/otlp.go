@@ -0,0 +1,61 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/audit"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/otlp"
+)
+
+// PostHandlerOTLP accepts OTLP/HTTP JSON ExportMetricsServiceRequest payloads via POST /v1/metrics
+func (s *Service) PostHandlerOTLP(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		apierr.Error(w, "only application/json is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// gzip bodies are inflated by validate.Gunzip, the limit applies to the inflated body
+	dec := s.Decoder()
+	body := dec.Body(w, r)
+
+	req := otlp.ExportMetricsServiceRequest{}
+	// OTLP receivers must ignore unknown fields, so no strict decoding here
+	dec.DisallowUnknownFields = false
+	if verr := dec.Decode(body, &req); verr != nil {
+		log.Printf("unable to decode params in PostHandlerOTLP, %s", verr)
+		apierr.Write(w, verr)
+		return
+	}
+
+	res := otlp.Convert(&req, otlp.Options{IDPrefixAttribute: s.Server.OTLPIDPrefix})
+	ctx := audit.WithAction(r.Context(), audit.ActionImport)
+	for _, p := range res.Points {
+		var err error
+		if p.Cumulative {
+			_, err = s.SetMetric(ctx, p.Metric)
+		} else {
+			_, err = s.UpdateMetric(ctx, p.Metric)
+		}
+		if err != nil {
+			res.Rejected++
+			res.Errors = append(res.Errors, err.Error())
+		}
+	}
+
+	resp := otlp.ExportMetricsServiceResponse{}
+	if res.Rejected > 0 {
+		resp.PartialSuccess = &otlp.ExportMetricsPartialSuccess{
+			RejectedDataPoints: res.Rejected,
+			ErrorMessage:       res.Message(),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Println(err)
+	}
+}
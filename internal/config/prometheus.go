@@ -0,0 +1,132 @@
+package config
+
+import (
+	"bufio"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// GetMetricsPrometheus serves every series in the Prometheus text format via GET /metrics
+// Stale series are left out like in queries.
+func (s *Service) GetMetricsPrometheus(w http.ResponseWriter, r *http.Request) {
+	list := s.Storage.Metrics(false)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writePrometheus(bw, list, s.describe)
+	if err := bw.Flush(); err != nil {
+		log.Println(err)
+	}
+}
+
+// family is the series exposed under one Prometheus name
+type family struct {
+	name   string
+	mtype  metric.MetricType
+	help   string
+	series []promSeries
+}
+
+type promSeries struct {
+	labels string
+	m      metric.Metric
+}
+
+// writePrometheus renders list with one HELP and TYPE header per exposed name.
+// IDs mapping to the same name share its family when they have the same type,
+// otherwise the ones sorting later are left out, as are repeated series.
+func writePrometheus(w *bufio.Writer, list []metric.Metric, describe func(metric.Metric) metric.Metric) {
+	families := make(map[string]*family)
+	var names []string
+	for _, m := range list {
+		name := promName(m.ID)
+		f, ok := families[name]
+		if !ok {
+			f = &family{name: name, mtype: m.MType, help: describe(m).Help}
+			families[name] = f
+			names = append(names, name)
+		}
+		if f.mtype != m.MType {
+			log.Printf("metric %s is exposed as %s, which is already a %s", m.Key(), name, f.mtype)
+			continue
+		}
+		f.series = append(f.series, promSeries{labels: promLabels(m.Labels), m: m})
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+		if f.help != "" {
+			w.WriteString("# HELP " + name + " " + promEscape(f.help, false) + "\n")
+		}
+		w.WriteString("# TYPE " + name + " " + string(f.mtype) + "\n")
+
+		sort.SliceStable(f.series, func(i, j int) bool { return f.series[i].labels < f.series[j].labels })
+		for i, sr := range f.series {
+			if i > 0 && sr.labels == f.series[i-1].labels {
+				log.Printf("metric %s repeats series %s%s", sr.m.Key(), name, sr.labels)
+				continue
+			}
+			w.WriteString(name)
+			w.WriteString(sr.labels)
+			w.WriteByte(' ')
+			if sr.m.MType == metric.MetricTypeCounter {
+				w.WriteString(strconv.FormatInt(sr.m.Delta, 10))
+			} else {
+				w.WriteString(strconv.FormatFloat(sr.m.Value, 'g', -1, 64))
+			}
+			w.WriteByte('\n')
+		}
+	}
+}
+
+// promLabels renders labels sorted by name, empty without labels
+func promLabels(labels metric.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(promName(k) + `="` + promEscape(labels[k], true) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// promName replaces the characters Prometheus doesn't allow in names with underscores
+func promName(id string) string {
+	b := []byte(id)
+	for i, c := range b {
+		ok := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func promEscape(v string, quoted bool) string {
+	if quoted {
+		return valueEscaper.Replace(v)
+	}
+	return helpEscaper.Replace(v)
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/query"
+)
+
+// liveWindow is how far back a query time may lie and still read the live value
+const liveWindow = time.Minute
+
+// querySource serves current values from the storage and past ones from the rollups
+type querySource struct {
+	s   *Service
+	now time.Time
+}
+
+func (qs querySource) Series() []metric.Metric {
+	// stale series drop out of queries while they await eviction
+	return qs.s.Storage.Metrics(false)
+}
+
+func (qs querySource) ValueAt(key string, t time.Time) (float64, bool) {
+	if qs.now.Sub(t) < liveWindow || qs.s.Rollups == nil {
+		m, ok := qs.s.Lookup(key)
+		if !ok {
+			return 0, false
+		}
+		if m.MType == metric.MetricTypeCounter {
+			return float64(m.Delta), true
+		}
+		return m.Value, true
+	}
+	return qs.s.Rollups.LastAt(key, t)
+}
+
+func (qs querySource) Increase(key string, from, to time.Time) (float64, bool) {
+	if qs.s.Rollups == nil {
+		return 0, false
+	}
+	inc, ok := qs.s.Rollups.Increase(key, from, to)
+	return float64(inc), ok
+}
+
+type querySample struct {
+	ID     string           `json:"id,omitempty"`
+	Labels metric.Labels    `json:"labels"`
+	Value  *[2]interface{}  `json:"value,omitempty"`
+	Values [][2]interface{} `json:"values,omitempty"`
+}
+
+type queryResponse struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+// queryPoint renders a value as [unix seconds, "value"], the string keeps NaN and Inf encodable
+func queryPoint(t time.Time, v float64) [2]interface{} {
+	return [2]interface{}{float64(t.UnixNano()) / 1e9, strconv.FormatFloat(v, 'g', -1, 64)}
+}
+
+// GetQuery evaluates an expression via GET /query?expr=&time=
+func (s *Service) GetQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	expr, err := query.Parse(q.Get("expr"))
+	if err != nil {
+		apierr.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	t, err := parseTime(q.Get("time"), now)
+	if err != nil {
+		apierr.Error(w, "wrong \"time\"", http.StatusBadRequest)
+		return
+	}
+
+	v, err := query.Eval(expr, querySource{s: s, now: now}, t)
+	if err != nil {
+		apierr.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	resp := queryResponse{ResultType: v.Type()}
+	switch v := v.(type) {
+	case query.Scalar:
+		resp.Result = queryPoint(t, float64(v))
+	case query.Vector:
+		list := make([]querySample, 0, len(v))
+		for _, smp := range v {
+			p := queryPoint(t, smp.Value)
+			list = append(list, querySample{ID: smp.ID, Labels: nonNil(smp.Labels), Value: &p})
+		}
+		resp.Result = list
+	}
+	writeQueryResponse(w, resp)
+}
+
+// GetQueryRange evaluates an expression over time via GET /query_range?expr=&start=&end=&step=
+// The range defaults to the last hour with a minute step.
+func (s *Service) GetQueryRange(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	expr, err := query.Parse(q.Get("expr"))
+	if err != nil {
+		apierr.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	end, err := parseTime(q.Get("end"), now)
+	if err != nil {
+		apierr.Error(w, "wrong \"end\"", http.StatusBadRequest)
+		return
+	}
+	start, err := parseTime(q.Get("start"), end.Add(-time.Hour))
+	if err != nil {
+		apierr.Error(w, "wrong \"start\"", http.StatusBadRequest)
+		return
+	}
+	step, err := parseStep(q.Get("step"))
+	if err != nil {
+		apierr.Error(w, "wrong \"step\"", http.StatusBadRequest)
+		return
+	}
+	if step == 0 {
+		step = time.Minute
+	}
+
+	series, err := query.EvalRange(expr, querySource{s: s, now: now}, start, end, step)
+	if err != nil {
+		apierr.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	list := make([]querySample, 0, len(series))
+	for _, ser := range series {
+		smp := querySample{ID: ser.ID, Labels: nonNil(ser.Labels), Values: make([][2]interface{}, 0, len(ser.Points))}
+		for _, p := range ser.Points {
+			smp.Values = append(smp.Values, queryPoint(p.T, p.V))
+		}
+		list = append(list, smp)
+	}
+	writeQueryResponse(w, queryResponse{ResultType: "matrix", Result: list})
+}
+
+// nonNil keeps label sets rendered as objects rather than null
+func nonNil(l metric.Labels) metric.Labels {
+	if l == nil {
+		return metric.Labels{}
+	}
+	return l
+}
+
+func writeQueryResponse(w http.ResponseWriter, resp queryResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Println(err)
+	}
+}
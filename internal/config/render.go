@@ -0,0 +1,210 @@
+package config
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// Formats the read routes can answer in
+const (
+	formatJSON  = "json"
+	formatPlain = "plain"
+	formatCSV   = "csv"
+	formatHTML  = "html"
+)
+
+var mediaFormats = map[string]string{
+	"application/json": formatJSON,
+	"text/plain":       formatPlain,
+	"text/csv":         formatCSV,
+	"text/html":        formatHTML,
+}
+
+var formatTypes = map[string]string{
+	formatJSON:  "application/json",
+	formatPlain: "text/plain; charset=utf-8",
+	formatCSV:   "text/csv; charset=utf-8",
+	formatHTML:  "text/html; charset=utf-8",
+}
+
+// negotiate picks the format of the response from the Accept header,
+// preferring def among equally weighted types and when nothing matches
+func negotiate(r *http.Request, def string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return def
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		format := mediaFormats[mt]
+		switch mt {
+		case "*/*":
+			format = def
+		case "text/*":
+			format = formatPlain
+			if def != formatJSON {
+				format = def
+			}
+		}
+		if format == "" {
+			continue
+		}
+		if q > bestQ || q == bestQ && format == def {
+			best, bestQ = format, q
+		}
+	}
+	if best == "" {
+		return def
+	}
+	return best
+}
+
+// metricFields are the fields a metric renders, in order
+var metricFields = []string{"key", "id", "type", "value", "labels", "unit", "help"}
+
+// fieldValue returns a field of m for JSON output
+func fieldValue(m metric.Metric, field string) interface{} {
+	switch field {
+	case "key":
+		return m.Key()
+	case "id":
+		return m.ID
+	case "type":
+		return m.MType
+	case "value":
+		if m.MType == metric.MetricTypeCounter {
+			return m.Delta
+		}
+		return m.Value
+	case "labels":
+		return nonNil(m.Labels)
+	case "unit":
+		return m.Unit
+	case "help":
+		return m.Help
+	}
+	return nil
+}
+
+// fieldString returns a field of m for text output
+func fieldString(m metric.Metric, field string) string {
+	switch field {
+	case "value":
+		return metricValue(m)
+	case "labels":
+		if len(m.Labels) == 0 {
+			return ""
+		}
+		return m.Labels.String()
+	}
+	return fmt.Sprint(fieldValue(m, field))
+}
+
+func metricValue(m metric.Metric) string {
+	if m.MType == metric.MetricTypeCounter {
+		return strconv.FormatInt(m.Delta, 10)
+	}
+	return strconv.FormatFloat(m.Value, 'g', -1, 64)
+}
+
+// selectFields renders list as JSON objects holding only fields
+func selectFields(list []metric.Metric, fields []string) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(list))
+	for _, m := range list {
+		obj := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			obj[f] = fieldValue(m, f)
+		}
+		out = append(out, obj)
+	}
+	return out
+}
+
+// writeMetrics renders list in the given text format, one row per metric
+func writeMetrics(w http.ResponseWriter, format string, fields []string, list []metric.Metric) {
+	w.Header().Set("Content-Type", formatTypes[format])
+	switch format {
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(fields)
+		for _, m := range list {
+			row := make([]string, 0, len(fields))
+			for _, f := range fields {
+				row = append(row, fieldString(m, f))
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Println(err)
+		}
+	case formatPlain:
+		for _, m := range list {
+			row := make([]string, 0, len(fields))
+			for _, f := range fields {
+				if v := fieldString(m, f); v != "" {
+					row = append(row, v)
+				}
+			}
+			fmt.Fprintln(w, strings.Join(row, " "))
+		}
+	case formatHTML:
+		fmt.Fprint(w, "<table>\n<tr>")
+		for _, f := range fields {
+			fmt.Fprintf(w, "<th>%s</th>", html.EscapeString(f))
+		}
+		fmt.Fprint(w, "</tr>\n")
+		for _, m := range list {
+			fmt.Fprint(w, "<tr>")
+			for _, f := range fields {
+				fmt.Fprintf(w, "<td>%s</td>", html.EscapeString(fieldString(m, f)))
+			}
+			fmt.Fprint(w, "</tr>\n")
+		}
+		fmt.Fprint(w, "</table>\n")
+	}
+}
+
+// Snapshot returns a copy of every stored metric with its metadata, ordered by key.
+// The copy is a single point in time, so it never mixes states of the storage.
+func (s *Service) Snapshot() []metric.Metric {
+	list := s.snapshot()
+	for i := range list {
+		list[i] = s.describe(list[i])
+	}
+	return list
+}
+
+func sortMetrics(list []metric.Metric, less func(a, b metric.Metric) bool) {
+	sort.SliceStable(list, func(i, j int) bool { return less(list[i], list[j]) })
+}
+
+func writeJSONValue(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", formatTypes[formatJSON])
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/rollup"
+)
+
+// EnableRollups feeds every update into e and serves history queries from it
+func (s *Service) EnableRollups(e *rollup.Engine) {
+	s.Rollups = e
+	s.OnUpdate(func(ctx context.Context, u Update) {
+		var increase int64
+		if u.New.MType == metric.MetricTypeCounter {
+			increase = u.New.Delta
+			if u.Existed && u.Old.MType == metric.MetricTypeCounter {
+				increase -= u.Old.Delta
+			}
+			// a counter going down was reset and counts from zero
+			if increase < 0 {
+				increase = u.New.Delta
+			}
+		}
+		e.Record(u.New, increase, time.Now())
+	})
+}
+
+type historyBucket struct {
+	Start    time.Time `json:"start"`
+	Count    int64     `json:"count"`
+	Last     float64   `json:"last"`
+	Min      *float64  `json:"min,omitempty"`
+	Max      *float64  `json:"max,omitempty"`
+	Sum      *float64  `json:"sum,omitempty"`
+	Avg      *float64  `json:"avg,omitempty"`
+	Increase *int64    `json:"increase,omitempty"`
+}
+
+type historyResponse struct {
+	ID         string            `json:"id"`
+	Type       metric.MetricType `json:"type"`
+	Resolution string            `json:"resolution"`
+	Step       string            `json:"step"`
+	Buckets    []historyBucket   `json:"buckets"`
+}
+
+// GetMetricHistory returns rolled up windows via GET /history?id=&from=&to=&step=
+// from and to are RFC 3339 times or unix seconds, step is a duration or seconds.
+// The range defaults to the last hour.
+func (s *Service) GetMetricHistory(w http.ResponseWriter, r *http.Request) {
+	if s.Rollups == nil {
+		apierr.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	id := q.Get("id")
+	if id == "" {
+		apierr.Error(w, "empty \"id\" query param", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	to, err := parseTime(q.Get("to"), now)
+	if err != nil {
+		apierr.Error(w, "wrong \"to\"", http.StatusBadRequest)
+		return
+	}
+	from, err := parseTime(q.Get("from"), to.Add(-time.Hour))
+	if err != nil || !from.Before(to) {
+		apierr.Error(w, "wrong \"from\"", http.StatusBadRequest)
+		return
+	}
+	step, err := parseStep(q.Get("step"))
+	if err != nil {
+		apierr.Error(w, "wrong \"step\"", http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.Rollups.Query(id, from, to, step)
+	if errors.Is(err, rollup.ErrNoSeries) {
+		apierr.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	resp := historyResponse{
+		ID:         id,
+		Type:       res.Type,
+		Resolution: res.Resolution.Step.String(),
+		Step:       res.Step.String(),
+		Buckets:    make([]historyBucket, 0, len(res.Buckets)),
+	}
+	for _, b := range res.Buckets {
+		b := b
+		hb := historyBucket{Start: b.Start, Count: b.Count, Last: b.Last}
+		if res.Type == metric.MetricTypeCounter {
+			hb.Increase = &b.Increase
+		} else {
+			avg := b.Sum / float64(b.Count)
+			hb.Min, hb.Max, hb.Sum, hb.Avg = &b.Min, &b.Max, &b.Sum, &avg
+		}
+		resp.Buckets = append(resp.Buckets, hb)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Println(err)
+	}
+}
+
+// parseTime accepts RFC 3339 and unix seconds, def is used for an empty value
+func parseTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(sec*float64(time.Second))), nil
+}
+
+// parseStep accepts Go durations and plain seconds, zero for an empty value
+func parseStep(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return d, nil
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(sec * float64(time.Second)), nil
+}
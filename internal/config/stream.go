@@ -0,0 +1,170 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/stream"
+	"golang.org/x/net/websocket"
+)
+
+// EnableStream publishes every applied update to h
+func (s *Service) EnableStream(h *stream.Hub) {
+	s.Stream = h
+	s.OnUpdate(func(ctx context.Context, u Update) {
+		h.Publish(u.New)
+	})
+}
+
+// subscribe parses the filter and resume position of a stream request
+func (s *Service) subscribe(r *http.Request) (*stream.Subscriber, bool) {
+	q := r.URL.Query()
+	filter := stream.ParseFilter(q.Get("id"), q.Get("type"))
+
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = q.Get("lastEventId")
+	}
+	lastID, err := strconv.ParseUint(last, 10, 64)
+	return s.Stream.Subscribe(filter, lastID, err == nil)
+}
+
+// GetStreamSSE pushes metric changes as Server-Sent Events via GET /stream?id=&type=
+// id holds comma separated ID patterns, type comma separated metric types.
+// A reconnecting client resumes after its Last-Event-ID; a "reset" event
+// tells it that some changes are lost and it should reload all metrics.
+func (s *Service) GetStreamSSE(w http.ResponseWriter, r *http.Request) {
+	if s.Stream == nil {
+		apierr.Error(w, "streaming is disabled", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apierr.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, complete := s.subscribe(r)
+	defer s.Stream.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	flusher.Flush()
+
+	heartbeat, stop := s.heartbeat()
+	defer stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case ev, ok := <-sub.C:
+			if !ok {
+				if sub.Dropped() {
+					fmt.Fprint(w, "event: dropped\ndata: {}\n\n")
+					flusher.Flush()
+				}
+				return
+			}
+			data, err := json.Marshal(&ev.Metric)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: metric\ndata: %s\n\n", ev.ID, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// heartbeat ticks every StreamHeartbeat, zero or less never ticks
+func (s *Service) heartbeat() (<-chan time.Time, func()) {
+	if s.Server.StreamHeartbeat <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(s.Server.StreamHeartbeat)
+	return t.C, t.Stop
+}
+
+type wsMessage struct {
+	Type  string        `json:"type"`
+	Event *stream.Event `json:"event,omitempty"`
+}
+
+// GetStreamWS is the WebSocket equivalent of GetStreamSSE via GET /stream/ws
+// Every message is a JSON object with a "type" of metric, heartbeat, reset or dropped.
+// Browsers can't set Last-Event-ID on WebSockets, so lastEventId is taken from the query.
+func (s *Service) GetStreamWS(w http.ResponseWriter, r *http.Request) {
+	if s.Stream == nil {
+		apierr.Error(w, "streaming is disabled", http.StatusNotFound)
+		return
+	}
+	ws := websocket.Server{
+		// dashboards are served from anywhere, the stream is read only
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   func(conn *websocket.Conn) { s.serveWS(conn, r) },
+	}
+	ws.ServeHTTP(w, r)
+}
+
+func (s *Service) serveWS(conn *websocket.Conn, r *http.Request) {
+	defer conn.Close()
+
+	sub, complete := s.subscribe(r)
+	defer s.Stream.Unsubscribe(sub)
+
+	// the client isn't expected to talk, reading only notices it leaving
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		var discard []byte
+		for websocket.Message.Receive(conn, &discard) == nil {
+		}
+	}()
+
+	send := func(msg wsMessage) bool {
+		if err := websocket.JSON.Send(conn, &msg); err != nil {
+			return false
+		}
+		return true
+	}
+	if !complete && !send(wsMessage{Type: "reset"}) {
+		return
+	}
+
+	heartbeat, stop := s.heartbeat()
+	defer stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-heartbeat:
+			if !send(wsMessage{Type: "heartbeat"}) {
+				return
+			}
+		case ev, ok := <-sub.C:
+			if !ok {
+				if sub.Dropped() {
+					send(wsMessage{Type: "dropped"})
+				}
+				return
+			}
+			if !send(wsMessage{Type: "metric", Event: &ev}) {
+				return
+			}
+		}
+	}
+}
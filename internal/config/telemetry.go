@@ -0,0 +1,39 @@
+package config
+
+import (
+	"context"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/telemetry"
+)
+
+// Store file operations reported to telemetry
+const (
+	persistAppend    = "append"
+	persistSnapshot  = "snapshot"
+	persistTombstone = "tombstone"
+)
+
+// EnableTelemetry counts updates and times the store file writes in t
+func (s *Service) EnableTelemetry(t *telemetry.Server) {
+	s.Telemetry = t
+	s.OnUpdate(func(ctx context.Context, u Update) {
+		t.Updates.With(s.Tenant, string(u.New.MType)).Inc()
+	})
+}
+
+// observePersist reports a store file write started at start
+func (s *Service) observePersist(op string, start time.Time, err error) {
+	if s.Telemetry == nil {
+		return
+	}
+	s.Telemetry.PersistDuration.With(s.Tenant, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.Telemetry.PersistErrors.With(s.Tenant, op).Inc()
+	}
+}
+
+// Len returns the number of stored series
+func (s *Service) Len() int {
+	return s.Storage.Len()
+}
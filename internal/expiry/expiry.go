@@ -0,0 +1,94 @@
+package expiry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Override sets the TTL of the metrics whose ID starts with Prefix
+type Override struct {
+	Prefix string
+	TTL    time.Duration
+}
+
+// Policy decides when a series that stopped receiving updates goes away.
+// A series is stale once its TTL has passed and is evicted Grace later.
+// A zero TTL keeps the series forever.
+type Policy struct {
+	TTL       time.Duration
+	Overrides []Override
+	Grace     time.Duration
+}
+
+// State is the liveness of a series
+type State int
+
+const (
+	Live State = iota
+	Stale
+	Expired
+)
+
+// ParseOverrides parses a "prefix=ttl,..." list, e.g. "tmp.=5m,host.=24h"
+func ParseOverrides(s string) ([]Override, error) {
+	var list []Override
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("wrong TTL override %q, want prefix=duration", part)
+		}
+		ttl, err := time.ParseDuration(kv[1])
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("wrong TTL in override %q", part)
+		}
+		list = append(list, Override{Prefix: kv[0], TTL: ttl})
+	}
+	// longest prefix first, so the most specific override wins
+	sort.SliceStable(list, func(i, j int) bool { return len(list[i].Prefix) > len(list[j].Prefix) })
+	return list, nil
+}
+
+// TTLFor returns the TTL of the metric with the given ID
+func (p Policy) TTLFor(id string) time.Duration {
+	for _, o := range p.Overrides {
+		if strings.HasPrefix(id, o.Prefix) {
+			return o.TTL
+		}
+	}
+	return p.TTL
+}
+
+// Enabled reports whether any series can ever expire
+func (p Policy) Enabled() bool {
+	if p.TTL > 0 {
+		return true
+	}
+	for _, o := range p.Overrides {
+		if o.TTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the state as of now of a series last updated at last
+func (p Policy) State(id string, last, now time.Time) State {
+	ttl := p.TTLFor(id)
+	if ttl <= 0 {
+		return Live
+	}
+	age := now.Sub(last)
+	switch {
+	case age <= ttl:
+		return Live
+	case age <= ttl+p.Grace:
+		return Stale
+	}
+	return Expired
+}
@@ -0,0 +1,34 @@
+package expiry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	overrides, err := ParseOverrides("tmp.=1m, tmp.keep.=0s,host.=1h")
+	require.NoError(t, err)
+	p := Policy{TTL: 10 * time.Minute, Overrides: overrides, Grace: 5 * time.Minute}
+	assert.True(t, p.Enabled())
+
+	assert.Equal(t, time.Minute, p.TTLFor("tmp.x"))
+	assert.Equal(t, time.Duration(0), p.TTLFor("tmp.keep.x"))
+	assert.Equal(t, time.Hour, p.TTLFor("host.a"))
+	assert.Equal(t, 10*time.Minute, p.TTLFor("Alloc"))
+
+	now := time.Now()
+	assert.Equal(t, Live, p.State("Alloc", now.Add(-9*time.Minute), now))
+	assert.Equal(t, Stale, p.State("Alloc", now.Add(-12*time.Minute), now))
+	assert.Equal(t, Expired, p.State("Alloc", now.Add(-16*time.Minute), now))
+	assert.Equal(t, Expired, p.State("tmp.x", now.Add(-7*time.Minute), now))
+	assert.Equal(t, Live, p.State("tmp.keep.x", now.Add(-24*time.Hour), now))
+
+	assert.False(t, Policy{}.Enabled())
+	for _, bad := range []string{"tmp.", "=1m", "tmp.=x", "tmp.=-1m"} {
+		_, err := ParseOverrides(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,291 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// HopHeader carries the number of servers an update has already passed through
+const HopHeader = "X-Metric-Hops"
+
+// TenantLabel names the tenant of updates relayed by ObserveTenant
+const TenantLabel = "tenant"
+
+type hopsKey struct{}
+
+// Hops is a middleware that records the hop count of the request in its context.
+// Only updates made under it are considered for forwarding.
+func Hops(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops, _ := strconv.Atoi(r.Header.Get(HopHeader))
+		if hops < 0 {
+			hops = 0
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), hopsKey{}, hops)))
+	})
+}
+
+// HopsFromContext returns the hop count stored by Hops
+func HopsFromContext(ctx context.Context) (int, bool) {
+	hops, ok := ctx.Value(hopsKey{}).(int)
+	return hops, ok
+}
+
+type Config struct {
+	// Upstreams are base URLs of the servers to relay updates to
+	Upstreams []string
+	// Filter holds path.Match patterns of IDs to forward, all IDs if empty
+	Filter []string
+	// Prefix is prepended to forwarded IDs as "<prefix>.<id>"
+	Prefix string
+	// MaxHops is the hop count from which updates are no longer relayed
+	MaxHops       int
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+	RetryCount    int
+}
+
+// Stats are cumulative forwarding counters over all upstreams
+type Stats struct {
+	Sent    int64
+	Dropped int64
+	Failed  int64
+	Queued  int64
+	// Lag is the time the oldest update of the last sent batch spent queued
+	Lag time.Duration
+}
+
+type item struct {
+	m      metric.Metric
+	hops   int
+	queued time.Time
+}
+
+type upstream struct {
+	url    string
+	queue  chan item
+	client *resty.Client
+}
+
+// Forwarder relays accepted updates asynchronously to upstream servers.
+// Each upstream has its own queue, so a slow one doesn't hold back the rest.
+type Forwarder struct {
+	conf      Config
+	upstreams []*upstream
+	wg        sync.WaitGroup
+	done      chan struct{}
+
+	sent, dropped, failed int64
+	lag                   int64
+}
+
+func New(conf Config) *Forwarder {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 100
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = time.Second
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 10000
+	}
+
+	f := &Forwarder{
+		conf: conf,
+		done: make(chan struct{}),
+	}
+	for _, u := range conf.Upstreams {
+		client := resty.New().
+			SetRetryCount(conf.RetryCount).
+			SetRetryWaitTime(100 * time.Millisecond).
+			SetRetryMaxWaitTime(5 * time.Second).
+			AddRetryCondition(func(r *resty.Response, err error) bool {
+				return err != nil || r.StatusCode() >= http.StatusInternalServerError || r.StatusCode() == http.StatusTooManyRequests
+			})
+		up := &upstream{
+			url:    u + "/updates/",
+			queue:  make(chan item, conf.QueueSize),
+			client: client,
+		}
+		f.upstreams = append(f.upstreams, up)
+		f.wg.Add(1)
+		go f.run(up)
+	}
+	return f
+}
+
+// Observe is a config.UpdateHook queueing the update for every upstream
+func (f *Forwarder) Observe(ctx context.Context, u config.Update) {
+	f.observe(ctx, u, "")
+}
+
+// ObserveTenant returns the hook of a tenant's service. Its updates are
+// labeled tenant=<name>, so tenants sharing IDs stay apart upstream.
+func (f *Forwarder) ObserveTenant(name string) config.UpdateHook {
+	return func(ctx context.Context, u config.Update) {
+		f.observe(ctx, u, name)
+	}
+}
+
+func (f *Forwarder) observe(ctx context.Context, u config.Update, tenant string) {
+	hops, ok := HopsFromContext(ctx)
+	if !ok || hops >= f.conf.MaxHops || !f.match(u.New.ID) {
+		return
+	}
+
+	m := u.New
+	if m.MType == metric.MetricTypeCounter && u.Existed && u.Old.MType == metric.MetricTypeCounter {
+		// relay the increment, not the running total
+		m.Delta -= u.Old.Delta
+		// a reset has nothing to relay, upstream keeps its total
+		if m.Delta < 0 {
+			return
+		}
+	}
+	if f.conf.Prefix != "" {
+		m.ID = f.conf.Prefix + "." + m.ID
+	}
+	if tenant != "" {
+		// the label is set by the server, a tenant can't pass for another
+		labels := make(metric.Labels, len(m.Labels)+1)
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		labels[TenantLabel] = tenant
+		m.Labels = labels
+	}
+
+	it := item{m: m, hops: hops, queued: time.Now()}
+	for _, up := range f.upstreams {
+		select {
+		case up.queue <- it:
+		default:
+			atomic.AddInt64(&f.dropped, 1)
+		}
+	}
+}
+
+func (f *Forwarder) match(id string) bool {
+	if len(f.conf.Filter) == 0 {
+		return true
+	}
+	for _, p := range f.conf.Filter {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Forwarder) run(up *upstream) {
+	defer f.wg.Done()
+
+	tck := time.NewTicker(f.conf.FlushInterval)
+	defer tck.Stop()
+
+	batch := make([]item, 0, f.conf.BatchSize)
+	for {
+		select {
+		case it := <-up.queue:
+			batch = append(batch, it)
+			if len(batch) >= f.conf.BatchSize {
+				f.send(up, batch)
+				batch = batch[:0]
+			}
+		case <-tck.C:
+			if len(batch) > 0 {
+				f.send(up, batch)
+				batch = batch[:0]
+			}
+		case <-f.done:
+			// drain what is already queued
+			for {
+				select {
+				case it := <-up.queue:
+					batch = append(batch, it)
+					if len(batch) >= f.conf.BatchSize {
+						f.send(up, batch)
+						batch = batch[:0]
+					}
+				default:
+					if len(batch) > 0 {
+						f.send(up, batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (f *Forwarder) send(up *upstream, batch []item) {
+	metrics := make([]metric.Metric, len(batch))
+	hops := 0
+	oldest := batch[0].queued
+	for i, it := range batch {
+		metrics[i] = it.m
+		if it.hops > hops {
+			hops = it.hops
+		}
+		if it.queued.Before(oldest) {
+			oldest = it.queued
+		}
+	}
+
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		log.Printf("unable to marshal forwarded batch: %s", err)
+		atomic.AddInt64(&f.failed, int64(len(batch)))
+		return
+	}
+
+	resp, err := up.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader(HopHeader, strconv.Itoa(hops+1)).
+		SetBody(body).
+		Post(up.url)
+	if err == nil && resp.StatusCode() != http.StatusOK {
+		err = fmt.Errorf("status code [%d]: %s", resp.StatusCode(), string(resp.Body()))
+	}
+	if err != nil {
+		log.Printf("unable to forward %d metrics to %s: %s", len(batch), up.url, err)
+		atomic.AddInt64(&f.failed, int64(len(batch)))
+		return
+	}
+
+	atomic.AddInt64(&f.sent, int64(len(batch)))
+	atomic.StoreInt64(&f.lag, int64(time.Since(oldest)))
+}
+
+// Stats returns a snapshot of the forwarding counters
+func (f *Forwarder) Stats() Stats {
+	st := Stats{
+		Sent:    atomic.LoadInt64(&f.sent),
+		Dropped: atomic.LoadInt64(&f.dropped),
+		Failed:  atomic.LoadInt64(&f.failed),
+		Lag:     time.Duration(atomic.LoadInt64(&f.lag)),
+	}
+	for _, up := range f.upstreams {
+		st.Queued += int64(len(up.queue))
+	}
+	return st
+}
+
+// Close stops accepting updates and flushes the queues
+func (f *Forwarder) Close() {
+	close(f.done)
+	f.wg.Wait()
+}
@@ -0,0 +1,86 @@
+package forward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwarder(t *testing.T) {
+	var mu sync.Mutex
+	var received []metric.Metric
+	var hops []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/updates/", r.URL.Path)
+		var batch []metric.Metric
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		mu.Lock()
+		received = append(received, batch...)
+		hops = append(hops, r.Header.Get(HopHeader))
+		mu.Unlock()
+	}))
+	defer upstream.Close()
+
+	fwd := New(Config{
+		Upstreams:     []string{upstream.URL},
+		Filter:        []string{"Heap*", "PollCount"},
+		Prefix:        "dc1",
+		MaxHops:       1,
+		FlushInterval: 10 * time.Millisecond,
+	})
+
+	srv := config.NewService(&config.ConfigServer{StoreInterval: time.Second})
+	srv.OnUpdate(fwd.Observe)
+
+	// another tenant's updates are labeled with its name
+	team := config.NewService(&config.ConfigServer{StoreInterval: time.Second})
+	team.OnUpdate(fwd.ObserveTenant("team-a"))
+
+	router := Hops(http.HandlerFunc(srv.PostHandlerMetricsBatchJSON))
+	teamRouter := Hops(http.HandlerFunc(team.PostHandlerMetricsBatchJSON))
+	post := func(body string, hop string) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+		if hop != "" {
+			req.Header.Set(HopHeader, hop)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	post(`[{"id":"PollCount","type":"counter","delta":5},{"id":"Alloc","type":"gauge","value":1}]`, "")
+	post(`[{"id":"PollCount","type":"counter","delta":2},{"id":"HeapInuse","type":"gauge","value":7}]`, "")
+	// already relayed once, must not travel further
+	post(`[{"id":"HeapSys","type":"gauge","value":3}]`, "1")
+	w := httptest.NewRecorder()
+	teamRouter.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id":"HeapInuse","type":"gauge","value":9,"labels":{"tenant":"team-b"}}]`)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	fwd.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []metric.Metric{
+		{ID: "dc1.PollCount", MType: metric.MetricTypeCounter, Delta: 5},
+		{ID: "dc1.PollCount", MType: metric.MetricTypeCounter, Delta: 2},
+		{ID: "dc1.HeapInuse", MType: metric.MetricTypeGauge, Value: 7},
+		{ID: "dc1.HeapInuse", MType: metric.MetricTypeGauge, Value: 9, Labels: metric.Labels{"tenant": "team-a"}},
+	}, received)
+	for _, h := range hops {
+		assert.Equal(t, "1", h)
+	}
+
+	st := fwd.Stats()
+	assert.Equal(t, int64(4), st.Sent)
+	assert.Equal(t, int64(0), st.Dropped)
+}
@@ -75,6 +75,27 @@ func (s *saver) WriteMetric(savedMetric metric.Metric) error {
 	}
 	return s.writer.Flush()
 }
+
+// WriteTombstone records that m was deleted, restoring drops every earlier line of it
+func (s *saver) WriteTombstone(deleted metric.Metric) error {
+	data, err := json.Marshal(&struct {
+		ID      string            `json:"id"`
+		MType   metric.MetricType `json:"type"`
+		Labels  metric.Labels     `json:"labels,omitempty"`
+		Deleted bool              `json:"deleted"`
+	}{deleted.ID, deleted.MType, deleted.Labels, true})
+	if err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(data); err != nil {
+		return err
+	}
+	if err := s.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
 func (s *saver) StoreMetrics(storage *map[string]metric.Metric) error {
 	data, err := json.Marshal(&storage)
 	if err != nil {
@@ -100,9 +121,38 @@ func (r *restorer) RestoreMetrics() (map[string]metric.Metric, error) {
 		if err != nil {
 			return nil, err
 		}
-		store[item.ID] = item
+		var mark struct {
+			Deleted bool `json:"deleted"`
+		}
+		if err := json.Unmarshal(data, &mark); err == nil && mark.Deleted {
+			delete(store, item.Key())
+			continue
+		}
+		store[item.Key()] = item
 
 	}
 
 	return store, nil
 }
+
+// Rewrite replaces the file with one line per metric, dropping every
+// superseded or evicted entry. The file is written aside and renamed,
+// so a crash never leaves it truncated.
+func Rewrite(fileName string, metrics []metric.Metric) error {
+	tmp := fileName + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	s := &saver{file: file, writer: bufio.NewWriter(file)}
+	for _, m := range metrics {
+		if err := s.WriteMetric(m); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
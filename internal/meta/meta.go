@@ -0,0 +1,166 @@
+package meta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+var (
+	ErrTypeConflict = errors.New("metric type conflicts with the registered type")
+	ErrInvalid      = errors.New("metadata needs an id and a gauge or counter type")
+)
+
+// Meta describes a metric name, shared by all its label sets
+type Meta struct {
+	ID   string            `json:"id"`
+	Type metric.MetricType `json:"type"`
+	Unit string            `json:"unit,omitempty"`
+	Help string            `json:"help,omitempty"`
+}
+
+// Registry locks the type of every metric name and keeps its unit and help.
+// With a path it is saved to a JSON file on every change.
+type Registry struct {
+	mu   sync.RWMutex
+	path string
+	byID map[string]Meta
+}
+
+func NewRegistry() *Registry {
+	return &Registry{byID: make(map[string]Meta)}
+}
+
+// Load reads the registry file, a missing file starts empty
+func Load(path string) (*Registry, error) {
+	reg := NewRegistry()
+	reg.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Meta
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	for _, m := range list {
+		reg.byID[m.ID] = m
+	}
+	return reg, nil
+}
+
+func (reg *Registry) save() error {
+	if reg.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(reg.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := reg.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, reg.path)
+}
+
+// Register declares a metric explicitly. The type of a known metric can't
+// change, a non-empty unit or help replaces the registered one.
+func (reg *Registry) Register(m Meta) (Meta, error) {
+	if m.ID == "" || (m.Type != metric.MetricTypeGauge && m.Type != metric.MetricTypeCounter) {
+		return Meta{}, ErrInvalid
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	old, ok := reg.byID[m.ID]
+	if ok {
+		if old.Type != m.Type {
+			return old, ErrTypeConflict
+		}
+		if m.Unit == "" {
+			m.Unit = old.Unit
+		}
+		if m.Help == "" {
+			m.Help = old.Help
+		}
+		if m == old {
+			return m, nil
+		}
+	}
+	reg.byID[m.ID] = m
+	return m, reg.save()
+}
+
+// Observe checks a write against the registry, registering the metric on
+// its first write. Unit and help only fill in what isn't registered yet.
+func (reg *Registry) Observe(id string, typ metric.MetricType, unit, help string) error {
+	reg.mu.RLock()
+	old, ok := reg.byID[id]
+	reg.mu.RUnlock()
+	if ok && old.Type != typ {
+		return ErrTypeConflict
+	}
+	if ok && (unit == "" || old.Unit != "") && (help == "" || old.Help != "") {
+		return nil
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	old, ok = reg.byID[id]
+	if ok && old.Type != typ {
+		return ErrTypeConflict
+	}
+	m := Meta{ID: id, Type: typ, Unit: old.Unit, Help: old.Help}
+	if m.Unit == "" {
+		m.Unit = unit
+	}
+	if m.Help == "" {
+		m.Help = help
+	}
+	reg.byID[id] = m
+	return reg.save()
+}
+
+// Delete forgets a metric name
+func (reg *Registry) Delete(id string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.byID[id]; !ok {
+		return nil
+	}
+	delete(reg.byID, id)
+	return reg.save()
+}
+
+// Get returns the metadata of a metric name
+func (reg *Registry) Get(id string) (Meta, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	m, ok := reg.byID[id]
+	return m, ok
+}
+
+// List returns the metadata ordered by ID
+func (reg *Registry) List() []Meta {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.list()
+}
+
+func (reg *Registry) list() []Meta {
+	list := make([]Meta, 0, len(reg.byID))
+	for _, m := range reg.byID {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,40 @@
+package meta
+
+import (
+	"path/filepath"
+	"testing"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta.json")
+	reg, err := Load(path)
+	require.NoError(t, err)
+
+	// implicit registration on the first write
+	require.NoError(t, reg.Observe("Alloc", metric.MetricTypeGauge, "", ""))
+	assert.Equal(t, ErrTypeConflict, reg.Observe("Alloc", metric.MetricTypeCounter, "", ""))
+	require.NoError(t, reg.Observe("Alloc", metric.MetricTypeGauge, "bytes", ""))
+
+	m, err := reg.Register(Meta{ID: "Alloc", Type: metric.MetricTypeGauge, Help: "Allocated heap"})
+	require.NoError(t, err)
+	assert.Equal(t, Meta{ID: "Alloc", Type: metric.MetricTypeGauge, Unit: "bytes", Help: "Allocated heap"}, m)
+
+	_, err = reg.Register(Meta{ID: "Alloc", Type: metric.MetricTypeCounter})
+	assert.Equal(t, ErrTypeConflict, err)
+	_, err = reg.Register(Meta{ID: "PollCount"})
+	assert.Equal(t, ErrInvalid, err)
+
+	// a later unit doesn't replace the registered one on writes
+	require.NoError(t, reg.Observe("Alloc", metric.MetricTypeGauge, "kB", ""))
+
+	reg, err = Load(path)
+	require.NoError(t, err)
+	got, ok := reg.Get("Alloc")
+	require.True(t, ok)
+	assert.Equal(t, m, got)
+	assert.Len(t, reg.List(), 1)
+}
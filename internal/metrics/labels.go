@@ -0,0 +1,41 @@
+package metric
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels is a set of name/value pairs that distinguishes series sharing an ID
+type Labels map[string]string
+
+// String renders labels in a stable {a="1",b="2"} form
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for k := range l {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Key returns the storage key of the metric.
+// Unlabeled metrics are keyed by ID alone, so existing clients are unaffected.
+func (m Metric) Key() string {
+	return m.ID + m.Labels.String()
+}
@@ -4,9 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
-	"math/rand"
 	"net/http"
-	"runtime"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
@@ -18,6 +16,8 @@ var (
 	ErrMissmatchedType = errors.New("missmatched type")
 	ErrDeltaAssign     = errors.New("type insn't a int64")
 	ErrValueAssign     = errors.New("type insn't a float64")
+	ErrMissingType     = errors.New("metric type is missing")
+	ErrUnknownType     = errors.New("unknown metric type")
 )
 
 const (
@@ -33,19 +33,26 @@ const (
 )
 
 type Metric struct {
-	ID    string     `json:"id"`
-	MType MetricType `json:"type"`
-	Delta int64      `json:"delta,omitempty"`
-	Value float64    `json:"value,omitempty"`
+	ID     string     `json:"id"`
+	MType  MetricType `json:"type"`
+	Delta  int64      `json:"delta,omitempty"`
+	Value  float64    `json:"value,omitempty"`
+	Labels Labels     `json:"labels,omitempty"`
+	// Unit and Help declare metadata on a write and describe the metric on reads
+	Unit string `json:"unit,omitempty"`
+	Help string `json:"help,omitempty"`
 }
 
 func (m Metric) MarshalJSON() (data []byte, err error) {
 
 	MetricJSON := &struct {
-		ID    string     `json:"id"`
-		Mtype MetricType `json:"type"`
-		Delta *int64     `json:"delta,omitempty"`
-		Value *float64   `json:"value,omitempty"`
+		ID     string     `json:"id"`
+		Mtype  MetricType `json:"type"`
+		Delta  *int64     `json:"delta,omitempty"`
+		Value  *float64   `json:"value,omitempty"`
+		Labels Labels     `json:"labels,omitempty"`
+		Unit   string     `json:"unit,omitempty"`
+		Help   string     `json:"help,omitempty"`
 	}{}
 
 	switch {
@@ -54,6 +61,9 @@ func (m Metric) MarshalJSON() (data []byte, err error) {
 
 		MetricJSON.ID = m.ID
 		MetricJSON.Mtype = m.MType
+		MetricJSON.Labels = m.Labels
+		MetricJSON.Unit = m.Unit
+		MetricJSON.Help = m.Help
 		MetricJSON.Delta = &m.Delta
 		MetricJSON.Value = nil
 
@@ -65,6 +75,9 @@ func (m Metric) MarshalJSON() (data []byte, err error) {
 
 		MetricJSON.ID = m.ID
 		MetricJSON.Mtype = m.MType
+		MetricJSON.Labels = m.Labels
+		MetricJSON.Unit = m.Unit
+		MetricJSON.Help = m.Help
 		MetricJSON.Delta = nil
 		MetricJSON.Value = &m.Value
 
@@ -78,52 +91,44 @@ func (m Metric) MarshalJSON() (data []byte, err error) {
 }
 
 func (m *Metric) UnmarshalJSON(data []byte) error {
-	var v map[string]interface{}
+	MetricJSON := &struct {
+		ID     string     `json:"id"`
+		Mtype  MetricType `json:"type"`
+		Delta  *int64     `json:"delta,omitempty"`
+		Value  *float64   `json:"value,omitempty"`
+		Labels Labels     `json:"labels,omitempty"`
+		Unit   string     `json:"unit,omitempty"`
+		Help   string     `json:"help,omitempty"`
+	}{}
 
-	if err := json.Unmarshal(data, &v); err != nil {
+	if err := json.Unmarshal(data, &MetricJSON); err != nil {
 		log.Printf("error during UnamarshalJSON %s", err)
 		return err
 	}
 
-	MetricJSON := &struct {
-		ID    string     `json:"id"`
-		Mtype MetricType `json:"type"`
-		Delta *int64     `json:"delta,omitempty"`
-		Value *float64   `json:"value,omitempty"`
-	}{}
-
-	switch {
-	case v["type"].(string) == string(MetricTypeCounter):
-
-		if err := json.Unmarshal(data, &MetricJSON); err != nil {
-			return err
-		}
-
-		m.ID = MetricJSON.ID
-		m.MType = MetricJSON.Mtype
+	switch MetricJSON.Mtype {
+	case MetricTypeCounter:
 		if MetricJSON.Delta != nil {
 			m.Delta = *MetricJSON.Delta
 		}
-	case v["type"].(string) == string(MetricTypeGauge):
-		if err := json.Unmarshal(data, &MetricJSON); err != nil {
-			return err
-		}
-		m.ID = MetricJSON.ID
-		m.MType = MetricJSON.Mtype
+	case MetricTypeGauge:
 		if MetricJSON.Value != nil {
 			m.Value = *MetricJSON.Value
 		}
-
+	case "":
+		return ErrMissingType
+	default:
+		return ErrUnknownType
 	}
+	m.ID = MetricJSON.ID
+	m.MType = MetricJSON.Mtype
+	m.Labels = MetricJSON.Labels
+	m.Unit = MetricJSON.Unit
+	m.Help = MetricJSON.Help
 
 	return nil
 }
 
-type AgentStorage struct {
-	Stats runtime.MemStats
-	Data  map[string]Metric
-}
-
 func ParseMetricEntityFromURL(r *http.Request) (Metric, error) {
 	m := Metric{}
 	if m.ID = chi.URLParam(r, queryKeyMetricID); m.ID == "" {
@@ -156,149 +161,3 @@ func ParseMetricEntityFromURL(r *http.Request) (Metric, error) {
 
 	return m, nil
 }
-
-func (as *AgentStorage) PopulateMetricStruct() {
-
-	runtime.ReadMemStats(&as.Stats)
-	as.Data["Alloc"] = Metric{
-		ID:    "Alloc",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.Alloc),
-	}
-	as.Data["BuckHashSys"] = Metric{
-		ID:    "BuckHashSys",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.BuckHashSys),
-	}
-	as.Data["GCSys"] = Metric{
-		ID:    "GCSys",
-		MType: MetricTypeCounter,
-		Value: float64(as.Stats.GCSys),
-	}
-	as.Data["GCCPUFraction"] = Metric{
-		ID:    "GCCPUFraction",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.GCCPUFraction),
-	}
-	as.Data["Frees"] = Metric{
-		ID:    "Frees",
-		MType: MetricTypeCounter,
-		Value: float64(as.Stats.Frees),
-	}
-	as.Data["HeapAlloc"] = Metric{
-		ID:    "HeapAlloc",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.HeapAlloc),
-	}
-	as.Data["HeapIdle"] = Metric{
-		ID:    "HeapIdle",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.HeapIdle),
-	}
-	as.Data["HeapInuse"] = Metric{
-		ID:    "HeapInuse",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.HeapInuse),
-	}
-	as.Data["HeapObjects"] = Metric{
-		ID:    "HeapObjects",
-		MType: MetricTypeCounter,
-		Value: float64(as.Stats.HeapObjects),
-	}
-	as.Data["HeapReleased"] = Metric{
-		ID:    "HeapReleased",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.HeapReleased),
-	}
-	as.Data["HeapSys"] = Metric{
-		ID:    "HeapSys",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.HeapSys),
-	}
-	as.Data["LastGC"] = Metric{
-		ID:    "LastGC",
-		MType: MetricTypeCounter,
-		Value: float64(as.Stats.LastGC),
-	}
-	as.Data["Lookups"] = Metric{
-		ID:    "Lookups",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.Lookups),
-	}
-	as.Data["MCacheInuse"] = Metric{
-		ID:    "MCacheInuse",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.MCacheInuse),
-	}
-	as.Data["MCacheSys"] = Metric{
-		ID:    "MCacheSys",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.MCacheSys),
-	}
-	as.Data["MSpanInuse"] = Metric{
-		ID:    "MSpanInuse",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.MSpanInuse),
-	}
-	as.Data["MSpanSys"] = Metric{
-		ID:    "MSpanSys",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.MSpanSys),
-	}
-	as.Data["Mallocs"] = Metric{
-		ID:    "Mallocs",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.Mallocs),
-	}
-	as.Data["NextGC"] = Metric{
-		ID:    "NextGC",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.NextGC),
-	}
-	as.Data["NumForcedGC"] = Metric{
-		ID:    "NumForcedGC",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.NumForcedGC),
-	}
-	as.Data["NumGC"] = Metric{
-		ID:    "NumGC",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.NumGC),
-	}
-	as.Data["OtherSys"] = Metric{
-		ID:    "OtherSys",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.OtherSys),
-	}
-	as.Data["PauseTotalNs"] = Metric{
-		ID:    "PauseTotalNs",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.PauseTotalNs),
-	}
-	as.Data["StackInuse"] = Metric{
-		ID:    "StackInuse",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.StackInuse),
-	}
-	as.Data["StackSys"] = Metric{
-		ID:    "StackSys",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.StackSys),
-	}
-	as.Data["Sys"] = Metric{
-		ID:    "Sys",
-		MType: MetricTypeGauge,
-		Value: float64(as.Stats.Sys),
-	}
-	as.Data["PollCount"] = Metric{
-		ID:    "PollCount",
-		MType: MetricTypeCounter,
-		Delta: 0,
-	}
-	as.Data["RandomValue"] = Metric{
-		ID:    "RandomValue",
-		MType: MetricTypeGauge,
-		Value: rand.Float64(),
-	}
-
-}
@@ -0,0 +1,18 @@
+package metric
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshalJSON(t *testing.T) {
+	m := Metric{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"id":"Alloc","type":"gauge","value":1.5,"unit":"bytes"}`), &m))
+	assert.Equal(t, Metric{ID: "Alloc", MType: MetricTypeGauge, Value: 1.5, Unit: "bytes"}, m)
+
+	assert.Equal(t, ErrMissingType, json.Unmarshal([]byte(`{"id":"Alloc"}`), &m))
+	assert.Equal(t, ErrUnknownType, json.Unmarshal([]byte(`{"id":"Alloc","type":"summary"}`), &m))
+	assert.Error(t, json.Unmarshal([]byte(`{"id":"Alloc","type":5}`), &m))
+}
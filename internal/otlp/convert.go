@@ -0,0 +1,225 @@
+package otlp
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// labelScopeName carries the instrumentation scope name of a point
+const labelScopeName = "otel.scope.name"
+
+// Options controls how OTLP points are mapped onto server metrics
+type Options struct {
+	// IDPrefixAttribute names a resource attribute, e.g. "service.name",
+	// whose value is prepended to every metric ID as "<value>.<name>".
+	// Resources without the attribute keep the bare metric name.
+	IDPrefixAttribute string
+}
+
+// Point is a single OTLP data point translated into the server's model
+type Point struct {
+	Metric metric.Metric
+	// Cumulative reports that a counter carries a running total
+	// rather than an increment since the previous export.
+	Cumulative bool
+}
+
+// Result holds the translated points and the rejected ones
+type Result struct {
+	Points   []Point
+	Rejected int64
+	Errors   []string
+}
+
+// Message joins the distinct rejection reasons for a partial-success response
+func (r Result) Message() string {
+	seen := make(map[string]bool)
+	var msgs []string
+	for _, e := range r.Errors {
+		if !seen[e] {
+			seen[e] = true
+			msgs = append(msgs, e)
+		}
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, "; ")
+}
+
+func (r *Result) reject(n int, format string, args ...interface{}) {
+	if n == 0 {
+		return
+	}
+	r.Rejected += int64(n)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Convert maps gauges onto gauges and sums of either temporality onto
+// counters. Resource, scope and point attributes become metric labels.
+// Histograms, summaries and points that don't fit the int64 counter
+// model are rejected and reported in the result.
+func Convert(req *ExportMetricsServiceRequest, opts Options) Result {
+	res := Result{}
+	for _, rm := range req.ResourceMetrics {
+		resLabels := attributes(nil, rm.Resource.Attributes)
+		prefix := ""
+		if opts.IDPrefixAttribute != "" {
+			prefix = resLabels[opts.IDPrefixAttribute]
+		}
+
+		scopes := rm.ScopeMetrics
+		if len(scopes) == 0 {
+			scopes = rm.InstrumentationLibraryMetrics
+		}
+		for _, sm := range scopes {
+			scope := sm.Scope
+			if scope.Name == "" && len(scope.Attributes) == 0 {
+				scope = sm.InstrumentationLibrary
+			}
+			scopeLabels := attributes(resLabels, scope.Attributes)
+			if scope.Name != "" {
+				scopeLabels[labelScopeName] = scope.Name
+			}
+			for _, m := range sm.Metrics {
+				res.convertMetric(m, prefix, scopeLabels)
+			}
+		}
+	}
+	return res
+}
+
+func (r *Result) convertMetric(m Metric, prefix string, base metric.Labels) {
+	id := m.Name
+	if prefix != "" {
+		id = prefix + "." + m.Name
+	}
+
+	switch {
+	case m.Histogram != nil:
+		r.reject(len(m.Histogram.DataPoints), "%s: histogram data points are not supported", m.Name)
+		return
+	case m.ExponentialHistogram != nil:
+		r.reject(len(m.ExponentialHistogram.DataPoints), "%s: exponential histogram data points are not supported", m.Name)
+		return
+	case m.Summary != nil:
+		r.reject(len(m.Summary.DataPoints), "%s: summary data points are not supported", m.Name)
+		return
+	}
+
+	if m.Name == "" {
+		n := 0
+		if m.Gauge != nil {
+			n += len(m.Gauge.DataPoints)
+		}
+		if m.Sum != nil {
+			n += len(m.Sum.DataPoints)
+		}
+		r.reject(n, "metric without a name")
+		return
+	}
+
+	if m.Gauge != nil {
+		for _, dp := range m.Gauge.DataPoints {
+			if dp.Flags&flagNoRecordedValue != 0 {
+				continue
+			}
+			v, ok := dp.float()
+			if !ok {
+				r.reject(1, "%s: gauge data point without a finite value", m.Name)
+				continue
+			}
+			r.Points = append(r.Points, Point{Metric: metric.Metric{
+				ID:     id,
+				MType:  metric.MetricTypeGauge,
+				Value:  v,
+				Labels: labels(base, dp.Attributes),
+				Unit:   m.Unit,
+				Help:   m.Description,
+			}})
+		}
+	}
+
+	if m.Sum != nil {
+		cumulative := false
+		switch m.Sum.AggregationTemporality {
+		case TemporalityCumulative:
+			cumulative = true
+		case TemporalityDelta:
+		default:
+			r.reject(len(m.Sum.DataPoints), "%s: sum without aggregation temporality", m.Name)
+			return
+		}
+		for _, dp := range m.Sum.DataPoints {
+			if dp.Flags&flagNoRecordedValue != 0 {
+				continue
+			}
+			v, ok := dp.int()
+			if !ok {
+				r.reject(1, "%s: sum data point is not an int64 value", m.Name)
+				continue
+			}
+			r.Points = append(r.Points, Point{
+				Metric: metric.Metric{
+					ID:     id,
+					MType:  metric.MetricTypeCounter,
+					Delta:  v,
+					Labels: labels(base, dp.Attributes),
+					Unit:   m.Unit,
+					Help:   m.Description,
+				},
+				Cumulative: cumulative,
+			})
+		}
+	}
+}
+
+func (dp NumberDataPoint) float() (float64, bool) {
+	switch {
+	case dp.AsInt != nil:
+		return float64(*dp.AsInt), true
+	case dp.AsDouble != nil:
+		v := float64(*dp.AsDouble)
+		return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+	}
+	return 0, false
+}
+
+// int accepts double values only when they hold a whole number
+func (dp NumberDataPoint) int() (int64, bool) {
+	switch {
+	case dp.AsInt != nil:
+		return int64(*dp.AsInt), true
+	case dp.AsDouble != nil:
+		v := float64(*dp.AsDouble)
+		if v != math.Trunc(v) || v >= math.MaxInt64 || v < math.MinInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// attributes copies base and adds kvs on top of it
+func attributes(base metric.Labels, kvs []KeyValue) metric.Labels {
+	l := make(metric.Labels, len(base)+len(kvs))
+	for k, v := range base {
+		l[k] = v
+	}
+	for _, kv := range kvs {
+		if kv.Key != "" {
+			l[kv.Key] = kv.Value.String()
+		}
+	}
+	return l
+}
+
+func labels(base metric.Labels, kvs []KeyValue) metric.Labels {
+	l := attributes(base, kvs)
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
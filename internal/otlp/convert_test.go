@@ -0,0 +1,69 @@
+package otlp
+
+import (
+	"encoding/json"
+	"testing"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPayload = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "checkout"}}]},
+    "scopeMetrics": [{
+      "scope": {"name": "app"},
+      "metrics": [
+        {"name": "requests", "sum": {"aggregationTemporality": 2, "isMonotonic": true,
+          "dataPoints": [{"asInt": "42", "attributes": [{"key": "method", "value": {"stringValue": "GET"}}]}]}},
+        {"name": "errors", "sum": {"aggregationTemporality": "AGGREGATION_TEMPORALITY_DELTA",
+          "dataPoints": [{"asInt": 3}, {"asDouble": 0.5}, {"asDouble": 9223372036854775807}]}},
+        {"name": "heap", "gauge": {"dataPoints": [{"asDouble": 12.5}, {"asDouble": "NaN"}]}},
+        {"name": "latency", "histogram": {"dataPoints": [{}, {}]}}
+      ]
+    }]
+  }]
+}`
+
+func TestConvert(t *testing.T) {
+	req := ExportMetricsServiceRequest{}
+	require.NoError(t, json.Unmarshal([]byte(testPayload), &req))
+
+	res := Convert(&req, Options{IDPrefixAttribute: "service.name"})
+
+	require.Len(t, res.Points, 3)
+	assert.Equal(t, Point{
+		Metric: metric.Metric{
+			ID:    "checkout.requests",
+			MType: metric.MetricTypeCounter,
+			Delta: 42,
+			Labels: metric.Labels{
+				"service.name":    "checkout",
+				"otel.scope.name": "app",
+				"method":          "GET",
+			},
+		},
+		Cumulative: true,
+	}, res.Points[0])
+
+	assert.Equal(t, "checkout.errors", res.Points[1].Metric.ID)
+	assert.Equal(t, int64(3), res.Points[1].Metric.Delta)
+	assert.False(t, res.Points[1].Cumulative)
+
+	assert.Equal(t, metric.MetricTypeGauge, res.Points[2].Metric.MType)
+	assert.Equal(t, 12.5, res.Points[2].Metric.Value)
+
+	// 0.5 and 2^63 deltas, NaN gauge and two histogram points
+	assert.Equal(t, int64(5), res.Rejected)
+	assert.Contains(t, res.Message(), "latency: histogram data points are not supported")
+}
+
+func TestConvertWithoutPrefix(t *testing.T) {
+	req := ExportMetricsServiceRequest{}
+	require.NoError(t, json.Unmarshal([]byte(testPayload), &req))
+
+	res := Convert(&req, Options{})
+	assert.Equal(t, "requests", res.Points[0].Metric.ID)
+	assert.Equal(t, `requests{method="GET",otel.scope.name="app",service.name="checkout"}`, res.Points[0].Metric.Key())
+}
@@ -0,0 +1,211 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ExportMetricsServiceRequest mirrors the OTLP/HTTP JSON encoding of
+// opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest.
+// Only the fields the server understands are decoded.
+type ExportMetricsServiceRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+	// InstrumentationLibraryMetrics is the pre-1.0 name of ScopeMetrics,
+	// still sent by older SDKs.
+	InstrumentationLibraryMetrics []ScopeMetrics `json:"instrumentationLibraryMetrics"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type ScopeMetrics struct {
+	Scope                  Scope    `json:"scope"`
+	InstrumentationLibrary Scope    `json:"instrumentationLibrary"`
+	Metrics                []Metric `json:"metrics"`
+}
+
+type Scope struct {
+	Name       string     `json:"name"`
+	Version    string     `json:"version"`
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type Metric struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Unit        string `json:"unit"`
+
+	Gauge *Gauge `json:"gauge"`
+	Sum   *Sum   `json:"sum"`
+
+	// Data types the server can't store, decoded only to count their points
+	Histogram            *unsupported `json:"histogram"`
+	ExponentialHistogram *unsupported `json:"exponentialHistogram"`
+	Summary              *unsupported `json:"summary"`
+}
+
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+type Sum struct {
+	DataPoints             []NumberDataPoint `json:"dataPoints"`
+	AggregationTemporality Temporality       `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type unsupported struct {
+	DataPoints []json.RawMessage `json:"dataPoints"`
+}
+
+type NumberDataPoint struct {
+	Attributes   []KeyValue `json:"attributes"`
+	TimeUnixNano Int64      `json:"timeUnixNano"`
+	AsDouble     *Double    `json:"asDouble"`
+	AsInt        *Int64     `json:"asInt"`
+	Flags        uint32     `json:"flags"`
+}
+
+// flagNoRecordedValue marks a point that only signals staleness
+const flagNoRecordedValue = 1
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+type AnyValue struct {
+	StringValue *string          `json:"stringValue"`
+	BoolValue   *bool            `json:"boolValue"`
+	IntValue    *Int64           `json:"intValue"`
+	DoubleValue *Double          `json:"doubleValue"`
+	ArrayValue  *json.RawMessage `json:"arrayValue"`
+	KvlistValue *json.RawMessage `json:"kvlistValue"`
+	BytesValue  *string          `json:"bytesValue"`
+}
+
+// String flattens the value into a label value.
+// Arrays and key/value lists are kept as their compact JSON text.
+func (v AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'g', -1, 64)
+	case v.ArrayValue != nil:
+		return compact(*v.ArrayValue)
+	case v.KvlistValue != nil:
+		return compact(*v.KvlistValue)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	}
+	return ""
+}
+
+func compact(raw json.RawMessage) string {
+	var b bytes.Buffer
+	if err := json.Compact(&b, raw); err != nil {
+		return string(raw)
+	}
+	return b.String()
+}
+
+// Temporality is AggregationTemporality, accepted both as the enum number
+// and as the enum name, as the protobuf JSON mapping allows.
+type Temporality int
+
+const (
+	TemporalityUnspecified Temporality = 0
+	TemporalityDelta       Temporality = 1
+	TemporalityCumulative  Temporality = 2
+)
+
+func (t *Temporality) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var n int
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid aggregationTemporality %s", data)
+		}
+		*t = Temporality(n)
+		return nil
+	}
+	switch name {
+	case "AGGREGATION_TEMPORALITY_DELTA":
+		*t = TemporalityDelta
+	case "AGGREGATION_TEMPORALITY_CUMULATIVE":
+		*t = TemporalityCumulative
+	case "AGGREGATION_TEMPORALITY_UNSPECIFIED":
+		*t = TemporalityUnspecified
+	default:
+		return fmt.Errorf("invalid aggregationTemporality %q", name)
+	}
+	return nil
+}
+
+// Int64 accepts both JSON numbers and decimal strings;
+// the protobuf JSON mapping encodes 64-bit integers as strings.
+type Int64 int64
+
+func (i *Int64) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid int64 %s", data)
+	}
+	*i = Int64(n)
+	return nil
+}
+
+// Double accepts JSON numbers as well as the "NaN", "Infinity" and
+// "-Infinity" strings of the protobuf JSON mapping.
+type Double float64
+
+func (d *Double) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	switch s {
+	case "NaN":
+		*d = Double(math.NaN())
+		return nil
+	case "Infinity":
+		*d = Double(math.Inf(1))
+		return nil
+	case "-Infinity":
+		*d = Double(math.Inf(-1))
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid double %s", data)
+	}
+	*d = Double(f)
+	return nil
+}
+
+// ExportMetricsServiceResponse is returned for every accepted request.
+// PartialSuccess is set only when some data points were rejected.
+type ExportMetricsServiceResponse struct {
+	PartialSuccess *ExportMetricsPartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+type ExportMetricsPartialSuccess struct {
+	RejectedDataPoints int64  `json:"rejectedDataPoints,string"`
+	ErrorMessage       string `json:"errorMessage,omitempty"`
+}
@@ -0,0 +1,308 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// maxPoints bounds the number of steps of a range query
+const maxPoints = 11000
+
+// Source gives the evaluator access to the stored series
+type Source interface {
+	// Series returns every series currently stored
+	Series() []metric.Metric
+	// ValueAt returns the value of the series with the given key at t
+	ValueAt(key string, t time.Time) (float64, bool)
+	// Increase returns the counter increase of the series over (from, to]
+	Increase(key string, from, to time.Time) (float64, bool)
+}
+
+// Value is the result of an evaluation, either Scalar or Vector
+type Value interface {
+	Type() string
+}
+
+type Scalar float64
+
+// Sample is one series of a vector. ID is dropped once the value is derived
+// from several metrics or aggregated.
+type Sample struct {
+	ID     string
+	Labels metric.Labels
+	Value  float64
+}
+
+type Vector []Sample
+
+func (Scalar) Type() string { return "scalar" }
+func (Vector) Type() string { return "vector" }
+
+// Point is a value at a moment of a range query
+type Point struct {
+	T time.Time
+	V float64
+}
+
+// Series is the result of a range query for one label set
+type Series struct {
+	ID     string
+	Labels metric.Labels
+	Points []Point
+}
+
+// Eval evaluates e as of t
+func Eval(e Expr, src Source, t time.Time) (Value, error) {
+	ev := &evaluator{src: src, t: t, series: src.Series()}
+	return ev.eval(e)
+}
+
+// EvalRange evaluates e at every step between start and end.
+// Scalar results are returned as a single series without labels.
+func EvalRange(e Expr, src Source, start, end time.Time, step time.Duration) ([]Series, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("end is before start")
+	}
+	if end.Sub(start)/step > maxPoints {
+		return nil, fmt.Errorf("too many points, raise the step")
+	}
+
+	all := src.Series()
+	byKey := make(map[string]*Series)
+	var order []string
+	for t := start; !t.After(end); t = t.Add(step) {
+		ev := &evaluator{src: src, t: t, series: all}
+		v, err := ev.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		var vec Vector
+		switch v := v.(type) {
+		case Scalar:
+			vec = Vector{{Value: float64(v)}}
+		case Vector:
+			vec = v
+		}
+		for _, s := range vec {
+			key := s.ID + s.Labels.String()
+			ser, ok := byKey[key]
+			if !ok {
+				ser = &Series{ID: s.ID, Labels: s.Labels}
+				byKey[key] = ser
+				order = append(order, key)
+			}
+			ser.Points = append(ser.Points, Point{T: t, V: s.Value})
+		}
+	}
+
+	sort.Strings(order)
+	res := make([]Series, 0, len(order))
+	for _, k := range order {
+		res = append(res, *byKey[k])
+	}
+	return res, nil
+}
+
+type evaluator struct {
+	src    Source
+	t      time.Time
+	series []metric.Metric
+}
+
+func (ev *evaluator) eval(e Expr) (Value, error) {
+	switch e := e.(type) {
+	case *NumberLiteral:
+		return Scalar(e.Value), nil
+	case *Selector:
+		if e.Range > 0 {
+			return nil, fmt.Errorf("range selector %s is only allowed in rate or increase", e)
+		}
+		return ev.instant(e), nil
+	case *UnaryExpr:
+		v, err := ev.eval(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return apply(v, func(f float64) float64 { return -f }), nil
+	case *BinaryExpr:
+		return ev.binary(e)
+	case *Call:
+		return ev.call(e), nil
+	case *Aggregate:
+		return ev.aggregate(e)
+	}
+	return nil, fmt.Errorf("unknown expression %s", e)
+}
+
+func (ev *evaluator) instant(sel *Selector) Vector {
+	vec := Vector{}
+	for _, m := range ev.series {
+		if !sel.Matches(m) {
+			continue
+		}
+		v, ok := ev.src.ValueAt(m.Key(), ev.t)
+		if !ok {
+			continue
+		}
+		vec = append(vec, Sample{ID: m.ID, Labels: m.Labels, Value: v})
+	}
+	return vec
+}
+
+func (ev *evaluator) call(c *Call) Vector {
+	vec := Vector{}
+	for _, m := range ev.series {
+		if m.MType != metric.MetricTypeCounter || !c.Arg.Matches(m) {
+			continue
+		}
+		inc, ok := ev.src.Increase(m.Key(), ev.t.Add(-c.Arg.Range), ev.t)
+		if !ok {
+			continue
+		}
+		if c.Func == "rate" {
+			inc /= c.Arg.Range.Seconds()
+		}
+		vec = append(vec, Sample{Labels: m.Labels, Value: inc})
+	}
+	return vec
+}
+
+func apply(v Value, f func(float64) float64) Value {
+	switch v := v.(type) {
+	case Scalar:
+		return Scalar(f(float64(v)))
+	case Vector:
+		out := make(Vector, len(v))
+		for i, s := range v {
+			out[i] = Sample{Labels: s.Labels, Value: f(s.Value)}
+		}
+		return out
+	}
+	return v
+}
+
+func arith(op byte, a, b float64) float64 {
+	switch op {
+	case '+':
+		return a + b
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	case '/':
+		return a / b
+	}
+	return math.NaN()
+}
+
+// binary matches vector elements with identical label sets, ignoring IDs
+func (ev *evaluator) binary(e *BinaryExpr) (Value, error) {
+	lhs, err := ev.eval(e.LHS)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(e.RHS)
+	if err != nil {
+		return nil, err
+	}
+
+	ls, lScalar := lhs.(Scalar)
+	rs, rScalar := rhs.(Scalar)
+	switch {
+	case lScalar && rScalar:
+		return Scalar(arith(e.Op, float64(ls), float64(rs))), nil
+	case rScalar:
+		return apply(lhs, func(f float64) float64 { return arith(e.Op, f, float64(rs)) }), nil
+	case lScalar:
+		return apply(rhs, func(f float64) float64 { return arith(e.Op, float64(ls), f) }), nil
+	}
+
+	right := make(map[string]Sample)
+	for _, s := range rhs.(Vector) {
+		key := s.Labels.String()
+		if _, dup := right[key]; dup {
+			return nil, fmt.Errorf("many-to-one match on %s%s in %s", s.ID, key, e)
+		}
+		right[key] = s
+	}
+	out := Vector{}
+	seen := make(map[string]bool)
+	for _, s := range lhs.(Vector) {
+		key := s.Labels.String()
+		r, ok := right[key]
+		if !ok {
+			continue
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("many-to-one match on %s%s in %s", s.ID, key, e)
+		}
+		seen[key] = true
+		out = append(out, Sample{Labels: s.Labels, Value: arith(e.Op, s.Value, r.Value)})
+	}
+	return out, nil
+}
+
+func (ev *evaluator) aggregate(a *Aggregate) (Value, error) {
+	v, err := ev.eval(a.Expr)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(Vector)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a vector", a.Op)
+	}
+
+	type group struct {
+		labels metric.Labels
+		value  float64
+		count  int
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for _, s := range vec {
+		var labels metric.Labels
+		for _, name := range a.By {
+			if v, ok := s.Labels[name]; ok {
+				if labels == nil {
+					labels = metric.Labels{}
+				}
+				labels[name] = v
+			}
+		}
+		key := labels.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels, value: s.Value}
+			groups[key] = g
+			order = append(order, key)
+		} else {
+			switch a.Op {
+			case "sum", "avg":
+				g.value += s.Value
+			case "min":
+				g.value = math.Min(g.value, s.Value)
+			case "max":
+				g.value = math.Max(g.value, s.Value)
+			}
+		}
+		g.count++
+	}
+
+	sort.Strings(order)
+	out := make(Vector, 0, len(groups))
+	for _, key := range order {
+		g := groups[key]
+		if a.Op == "avg" {
+			g.value /= float64(g.count)
+		}
+		out = append(out, Sample{Labels: g.labels, Value: g.value})
+	}
+	return out, nil
+}
@@ -0,0 +1,604 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// Expr is a node of a parsed expression
+type Expr interface {
+	String() string
+}
+
+type NumberLiteral struct {
+	Value float64
+}
+
+// MatchType is the operator of a label matcher
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// Selector picks series by ID and labels, e.g. HeapInuse{host="a"} or PollCount[5m]
+type Selector struct {
+	ID       string
+	Matchers []*Matcher
+	// Range is set for range selectors used by rate and increase
+	Range time.Duration
+}
+
+// Matches reports whether m is selected, ignoring the range
+func (s *Selector) Matches(m metric.Metric) bool {
+	if s.ID != "" && m.ID != s.ID {
+		return false
+	}
+	for _, lm := range s.Matchers {
+		if !lm.Matches(m.Labels[lm.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+type BinaryExpr struct {
+	Op  byte
+	LHS Expr
+	RHS Expr
+}
+
+type UnaryExpr struct {
+	Expr Expr
+}
+
+// Call is rate() or increase() over a range selector
+type Call struct {
+	Func string
+	Arg  *Selector
+}
+
+// Aggregate is sum, avg, min or max, optionally by labels
+type Aggregate struct {
+	Op   string
+	By   []string
+	Expr Expr
+}
+
+func (n *NumberLiteral) String() string {
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+func (s *Selector) String() string {
+	var b strings.Builder
+	if bareID(s.ID) {
+		b.WriteString(s.ID)
+	} else {
+		b.WriteString("`" + s.ID + "`")
+	}
+	if len(s.Matchers) > 0 {
+		b.WriteByte('{')
+		for i, m := range s.Matchers {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s%s%q", m.Name, m.Type, m.Value)
+		}
+		b.WriteByte('}')
+	}
+	if s.Range > 0 {
+		fmt.Fprintf(&b, "[%s]", s.Range)
+	}
+	return b.String()
+}
+
+func (e *BinaryExpr) String() string {
+	return fmt.Sprintf("(%s %c %s)", e.LHS, e.Op, e.RHS)
+}
+
+func (e *UnaryExpr) String() string {
+	return fmt.Sprintf("-%s", e.Expr)
+}
+
+func (c *Call) String() string {
+	return fmt.Sprintf("%s(%s)", c.Func, c.Arg)
+}
+
+func (a *Aggregate) String() string {
+	if len(a.By) > 0 {
+		return fmt.Sprintf("%s by (%s) (%s)", a.Op, strings.Join(a.By, ","), a.Expr)
+	}
+	return fmt.Sprintf("%s(%s)", a.Op, a.Expr)
+}
+
+var (
+	functions    = map[string]bool{"rate": true, "increase": true}
+	aggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true}
+)
+
+// Parse parses an expression such as
+//
+//	sum by (host) (rate(PollCount[5m])) / 2
+//	HeapInuse{service.name="checkout"} / HeapSys
+//	`http-requests/s`{code="200"}
+//
+// IDs holding - or / are quoted in backticks, bare they read as operators.
+func Parse(input string) (Expr, error) {
+	p := &parser{lex: lexer{input: input}}
+	p.next()
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return e, nil
+}
+
+// ParseSelector parses a standalone selector, e.g. {host=~"db.*"} or Alloc{host="a"}
+func ParseSelector(input string) (*Selector, error) {
+	p := &parser{lex: lexer{input: input}}
+	p.next()
+	var sel *Selector
+	var err error
+	if p.tok.kind == tokLBrace {
+		sel = &Selector{}
+		err = p.matchers(sel)
+	} else {
+		var e Expr
+		e, err = p.primary()
+		if err == nil {
+			var ok bool
+			if sel, ok = e.(*Selector); !ok {
+				err = p.errorf("expected a selector")
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return sel, nil
+}
+
+type parser struct {
+	lex lexer
+	tok token
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.next()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(k tokenKind) error {
+	if p.tok.kind != k {
+		return p.errorf("expected %s, got %s", k, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+// expr := term (('+' | '-') term)*
+func (p *parser) expr() (Expr, error) {
+	lhs, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp && (p.tok.text == "+" || p.tok.text == "-") {
+		op := p.tok.text[0]
+		p.next()
+		rhs, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+// term := unary (('*' | '/') unary)*
+func (p *parser) term() (Expr, error) {
+	lhs, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp && (p.tok.text == "*" || p.tok.text == "/") {
+		op := p.tok.text[0]
+		p.next()
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+// unary := '-' unary | primary
+func (p *parser) unary() (Expr, error) {
+	if p.tok.kind == tokOp && p.tok.text == "-" {
+		p.next()
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Expr: e}, nil
+	}
+	return p.primary()
+}
+
+// primary := number | '(' expr ')' | call | aggregate | selector
+func (p *parser) primary() (Expr, error) {
+	switch p.tok.kind {
+	case tokNumber:
+		v, err := strconv.ParseFloat(p.tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.tok.text)
+		}
+		p.next()
+		return &NumberLiteral{Value: v}, nil
+	case tokLParen:
+		p.next()
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(tokRParen)
+	case tokIdent:
+		name := p.tok.text
+		p.next()
+		// function and aggregation names are only keywords in call position
+		if functions[name] && p.tok.kind == tokLParen {
+			return p.call(name)
+		}
+		if aggregations[name] && (p.tok.kind == tokLParen || p.tok.kind == tokIdent && p.tok.text == "by") {
+			return p.aggregate(name)
+		}
+		return p.selector(name)
+	case tokQuotedIdent:
+		name := p.tok.text
+		p.next()
+		return p.selector(name)
+	case tokLBrace:
+		return p.selector("")
+	}
+	return nil, p.errorf("unexpected %s", p.tok)
+}
+
+func (p *parser) call(name string) (Expr, error) {
+	p.next()
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := e.(*Selector)
+	if !ok || sel.Range <= 0 {
+		return nil, p.errorf("%s expects a range selector like PollCount[5m]", name)
+	}
+	return &Call{Func: name, Arg: sel}, p.expect(tokRParen)
+}
+
+func (p *parser) aggregate(name string) (Expr, error) {
+	agg := &Aggregate{Op: name}
+	if p.tok.kind == tokIdent && p.tok.text == "by" {
+		p.next()
+		by, err := p.labelList()
+		if err != nil {
+			return nil, err
+		}
+		agg.By = by
+	}
+	if err := p.expect(tokLParen); err != nil {
+		return nil, err
+	}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	agg.Expr = e
+	if err := p.expect(tokRParen); err != nil {
+		return nil, err
+	}
+	// the grouping may also follow the expression, as in sum(x) by (host)
+	if agg.By == nil && p.tok.kind == tokIdent && p.tok.text == "by" {
+		p.next()
+		by, err := p.labelList()
+		if err != nil {
+			return nil, err
+		}
+		agg.By = by
+	}
+	return agg, nil
+}
+
+func (p *parser) labelList() ([]string, error) {
+	if err := p.expect(tokLParen); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for p.tok.kind != tokRParen {
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf("expected label name, got %s", p.tok)
+		}
+		labels = append(labels, p.tok.text)
+		p.next()
+		if p.tok.kind == tokComma {
+			p.next()
+		} else if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected , or ), got %s", p.tok)
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+func (p *parser) selector(id string) (Expr, error) {
+	sel := &Selector{ID: id}
+	if p.tok.kind == tokLBrace {
+		if err := p.matchers(sel); err != nil {
+			return nil, err
+		}
+	}
+	if sel.ID == "" && len(sel.Matchers) == 0 {
+		return nil, p.errorf("empty selector")
+	}
+	if p.tok.kind == tokLBracket {
+		d, err := p.lex.duration()
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		sel.Range = d
+		p.next()
+	}
+	return sel, nil
+}
+
+func (p *parser) matchers(sel *Selector) error {
+	p.next()
+	for p.tok.kind != tokRBrace {
+		if p.tok.kind != tokIdent {
+			return p.errorf("expected label name, got %s", p.tok)
+		}
+		m := &Matcher{Name: p.tok.text}
+		p.next()
+		if p.tok.kind != tokMatch {
+			return p.errorf("expected matcher operator, got %s", p.tok)
+		}
+		m.Type = MatchType(p.tok.text)
+		p.next()
+		if p.tok.kind != tokString {
+			return p.errorf("expected quoted label value, got %s", p.tok)
+		}
+		m.Value = p.tok.text
+		if m.Type == MatchRegexp || m.Type == MatchNotRegexp {
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return p.errorf("invalid regexp %q: %s", m.Value, err)
+			}
+			m.re = re
+		}
+		sel.Matchers = append(sel.Matchers, m)
+		p.next()
+		if p.tok.kind == tokComma {
+			p.next()
+		} else if p.tok.kind != tokRBrace {
+			return p.errorf("expected , or }, got %s", p.tok)
+		}
+	}
+	p.next()
+	return nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokError
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokMatch
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokLBracket
+	tokComma
+	tokQuotedIdent
+)
+
+func (k tokenKind) String() string {
+	return [...]string{"end of input", "error", "identifier", "number", "string",
+		"operator", "matcher", "(", ")", "{", "}", "[", ",", "quoted identifier"}[k]
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokError:
+		return t.text
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var single = map[byte]tokenKind{
+	'(': tokLParen, ')': tokRParen, '{': tokLBrace, '}': tokRBrace, '[': tokLBracket, ',': tokComma,
+}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+func isIdentStart(r byte) bool {
+	return r == '_' || unicode.IsLetter(rune(r))
+}
+
+func isIdentChar(r byte) bool {
+	return isIdentStart(r) || r == '.' || r == ':' || unicode.IsDigit(rune(r))
+}
+
+// bareID reports whether id reads as a single identifier without quotes
+func bareID(id string) bool {
+	if id == "" {
+		return true
+	}
+	if !isIdentStart(id[0]) {
+		return false
+	}
+	for i := 1; i < len(id); i++ {
+		if !isIdentChar(id[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *lexer) next() token {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: start}
+	}
+
+	c := l.input[l.pos]
+	switch {
+	case single[c] != 0:
+		l.pos++
+		return token{kind: single[c], text: string(c), pos: start}
+	case c == '+' || c == '-' || c == '*' || c == '/':
+		l.pos++
+		return token{kind: tokOp, text: string(c), pos: start}
+	case c == '=' || c == '!':
+		l.pos++
+		if l.pos < len(l.input) && (l.input[l.pos] == '=' || l.input[l.pos] == '~') {
+			l.pos++
+		} else if c == '!' {
+			return token{kind: tokError, text: "unexpected !", pos: start}
+		}
+		return token{kind: tokMatch, text: l.input[start:l.pos], pos: start}
+	case c == '"' || c == '\'':
+		return l.quoted(c)
+	case c == '`':
+		end := strings.IndexByte(l.input[l.pos+1:], '`')
+		if end < 0 {
+			return token{kind: tokError, text: "unterminated identifier", pos: start}
+		}
+		l.pos += end + 2
+		if end == 0 {
+			return token{kind: tokError, text: "empty identifier", pos: start}
+		}
+		return token{kind: tokQuotedIdent, text: l.input[start+1 : l.pos-1], pos: start}
+	case unicode.IsDigit(rune(c)) || c == '.':
+		for l.pos < len(l.input) {
+			c := l.input[l.pos]
+			if unicode.IsDigit(rune(c)) || c == '.' {
+				l.pos++
+				continue
+			}
+			if (c == 'e' || c == 'E') && l.pos+1 < len(l.input) {
+				l.pos++
+				if l.input[l.pos] == '+' || l.input[l.pos] == '-' {
+					l.pos++
+				}
+				continue
+			}
+			break
+		}
+		return token{kind: tokNumber, text: l.input[start:l.pos], pos: start}
+	case isIdentStart(c):
+		for l.pos < len(l.input) && isIdentChar(l.input[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.input[start:l.pos], pos: start}
+	}
+	l.pos++
+	return token{kind: tokError, text: fmt.Sprintf("unexpected character %q", c), pos: start}
+}
+
+func (l *lexer) quoted(q byte) token {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.input) {
+		switch l.input[l.pos] {
+		case '\\':
+			l.pos += 2
+			continue
+		case q:
+			l.pos++
+			raw := l.input[start:l.pos]
+			if q == '\'' {
+				raw = `"` + strings.ReplaceAll(raw[1:len(raw)-1], `"`, `\"`) + `"`
+			}
+			s, err := strconv.Unquote(raw)
+			if err != nil {
+				return token{kind: tokError, text: "invalid string " + raw, pos: start}
+			}
+			return token{kind: tokString, text: s, pos: start}
+		}
+		l.pos++
+	}
+	return token{kind: tokError, text: "unterminated string", pos: start}
+}
+
+// duration reads the body of a [5m] range right after the opening bracket
+func (l *lexer) duration() (time.Duration, error) {
+	end := strings.IndexByte(l.input[l.pos:], ']')
+	if end < 0 {
+		return 0, fmt.Errorf("unterminated range")
+	}
+	text := strings.TrimSpace(l.input[l.pos : l.pos+end])
+	l.pos += end + 1
+	d, err := time.ParseDuration(text)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid range %q", text)
+	}
+	return d, nil
+}
@@ -0,0 +1,157 @@
+package query
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSource struct {
+	series   []metric.Metric
+	increase map[string]float64
+}
+
+func (ts testSource) Series() []metric.Metric {
+	return ts.series
+}
+
+func (ts testSource) ValueAt(key string, t time.Time) (float64, bool) {
+	for _, m := range ts.series {
+		if m.Key() == key {
+			if m.MType == metric.MetricTypeCounter {
+				return float64(m.Delta), true
+			}
+			return m.Value, true
+		}
+	}
+	return 0, false
+}
+
+func (ts testSource) Increase(key string, from, to time.Time) (float64, bool) {
+	inc, ok := ts.increase[key]
+	return inc * to.Sub(from).Minutes(), ok
+}
+
+var src = testSource{
+	series: []metric.Metric{
+		{ID: "HeapInuse", MType: metric.MetricTypeGauge, Value: 30},
+		{ID: "HeapSys", MType: metric.MetricTypeGauge, Value: 120},
+		{ID: "Alloc", MType: metric.MetricTypeGauge, Value: 10, Labels: metric.Labels{"host": "a", "dc": "east"}},
+		{ID: "Alloc", MType: metric.MetricTypeGauge, Value: 20, Labels: metric.Labels{"host": "b", "dc": "east"}},
+		{ID: "Alloc", MType: metric.MetricTypeGauge, Value: 60, Labels: metric.Labels{"host": "c", "dc": "west"}},
+		{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: 100, Labels: metric.Labels{"host": "a"}},
+		{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: 50, Labels: metric.Labels{"host": "b"}},
+	},
+	increase: map[string]float64{
+		`PollCount{host="a"}`: 30,
+		`PollCount{host="b"}`: 6,
+	},
+}
+
+func eval(t *testing.T, expr string) Value {
+	e, err := Parse(expr)
+	require.NoError(t, err, expr)
+	v, err := Eval(e, src, time.Now())
+	require.NoError(t, err, expr)
+	return v
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"HeapInuse / HeapSys", "(HeapInuse / HeapSys)"},
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"-(1 - 2) - 3", "(-(1 - 2) - 3)"},
+		{`Alloc{host="a",dc!~'we.*'}`, `Alloc{host="a",dc!~"we.*"}`},
+		{"rate(PollCount[5m])", "rate(PollCount[5m0s])"},
+		{"sum by (dc) (Alloc)", "sum by (dc) (Alloc)"},
+		{"max(Alloc) by (dc)", "max by (dc) (Alloc)"},
+		{"checkout.requests{service.name=\"x\"}", `checkout.requests{service.name="x"}`},
+		{"sum", "sum"},
+		// IDs validate accepts but the operators would split
+		{"`http-requests/s`{code=\"200\"} / 2", "(`http-requests/s`{code=\"200\"} / 2)"},
+		{"rate(`api/v1-calls`[1m])", "rate(`api/v1-calls`[1m0s])"},
+		{"`Alloc`", "Alloc"},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.in)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, e.String(), tt.in)
+	}
+
+	for _, bad := range []string{"", "1 +", "Alloc{host=}", "rate(PollCount)", "sum by host (Alloc)", "Alloc[5x]", "(1", "a ! b", "``", "`open"} {
+		_, err := Parse(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestEvalArithmetic(t *testing.T) {
+	assert.Equal(t, Scalar(7), eval(t, "1 + 2 * 3"))
+	assert.Equal(t, Vector{{Value: 0.25}}, eval(t, "HeapInuse / HeapSys"))
+	assert.Equal(t, Vector{{Value: 25}}, eval(t, "HeapInuse / HeapSys * 100"))
+
+	v := eval(t, "1 / (HeapInuse - 30)")
+	require.Len(t, v, 1)
+	assert.True(t, math.IsInf(v.(Vector)[0].Value, 1))
+}
+
+func TestEvalSelectors(t *testing.T) {
+	v := eval(t, `Alloc{dc="east"}`).(Vector)
+	assert.Len(t, v, 2)
+	v = eval(t, `Alloc{host=~"a|c"}`).(Vector)
+	assert.Len(t, v, 2)
+	v = eval(t, `{host="a"}`).(Vector)
+	assert.Len(t, v, 2)
+}
+
+func TestEvalRateAndAggregations(t *testing.T) {
+	v := eval(t, "rate(PollCount[5m])").(Vector)
+	require.Len(t, v, 2)
+	assert.InDelta(t, 0.5, v[0].Value, 1e-9)
+	assert.Equal(t, Vector{{Value: 180}}, eval(t, "sum(increase(PollCount[5m]))"))
+
+	assert.Equal(t, Vector{
+		{Labels: metric.Labels{"dc": "east"}, Value: 15},
+		{Labels: metric.Labels{"dc": "west"}, Value: 60},
+	}, eval(t, "avg by (dc) (Alloc)"))
+	assert.Equal(t, Vector{{Value: 10}}, eval(t, "min(Alloc)"))
+	assert.Equal(t, Vector{{Value: 60}}, eval(t, "max(Alloc)"))
+}
+
+func TestEvalRange(t *testing.T) {
+	e, err := Parse("sum(Alloc)")
+	require.NoError(t, err)
+	start := time.Now().Add(-time.Hour)
+	series, err := EvalRange(e, src, start, start.Add(10*time.Minute), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Len(t, series[0].Points, 11)
+	assert.Equal(t, 90.0, series[0].Points[3].V)
+
+	_, err = EvalRange(e, src, start, start.Add(time.Hour*24*365), time.Second)
+	assert.Error(t, err)
+}
+
+func TestParseSelector(t *testing.T) {
+	sel, err := ParseSelector(`{host=~"a|b"}`)
+	require.NoError(t, err)
+	assert.True(t, sel.Matches(metric.Metric{ID: "x", Labels: metric.Labels{"host": "a"}}))
+	assert.False(t, sel.Matches(metric.Metric{ID: "x"}))
+
+	sel, err = ParseSelector(`Alloc`)
+	require.NoError(t, err)
+	assert.True(t, sel.Matches(metric.Metric{ID: "Alloc"}))
+
+	sel, err = ParseSelector("`disk/sda-1`")
+	require.NoError(t, err)
+	assert.True(t, sel.Matches(metric.Metric{ID: "disk/sda-1"}))
+
+	_, err = ParseSelector(`Alloc + 1`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at Rate tokens per second up to Burst
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewBucket returns a full bucket. A burst below one is raised to one.
+func NewBucket(rate float64, burst int) *Bucket {
+	b := float64(burst)
+	if b < 1 {
+		b = 1
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		now:    time.Now,
+	}
+}
+
+// Allow takes a token if one is available
+func (b *Bucket) Allow() bool {
+	ok, _ := b.Reserve(1)
+	return ok
+}
+
+// Reserve takes n tokens if available; otherwise it tells how long
+// to wait until they are
+func (b *Bucket) Reserve(n int) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	need := float64(n)
+	if b.tokens >= need {
+		b.tokens -= need
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Hour
+	}
+	wait := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewBucket(2, 3)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.Allow())
+	}
+	ok, wait := b.Reserve(1)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	now = now.Add(time.Second)
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// refill stops at the burst
+	now = now.Add(time.Hour)
+	ok, _ = b.Reserve(4)
+	assert.False(t, ok)
+	ok, _ = b.Reserve(3)
+	assert.True(t, ok)
+}
+
+func TestKeyedMiddleware(t *testing.T) {
+	k := NewKeyed(1, 2)
+	h := k.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(agent, addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/update/", nil)
+		r.RemoteAddr = addr
+		if agent != "" {
+			r.Header.Set(agents.HeaderID, agent)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, do("", "10.0.0.1:1000").Code)
+	assert.Equal(t, http.StatusOK, do("", "10.0.0.1:2000").Code)
+	w := do("", "10.0.0.1:3000")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// a client making up a new agent ID for every request stays in its IP's bucket
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, do(fmt.Sprintf("rotated-%d", i), "10.0.0.1:4000").Code)
+	}
+	assert.Equal(t, http.StatusOK, do("", "10.0.0.2:1000").Code)
+	assert.Equal(t, 2, k.Len())
+
+	// authenticated clients behind one address have buckets of their own
+	authed := func(ctx context.Context) int {
+		r := httptest.NewRequest(http.MethodPost, "/update/", nil).WithContext(ctx)
+		r.RemoteAddr = "10.0.0.1:5000"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, authed(auth.WithTokenID(context.Background(), "ci")))
+	tokens, err := auth.Load(writeTokens(t))
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/update/", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	var ctx context.Context
+	tokens.Identify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ctx = r.Context() })).ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, http.StatusOK, authed(ctx))
+	assert.Equal(t, 4, k.Len())
+}
+
+func writeTokens(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	data := fmt.Sprintf(`{"tokens":[{"id":"agent","hash":%q,"roles":["write"]}]}`, auth.Hash("s3cret"))
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	return path
+}
+
+func TestConcurrency(t *testing.T) {
+	c := NewConcurrency(1)
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	<-entered
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	close(release)
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/auth"
+)
+
+// idleAfter is how long a client's bucket is kept without requests
+const idleAfter = 10 * time.Minute
+
+// Keyed keeps one token bucket per client
+type Keyed struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*keyedBucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+type keyedBucket struct {
+	*Bucket
+	used time.Time
+}
+
+func NewKeyed(rate float64, burst int) *Keyed {
+	return &Keyed{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*keyedBucket),
+		now:     time.Now,
+	}
+}
+
+// Reserve takes a token from the bucket of key, see Bucket.Reserve
+func (k *Keyed) Reserve(key string) (bool, time.Duration) {
+	now := k.now()
+	k.mu.Lock()
+	b, ok := k.buckets[key]
+	if !ok {
+		b = &keyedBucket{Bucket: NewBucket(k.rate, k.burst)}
+		b.now = k.now
+		k.buckets[key] = b
+	}
+	b.used = now
+	// drop idle clients now and then, their buckets are full again anyway
+	if now.Sub(k.swept) > idleAfter {
+		for key, b := range k.buckets {
+			if now.Sub(b.used) > idleAfter {
+				delete(k.buckets, key)
+			}
+		}
+		k.swept = now
+	}
+	k.mu.Unlock()
+	return b.Reserve(1)
+}
+
+// Len returns the number of tracked clients
+func (k *Keyed) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.buckets)
+}
+
+// ClientKey identifies the client of r by an authenticated identity, the
+// token from auth.Identify or the certificate from agents.CertIdentity, or
+// else by its IP. Headers the client sets freely are never used, a client
+// could otherwise get a fresh bucket with every request.
+func ClientKey(r *http.Request) string {
+	if id, ok := auth.TokenIDFromContext(r.Context()); ok {
+		return "token:" + id
+	}
+	if id, ok := agents.CertIDFromContext(r.Context()); ok {
+		return "agent:" + id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// RetryAfter formats a wait as whole seconds for the Retry-After header
+func RetryAfter(wait time.Duration) string {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
+// Middleware rejects clients over their rate with 429 and a Retry-After header
+func (k *Keyed) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := k.Reserve(ClientKey(r)); !ok {
+			w.Header().Set("Retry-After", RetryAfter(wait))
+			apierr.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Concurrency caps the number of requests handled at once
+type Concurrency struct {
+	slots chan struct{}
+}
+
+func NewConcurrency(n int) *Concurrency {
+	return &Concurrency{slots: make(chan struct{}, n)}
+}
+
+// Middleware rejects requests with 429 while all slots are taken,
+// it never queues them
+func (c *Concurrency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case c.slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			apierr.Error(w, "server is busy", http.StatusTooManyRequests)
+			return
+		}
+		defer func() { <-c.slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// InFlight returns the number of requests being handled
+func (c *Concurrency) InFlight() int {
+	return len(c.slots)
+}
@@ -0,0 +1,382 @@
+package rollup
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// DefaultResolutions keep a day of minutes, a week of 5 minutes and a month of hours
+const DefaultResolutions = "1m:24h,5m:168h,1h:720h"
+
+// targetPoints is the number of buckets aimed for when no step is requested
+const targetPoints = 300
+
+// numShards splits the series like storage.DefaultShards, a power of two
+const numShards = 64
+
+var ErrNoSeries = errors.New("series not found")
+
+// Resolution is a window size together with how long its buckets are kept
+type Resolution struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// ParseResolutions parses a "step:retention,..." list, e.g. "1m:24h,1h:720h"
+func ParseResolutions(s string) ([]Resolution, error) {
+	var res []Resolution
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid resolution %q, want step:retention", part)
+		}
+		step, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolution step %q: %w", fields[0], err)
+		}
+		retention, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolution retention %q: %w", fields[1], err)
+		}
+		if step <= 0 || retention < step {
+			return nil, fmt.Errorf("invalid resolution %q", part)
+		}
+		res = append(res, Resolution{Step: step, Retention: retention})
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no resolutions")
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Step < res[j].Step })
+	return res, nil
+}
+
+// expired reports whether a bucket starting at start ended before the retention at now
+func (r Resolution) expired(start, now time.Time) bool {
+	return start.Add(r.Step).Before(now.Add(-r.Retention))
+}
+
+// Bucket aggregates the samples of one window.
+// Gauges use Min, Max, Sum, Count and Last; counters use Increase,
+// Count and Last, where Last is the running total.
+type Bucket struct {
+	Start    time.Time
+	Min      float64
+	Max      float64
+	Sum      float64
+	Count    int64
+	Last     float64
+	Increase int64
+}
+
+func (b *Bucket) add(value float64, increase int64) {
+	if b.Count == 0 || value < b.Min {
+		b.Min = value
+	}
+	if b.Count == 0 || value > b.Max {
+		b.Max = value
+	}
+	b.Sum += value
+	b.Count++
+	b.Last = value
+	b.Increase += increase
+}
+
+func (b *Bucket) merge(o Bucket) {
+	if o.Count == 0 {
+		return
+	}
+	if b.Count == 0 || o.Min < b.Min {
+		b.Min = o.Min
+	}
+	if b.Count == 0 || o.Max > b.Max {
+		b.Max = o.Max
+	}
+	b.Sum += o.Sum
+	b.Count += o.Count
+	b.Last = o.Last
+	b.Increase += o.Increase
+}
+
+type series struct {
+	mtype   metric.MetricType
+	buckets [][]Bucket // per resolution, ordered by Start
+}
+
+type shard struct {
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+// Engine aggregates incoming samples into fixed windows at several resolutions.
+// Series are split into shards by a hash of the metric ID, so updates of
+// different metrics don't wait on each other.
+type Engine struct {
+	resolutions []Resolution
+	shards      []*shard
+	mask        uint32
+	now         func() time.Time
+}
+
+func New(resolutions []Resolution) *Engine {
+	e := &Engine{
+		resolutions: resolutions,
+		shards:      make([]*shard, numShards),
+		mask:        numShards - 1,
+		now:         time.Now,
+	}
+	for i := range e.shards {
+		e.shards[i] = &shard{series: make(map[string]*series)}
+	}
+	return e
+}
+
+// shard picks the shard of a series key by the 32-bit FNV-1a hash of its
+// metric ID, IDs never contain '{'
+func (e *Engine) shard(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key) && key[i] != '{'; i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return e.shards[h&e.mask]
+}
+
+// Resolutions returns the configured resolutions, finest first
+func (e *Engine) Resolutions() []Resolution {
+	return e.resolutions
+}
+
+// Record adds a sample of m taken at t.
+// For counters increase is the change since the previous sample.
+func (e *Engine) Record(m metric.Metric, increase int64, t time.Time) {
+	value := m.Value
+	if m.MType == metric.MetricTypeCounter {
+		value = float64(m.Delta)
+	}
+
+	key := m.Key()
+	sh := e.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	s, ok := sh.series[key]
+	if !ok || s.mtype != m.MType {
+		// a type change makes the old windows meaningless
+		s = &series{mtype: m.MType, buckets: make([][]Bucket, len(e.resolutions))}
+		sh.series[key] = s
+	}
+
+	for i, r := range e.resolutions {
+		start := t.Truncate(r.Step)
+		s.buckets[i] = expire(s.buckets[i], t.Add(-r.Retention))
+		bs := s.buckets[i]
+
+		j := len(bs) - 1
+		for j >= 0 && bs[j].Start.After(start) {
+			j--
+		}
+		if j >= 0 && bs[j].Start.Equal(start) {
+			bs[j].add(value, increase)
+			continue
+		}
+		b := Bucket{Start: start}
+		b.add(value, increase)
+		bs = append(bs, Bucket{})
+		copy(bs[j+2:], bs[j+1:])
+		bs[j+1] = b
+		s.buckets[i] = bs
+	}
+}
+
+// expire drops buckets that ended before the cutoff
+func expire(bs []Bucket, cutoff time.Time) []Bucket {
+	n := 0
+	for n < len(bs) && bs[n].Start.Before(cutoff) {
+		n++
+	}
+	if n == 0 {
+		return bs
+	}
+	return append(bs[:0], bs[n:]...)
+}
+
+// Expire drops the buckets past their retention at now and the series left
+// without any, so metrics that stopped reporting don't stay forever
+func (e *Engine) Expire(now time.Time) {
+	for _, sh := range e.shards {
+		sh.mu.Lock()
+		for key, s := range sh.series {
+			empty := true
+			for i, r := range e.resolutions {
+				s.buckets[i] = expire(s.buckets[i], now.Add(-r.Retention-r.Step))
+				if len(s.buckets[i]) > 0 {
+					empty = false
+				}
+			}
+			if empty {
+				delete(sh.series, key)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// Delete drops all windows of a series
+func (e *Engine) Delete(key string) {
+	sh := e.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	delete(sh.series, key)
+}
+
+// Pick chooses the resolution to answer a query over [from, to] with the given step.
+// It prefers the coarsest resolution not exceeding step whose retention still
+// reaches back to from, falls back to the finest one that does, and to the
+// longest retention when none does. A zero step aims for about 300 points.
+func (e *Engine) Pick(from, to time.Time, step time.Duration) int {
+	if step <= 0 {
+		step = to.Sub(from) / targetPoints
+	}
+	age := e.now().Sub(from)
+
+	pick := -1
+	for i, r := range e.resolutions {
+		if r.Retention < age {
+			continue
+		}
+		if pick == -1 || r.Step <= step {
+			pick = i
+		}
+	}
+	if pick == -1 {
+		for i, r := range e.resolutions {
+			if pick == -1 || r.Retention > e.resolutions[pick].Retention {
+				pick = i
+			}
+		}
+	}
+	return pick
+}
+
+// Result is the answer to a history query
+type Result struct {
+	Type       metric.MetricType
+	Resolution Resolution
+	Step       time.Duration
+	Buckets    []Bucket
+}
+
+// Query returns the windows of the series with the given key overlapping [from, to].
+// Windows of the picked resolution are merged when step is coarser than it.
+func (e *Engine) Query(key string, from, to time.Time, step time.Duration) (Result, error) {
+	if len(e.resolutions) == 0 {
+		return Result{}, ErrNoSeries
+	}
+	i := e.Pick(from, to, step)
+	r := e.resolutions[i]
+	if step < r.Step {
+		step = r.Step
+	}
+	// merged windows must line up with the stored ones
+	step = time.Duration(math.Ceil(float64(step)/float64(r.Step))) * r.Step
+
+	sh := e.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	s, ok := sh.series[key]
+	if !ok {
+		return Result{}, ErrNoSeries
+	}
+
+	// buckets are only dropped by Record and Expire, skip the ones past retention
+	now := e.now()
+	res := Result{Type: s.mtype, Resolution: r, Step: step}
+	for _, b := range s.buckets[i] {
+		if r.expired(b.Start, now) || b.Start.Add(r.Step).Before(from) || b.Start.After(to) {
+			continue
+		}
+		start := b.Start.Truncate(step)
+		if n := len(res.Buckets); n > 0 && res.Buckets[n-1].Start.Equal(start) {
+			res.Buckets[n-1].merge(b)
+			continue
+		}
+		merged := Bucket{Start: start}
+		merged.merge(b)
+		res.Buckets = append(res.Buckets, merged)
+	}
+	return res, nil
+}
+
+// finest returns the finest resolution whose retention still reaches t
+func (e *Engine) finest(t time.Time) int {
+	age := e.now().Sub(t)
+	for i, r := range e.resolutions {
+		if r.Retention >= age {
+			return i
+		}
+	}
+	return len(e.resolutions) - 1
+}
+
+// LastAt returns the last value recorded at or before t
+func (e *Engine) LastAt(key string, t time.Time) (float64, bool) {
+	if len(e.resolutions) == 0 {
+		return 0, false
+	}
+	i := e.finest(t)
+
+	sh := e.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	s, ok := sh.series[key]
+	if !ok {
+		return 0, false
+	}
+	bs := s.buckets[i]
+	j := sort.Search(len(bs), func(j int) bool { return bs[j].Start.After(t) })
+	if j == 0 || e.resolutions[i].expired(bs[j-1].Start, e.now()) {
+		return 0, false
+	}
+	return bs[j-1].Last, true
+}
+
+// Increase returns the counter increase over the windows starting in [from, to)
+func (e *Engine) Increase(key string, from, to time.Time) (int64, bool) {
+	if len(e.resolutions) == 0 {
+		return 0, false
+	}
+	i := e.finest(from)
+	r := e.resolutions[i]
+	from = from.Truncate(r.Step)
+	now := e.now()
+
+	sh := e.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	s, ok := sh.series[key]
+	if !ok || s.mtype != metric.MetricTypeCounter {
+		return 0, false
+	}
+	var inc int64
+	found := false
+	for _, b := range s.buckets[i] {
+		if r.expired(b.Start, now) || b.Start.Before(from) || !b.Start.Before(to) {
+			continue
+		}
+		inc += b.Increase
+		found = true
+	}
+	return inc, found
+}
@@ -0,0 +1,146 @@
+package rollup
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEngine(t *testing.T, now time.Time) *Engine {
+	res, err := ParseResolutions(DefaultResolutions)
+	require.NoError(t, err)
+	e := New(res)
+	e.now = func() time.Time { return now }
+	return e
+}
+
+func TestGaugeBuckets(t *testing.T) {
+	base := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	e := testEngine(t, base.Add(10*time.Minute))
+
+	for i, v := range []float64{4, 1, 7, 2} {
+		e.Record(metric.Metric{ID: "Alloc", MType: metric.MetricTypeGauge, Value: v}, 0, base.Add(time.Duration(i)*20*time.Second))
+	}
+
+	res, err := e.Query("Alloc", base, base.Add(10*time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, res.Resolution.Step)
+	require.Len(t, res.Buckets, 2)
+	assert.Equal(t, Bucket{Start: base, Min: 1, Max: 7, Sum: 12, Count: 3, Last: 7}, res.Buckets[0])
+	assert.Equal(t, Bucket{Start: base.Add(time.Minute), Min: 2, Max: 2, Sum: 2, Count: 1, Last: 2}, res.Buckets[1])
+
+	// a coarser step merges minute windows
+	res, err = e.Query("Alloc", base, base.Add(10*time.Minute), 5*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, res.Resolution.Step)
+	require.Len(t, res.Buckets, 1)
+	assert.Equal(t, int64(4), res.Buckets[0].Count)
+}
+
+func TestCounterIncrease(t *testing.T) {
+	base := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	e := testEngine(t, base.Add(2*time.Hour))
+
+	total := int64(0)
+	for i := 0; i < 120; i++ {
+		total += 2
+		e.Record(metric.Metric{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: total}, 2, base.Add(time.Duration(i)*time.Minute))
+	}
+
+	res, err := e.Query("PollCount", base, base.Add(2*time.Hour), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, res.Resolution.Step)
+	require.Len(t, res.Buckets, 2)
+	assert.Equal(t, int64(120), res.Buckets[0].Increase)
+	assert.Equal(t, float64(240), res.Buckets[1].Last)
+}
+
+func TestPick(t *testing.T) {
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	e := testEngine(t, now)
+
+	tests := []struct {
+		name string
+		from time.Duration
+		step time.Duration
+		want time.Duration
+	}{
+		{"fine step", time.Hour, time.Minute, time.Minute},
+		{"auto step over an hour", time.Hour, 0, time.Minute},
+		{"auto step over a day", 24 * time.Hour, 0, 1 * time.Minute},
+		{"step between resolutions", 6 * time.Hour, 10 * time.Minute, 5 * time.Minute},
+		{"beyond minute retention", 48 * time.Hour, time.Minute, 5 * time.Minute},
+		{"beyond every retention", 60 * 24 * time.Hour, time.Minute, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := e.Pick(now.Add(-tt.from), now, tt.step)
+			assert.Equal(t, tt.want, e.Resolutions()[i].Step)
+		})
+	}
+}
+
+func TestRetention(t *testing.T) {
+	base := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	e := New([]Resolution{{Step: time.Minute, Retention: 10 * time.Minute}})
+	e.now = func() time.Time { return base.Add(time.Hour) }
+
+	for i := 0; i < 60; i++ {
+		e.Record(metric.Metric{ID: "Sys", MType: metric.MetricTypeGauge, Value: 1}, 0, base.Add(time.Duration(i)*time.Minute))
+	}
+	res, err := e.Query("Sys", base, base.Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	// ten full windows plus the one the cutoff falls into
+	assert.Len(t, res.Buckets, 11)
+
+	// Sys stopped reporting, its windows age out without another Record
+	now := base.Add(2 * time.Hour)
+	e.now = func() time.Time { return now }
+	res, err = e.Query("Sys", base, now, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, res.Buckets)
+	_, ok := e.LastAt("Sys", now)
+	assert.False(t, ok)
+
+	e.Record(metric.Metric{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: 5}, 5, base)
+	_, ok = e.Increase("PollCount", base, now)
+	assert.False(t, ok)
+
+	e.Expire(now)
+	_, err = e.Query("Sys", base, now, time.Minute)
+	assert.Equal(t, ErrNoSeries, err)
+}
+
+func TestConcurrentRecord(t *testing.T) {
+	base := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	e := testEngine(t, base.Add(time.Minute))
+
+	// metrics in different shards are recorded side by side
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			m := metric.Metric{ID: fmt.Sprintf("m%d", g), MType: metric.MetricTypeCounter, Labels: metric.Labels{"host": "a"}}
+			for i := 0; i < 100; i++ {
+				m.Delta = int64(i + 1)
+				e.Record(m, 1, base.Add(time.Duration(i)*100*time.Millisecond))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for g := 0; g < 8; g++ {
+		inc, ok := e.Increase(fmt.Sprintf(`m%d{host="a"}`, g), base, base.Add(time.Minute))
+		require.True(t, ok)
+		assert.Equal(t, int64(100), inc)
+	}
+	e.Delete(`m0{host="a"}`)
+	_, ok := e.Increase(`m0{host="a"}`, base, base.Add(time.Minute))
+	assert.False(t, ok)
+}
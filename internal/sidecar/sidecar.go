@@ -0,0 +1,83 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/collector"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
+)
+
+// ErrNotLocal is returned for a TCP address other apps on the network could reach
+var ErrNotLocal = errors.New("sidecar address must be a unix socket or a loopback address")
+
+// Listen opens the sidecar listener on "unix:<path>" or a loopback host:port.
+// A socket left over from an earlier run is replaced.
+func Listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("%w: %q", ErrNotLocal, addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Handler serves the update API of the server to local apps. Updates land in
+// sink and are reported with everything else the agent collects.
+func Handler(sink collector.Sink, dec validate.Decoder) http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(middleware.Recoverer, validate.Gunzip)
+
+	mux.Route("/update", func(mux chi.Router) {
+		mux.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			m, verr := dec.Update(w, r)
+			if verr != nil {
+				log.Printf("sidecar: %s", verr)
+				apierr.Write(w, verr)
+				return
+			}
+			sink.Add(m)
+		})
+		mux.Post("/{type}/{id}/{value}", func(w http.ResponseWriter, r *http.Request) {
+			m, verr := validate.URL(r)
+			if verr != nil {
+				log.Printf("sidecar: %s", verr)
+				apierr.Write(w, verr)
+				return
+			}
+			sink.Add(m)
+		})
+	})
+	mux.Post("/updates/", func(w http.ResponseWriter, r *http.Request) {
+		batch, verr := dec.Batch(w, r)
+		if verr != nil {
+			log.Printf("sidecar: %s", verr)
+			apierr.Write(w, verr)
+			return
+		}
+		for _, m := range batch {
+			sink.Add(m)
+		}
+	})
+	return mux
+}
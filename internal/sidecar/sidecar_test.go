@@ -0,0 +1,93 @@
+package sidecar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/collector"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	buf := collector.NewBuffer()
+	h := Handler(buf, validate.Decoder{})
+	post := func(path, body string, header map[string]string) int {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("/update/", `{"id":"jobs","type":"counter","delta":2}`, nil))
+	assert.Equal(t, http.StatusOK, post("/update/counter/jobs/3", "", nil))
+	assert.Equal(t, http.StatusOK, post("/updates/", `[{"id":"jobs","type":"counter","delta":5},{"id":"queue","type":"gauge","value":1.5}]`, nil))
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"id":"queue","type":"gauge","value":4}`))
+	require.NoError(t, zw.Close())
+	assert.Equal(t, http.StatusOK, post("/update/", gz.String(), map[string]string{"Content-Encoding": "gzip"}))
+
+	assert.Equal(t, http.StatusBadRequest, post("/update/", `{"id":"jobs","type":"counter"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, post("/update/counter/jobs/1.5", "", nil))
+	assert.Equal(t, http.StatusNotImplemented, post("/update/summary/jobs/1", "", nil))
+	assert.Equal(t, http.StatusBadRequest, post("/update/", "not gzip", map[string]string{"Content-Encoding": "gzip"}))
+
+	// counters add up until the agent reports
+	list := buf.Drain()
+	require.Len(t, list, 2)
+	assert.Equal(t, "jobs", list[0].ID)
+	assert.Equal(t, int64(10), list[0].Delta)
+	assert.Equal(t, 4.0, list[1].Value)
+}
+
+func TestListen(t *testing.T) {
+	_, err := Listen("0.0.0.0:0")
+	assert.True(t, errors.Is(err, ErrNotLocal))
+	_, err = Listen(":0")
+	assert.True(t, errors.Is(err, ErrNotLocal))
+
+	ln, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	ln.Close()
+
+	// a socket left behind by a crashed agent doesn't block the next start
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err = Listen("unix:" + path)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	buf := collector.NewBuffer()
+	srv := &http.Server{Handler: Handler(buf, validate.Decoder{})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Post("http://agent/update/gauge/temp/21.5", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 21.5, buf.Drain()[0].Value)
+}
@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// DefaultShards suits a few dozen cores
+const DefaultShards = 64
+
+// ErrFull is returned for a new series once the store holds Options.Max series
+var ErrFull = errors.New("storage is full")
+
+// Series is a stored metric with its bookkeeping
+type Series struct {
+	metric.Metric
+	// Updated is zero for series loaded from a file and not updated since
+	Updated time.Time
+	Stale   bool
+}
+
+// entry holds a series. Its type, ID and labels never change, the values
+// and the bookkeeping are read and written atomically.
+type entry struct {
+	id      string
+	mtype   metric.MetricType
+	labels  metric.Labels
+	value   uint64 // math.Float64bits of the value
+	delta   int64
+	updated int64 // unix nanoseconds
+	stale   uint32
+}
+
+func newEntry(m metric.Metric) *entry {
+	return &entry{
+		id:     m.ID,
+		mtype:  m.MType,
+		labels: m.Labels,
+		value:  math.Float64bits(m.Value),
+		delta:  m.Delta,
+	}
+}
+
+func (e *entry) metric() metric.Metric {
+	return metric.Metric{
+		ID:     e.id,
+		MType:  e.mtype,
+		Value:  math.Float64frombits(atomic.LoadUint64(&e.value)),
+		Delta:  atomic.LoadInt64(&e.delta),
+		Labels: e.labels,
+	}
+}
+
+func (e *entry) series() Series {
+	s := Series{Metric: e.metric(), Stale: atomic.LoadUint32(&e.stale) == 1}
+	if ns := atomic.LoadInt64(&e.updated); ns != 0 {
+		s.Updated = time.Unix(0, ns)
+	}
+	return s
+}
+
+func (e *entry) touch(now time.Time) {
+	atomic.StoreInt64(&e.updated, now.UnixNano())
+	atomic.StoreUint32(&e.stale, 0)
+}
+
+type shard struct {
+	mu     sync.RWMutex
+	series map[string]*entry
+	// ids counts the series of every metric ID
+	ids map[string]int
+}
+
+// Store is a map of series split into shards by a hash of the metric ID,
+// so all series of a metric share a shard and its lock. Updates of existing
+// series only take the read lock of their shard.
+type Store struct {
+	shards []*shard
+	mask   uint32
+	len    int64
+}
+
+// New returns a store with n shards, rounded up to a power of two
+func New(n int) *Store {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	st := &Store{shards: make([]*shard, size), mask: uint32(size - 1)}
+	for i := range st.shards {
+		st.shards[i] = &shard{series: make(map[string]*entry), ids: make(map[string]int)}
+	}
+	return st
+}
+
+// shard picks the shard of a metric ID by its 32-bit FNV-1a hash
+func (st *Store) shard(id string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return st.shards[h&st.mask]
+}
+
+// idOf returns the metric ID of a series key, IDs never contain '{'
+func idOf(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Len returns the number of series
+func (st *Store) Len() int {
+	return int(atomic.LoadInt64(&st.len))
+}
+
+// Get returns the series with the given key
+func (st *Store) Get(key string) (Series, bool) {
+	sh := st.shard(idOf(key))
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, ok := sh.series[key]
+	if !ok {
+		return Series{}, false
+	}
+	return e.series(), true
+}
+
+// Count returns the number of series of a metric ID
+func (st *Store) Count(id string) int {
+	sh := st.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.ids[id]
+}
+
+// Change is the outcome of a Put
+type Change struct {
+	Old     metric.Metric
+	Existed bool
+	New     metric.Metric
+}
+
+// Options tune a Put
+type Options struct {
+	// Accumulate adds a counter delta to the stored one
+	Accumulate bool
+	// Now is the update time of the series
+	Now time.Time
+	// Max caps the number of series, zero means no cap
+	Max int
+	// Check runs under the lock of the shard of the metric ID before
+	// anything is stored, an error from it aborts the Put
+	Check func() error
+}
+
+// Put stores m and returns the change it made
+func (st *Store) Put(m metric.Metric, opts Options) (Change, error) {
+	key := m.Key()
+	sh := st.shard(m.ID)
+
+	// fast path, the series exists with the same type
+	sh.mu.RLock()
+	if e, ok := sh.series[key]; ok && e.mtype == m.MType {
+		defer sh.mu.RUnlock()
+		if opts.Check != nil {
+			if err := opts.Check(); err != nil {
+				return Change{}, err
+			}
+		}
+		return e.set(m, opts), nil
+	}
+	sh.mu.RUnlock()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e, ok := sh.series[key]
+	if ok && e.mtype == m.MType {
+		// created while waiting for the lock
+		if opts.Check != nil {
+			if err := opts.Check(); err != nil {
+				return Change{}, err
+			}
+		}
+		return e.set(m, opts), nil
+	}
+	if !ok && !st.reserve(opts.Max) {
+		return Change{}, ErrFull
+	}
+	if opts.Check != nil {
+		if err := opts.Check(); err != nil {
+			if !ok {
+				atomic.AddInt64(&st.len, -1)
+			}
+			return Change{}, err
+		}
+	}
+
+	c := Change{New: m}
+	if ok {
+		// the series changes its type
+		c.Old, c.Existed = e.metric(), true
+		if opts.Accumulate && m.MType == metric.MetricTypeCounter {
+			c.New.Delta += c.Old.Delta
+		}
+	} else {
+		sh.ids[m.ID]++
+	}
+	e = newEntry(c.New)
+	e.touch(opts.Now)
+	sh.series[key] = e
+	return c, nil
+}
+
+// set updates an entry of the same type as m, the shard lock must be held
+func (e *entry) set(m metric.Metric, opts Options) Change {
+	c := Change{Existed: true, Old: metric.Metric{ID: e.id, MType: e.mtype, Labels: e.labels}}
+	c.Old.Value = math.Float64frombits(atomic.SwapUint64(&e.value, math.Float64bits(m.Value)))
+	if opts.Accumulate && m.MType == metric.MetricTypeCounter {
+		delta := atomic.AddInt64(&e.delta, m.Delta)
+		c.Old.Delta = delta - m.Delta
+		m.Delta = delta
+	} else {
+		c.Old.Delta = atomic.SwapInt64(&e.delta, m.Delta)
+	}
+	e.touch(opts.Now)
+	m.Labels = e.labels
+	c.New = m
+	return c
+}
+
+// reserve takes a slot for a new series, max of zero means no cap
+func (st *Store) reserve(max int) bool {
+	for {
+		n := atomic.LoadInt64(&st.len)
+		if max > 0 && n >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&st.len, n, n+1) {
+			return true
+		}
+	}
+}
+
+// Load stores restored series as is, without an update time and ignoring any cap
+func (st *Store) Load(list ...metric.Metric) {
+	for _, m := range list {
+		sh := st.shard(m.ID)
+		sh.mu.Lock()
+		if _, ok := sh.series[m.Key()]; !ok {
+			sh.ids[m.ID]++
+			atomic.AddInt64(&st.len, 1)
+		}
+		sh.series[m.Key()] = newEntry(m)
+		sh.mu.Unlock()
+	}
+}
+
+// Delete removes the series with the given key and returns it with the
+// number of series of its metric ID left. A non-nil last runs under the
+// lock of the shard when the last series of the metric ID goes, so no Put
+// of the ID can slip in between.
+func (st *Store) Delete(key string, last func(id string)) (metric.Metric, int, bool) {
+	id := idOf(key)
+	sh := st.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e, ok := sh.series[key]
+	if !ok {
+		return metric.Metric{}, sh.ids[id], false
+	}
+	if sh.remove(key, e) && last != nil {
+		last(id)
+	}
+	atomic.AddInt64(&st.len, -1)
+	return e.metric(), sh.ids[id], true
+}
+
+// remove drops a series and reports whether it was the last of its metric ID
+func (sh *shard) remove(key string, e *entry) bool {
+	delete(sh.series, key)
+	if sh.ids[e.id]--; sh.ids[e.id] <= 0 {
+		delete(sh.ids, e.id)
+		return true
+	}
+	return false
+}
+
+// Snapshot returns every series ordered by key. All shards are locked
+// together, so the copy is a single point in time.
+func (st *Store) Snapshot() []Series {
+	for _, sh := range st.shards {
+		sh.mu.Lock()
+	}
+	list := make([]Series, 0, st.Len())
+	for _, sh := range st.shards {
+		for _, e := range sh.series {
+			list = append(list, e.series())
+		}
+	}
+	for _, sh := range st.shards {
+		sh.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key() < list[j].Key() })
+	return list
+}
+
+// Metrics returns the metrics of a snapshot, leaving out stale series unless withStale is set
+func (st *Store) Metrics(withStale bool) []metric.Metric {
+	snap := st.Snapshot()
+	list := make([]metric.Metric, 0, len(snap))
+	for _, s := range snap {
+		if withStale || !s.Stale {
+			list = append(list, s.Metric)
+		}
+	}
+	return list
+}
+
+// Action is what Scan does with a series
+type Action int
+
+const (
+	// Keep leaves the series live
+	Keep Action = iota
+	// Touch starts the clock of a series without an update time
+	Touch
+	// MarkStale keeps the series but marks it stale
+	MarkStale
+	// Evict removes the series
+	Evict
+)
+
+// Scan visits every series one shard at a time under the shard's write lock,
+// applies the action fn returns and returns the evicted series.
+// A non-nil last runs under the same lock for every metric ID whose last
+// series is evicted.
+func (st *Store) Scan(now time.Time, fn func(s Series) Action, last func(id string)) []metric.Metric {
+	var evicted []metric.Metric
+	for _, sh := range st.shards {
+		sh.mu.Lock()
+		for key, e := range sh.series {
+			switch fn(e.series()) {
+			case Keep:
+				atomic.StoreUint32(&e.stale, 0)
+			case Touch:
+				e.touch(now)
+			case MarkStale:
+				atomic.StoreUint32(&e.stale, 1)
+			case Evict:
+				if sh.remove(key, e) && last != nil {
+					last(e.id)
+				}
+				atomic.AddInt64(&st.len, -1)
+				evicted = append(evicted, e.metric())
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return evicted
+}
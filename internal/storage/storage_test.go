@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func counter(id string, delta int64) metric.Metric {
+	return metric.Metric{ID: id, MType: metric.MetricTypeCounter, Delta: delta}
+}
+
+func gauge(id string, value float64) metric.Metric {
+	return metric.Metric{ID: id, MType: metric.MetricTypeGauge, Value: value}
+}
+
+func TestPutAccumulate(t *testing.T) {
+	st := New(8)
+	const workers, rounds = 16, 1000
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				_, err := st.Put(counter("hits", 1), Options{Accumulate: true})
+				assert.NoError(t, err)
+				_, err = st.Put(counter("id"+strconv.Itoa(i%10), 2), Options{Accumulate: true})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s, ok := st.Get("hits")
+	require.True(t, ok)
+	assert.Equal(t, int64(workers*rounds), s.Delta)
+	for i := 0; i < 10; i++ {
+		s, ok := st.Get("id" + strconv.Itoa(i))
+		require.True(t, ok)
+		assert.Equal(t, int64(2*workers*rounds/10), s.Delta)
+	}
+	assert.Equal(t, 11, st.Len())
+}
+
+func TestSnapshotConsistent(t *testing.T) {
+	st := New(DefaultShards)
+	// a and b hash to different shards in general, the test holds either way
+	const workers, rounds = 8, 2000
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var a, b int64
+				for _, s := range st.Snapshot() {
+					switch s.ID {
+					case "a":
+						a = s.Delta
+					case "b":
+						b = s.Delta
+					}
+				}
+				if a < b {
+					t.Errorf("snapshot saw b=%d ahead of a=%d", b, a)
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				st.Put(counter("a", 1), Options{Accumulate: true})
+				st.Put(counter("b", 1), Options{Accumulate: true})
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	snap := st.Snapshot()
+	require.Len(t, snap, 2)
+	assert.Equal(t, "a", snap[0].ID)
+	assert.Equal(t, int64(workers*rounds), snap[0].Delta)
+	assert.Equal(t, int64(workers*rounds), snap[1].Delta)
+}
+
+func TestPutMax(t *testing.T) {
+	st := New(4)
+	const workers = 32
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	full := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			_, err := st.Put(gauge("g"+strconv.Itoa(w), 1), Options{Max: 10})
+			if errors.Is(err, ErrFull) {
+				mu.Lock()
+				full++
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(t, 10, st.Len())
+	assert.Equal(t, workers-10, full)
+
+	// updates of stored series pass the cap
+	stored := st.Snapshot()[0]
+	_, err := st.Put(gauge(stored.ID, 2), Options{Max: 10})
+	assert.NoError(t, err)
+
+	// a failed check stores nothing and frees the reserved slot
+	st = New(4)
+	boom := errors.New("boom")
+	_, err = st.Put(gauge("x", 1), Options{Max: 1, Check: func() error { return boom }})
+	assert.Equal(t, boom, err)
+	assert.Equal(t, 0, st.Len())
+	_, err = st.Put(gauge("y", 1), Options{Max: 1})
+	assert.NoError(t, err)
+}
+
+func TestPutChange(t *testing.T) {
+	st := New(4)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c, err := st.Put(counter("c", 3), Options{Accumulate: true, Now: now})
+	require.NoError(t, err)
+	assert.False(t, c.Existed)
+	assert.Equal(t, int64(3), c.New.Delta)
+
+	c, err = st.Put(counter("c", 4), Options{Accumulate: true, Now: now})
+	require.NoError(t, err)
+	assert.True(t, c.Existed)
+	assert.Equal(t, int64(3), c.Old.Delta)
+	assert.Equal(t, int64(7), c.New.Delta)
+
+	c, err = st.Put(counter("c", 1), Options{Now: now})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), c.New.Delta)
+
+	// the type changes
+	c, err = st.Put(gauge("c", 0.5), Options{Now: now})
+	require.NoError(t, err)
+	assert.True(t, c.Existed)
+	assert.Equal(t, metric.MetricTypeCounter, c.Old.MType)
+	s, ok := st.Get("c")
+	require.True(t, ok)
+	assert.Equal(t, metric.MetricTypeGauge, s.MType)
+	assert.Equal(t, 0.5, s.Value)
+	assert.Equal(t, now, s.Updated.UTC())
+	assert.Equal(t, 1, st.Len())
+}
+
+func TestDelete(t *testing.T) {
+	st := New(4)
+	a := gauge("cpu", 1)
+	a.Labels = metric.Labels{"host": "a"}
+	b := gauge("cpu", 2)
+	b.Labels = metric.Labels{"host": "b"}
+	st.Load(a, b, gauge("mem", 3))
+	assert.Equal(t, 2, st.Count("cpu"))
+
+	var gone []string
+	last := func(id string) { gone = append(gone, id) }
+	m, left, ok := st.Delete(a.Key(), last)
+	require.True(t, ok)
+	assert.Equal(t, 1.0, m.Value)
+	assert.Equal(t, 1, left)
+	assert.Empty(t, gone)
+
+	_, left, ok = st.Delete(b.Key(), last)
+	require.True(t, ok)
+	assert.Equal(t, 0, left)
+	assert.Equal(t, []string{"cpu"}, gone)
+
+	_, _, ok = st.Delete("nope", nil)
+	assert.False(t, ok)
+	assert.Equal(t, 1, st.Len())
+	assert.Equal(t, 0, st.Count("cpu"))
+}
+
+func TestScan(t *testing.T) {
+	st := New(4)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	st.Load(gauge("restored", 1))
+	st.Put(gauge("live", 1), Options{Now: now})
+	st.Put(gauge("stale", 1), Options{Now: now})
+	st.Put(gauge("gone", 1), Options{Now: now})
+
+	actions := map[string]Action{"restored": Touch, "live": Keep, "stale": MarkStale, "gone": Evict}
+	var gone []string
+	evicted := st.Scan(now.Add(time.Minute), func(s Series) Action {
+		return actions[s.ID]
+	}, func(id string) { gone = append(gone, id) })
+	require.Len(t, evicted, 1)
+	assert.Equal(t, []string{"gone"}, gone)
+	assert.Equal(t, "gone", evicted[0].ID)
+	assert.Equal(t, 3, st.Len())
+
+	s, _ := st.Get("restored")
+	assert.Equal(t, now.Add(time.Minute), s.Updated.UTC())
+	s, _ = st.Get("stale")
+	assert.True(t, s.Stale)
+	assert.Len(t, st.Metrics(false), 2)
+	assert.Len(t, st.Metrics(true), 3)
+
+	// an update revives a stale series
+	st.Put(gauge("stale", 2), Options{Now: now})
+	s, _ = st.Get("stale")
+	assert.False(t, s.Stale)
+}
+
+// mutexStore is the single mutex map the sharded store replaced
+type mutexStore struct {
+	mu     sync.Mutex
+	series map[string]metric.Metric
+}
+
+func (ms *mutexStore) put(m metric.Metric) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	key := m.Key()
+	if old, ok := ms.series[key]; ok && old.MType == m.MType && m.MType == metric.MetricTypeCounter {
+		m.Delta += old.Delta
+	}
+	ms.series[key] = m
+}
+
+func (ms *mutexStore) get(key string) (metric.Metric, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m, ok := ms.series[key]
+	return m, ok
+}
+
+const benchIDs = 1000
+
+func benchKeys() []metric.Metric {
+	list := make([]metric.Metric, benchIDs)
+	for i := range list {
+		list[i] = counter("metric"+strconv.Itoa(i), 1)
+	}
+	return list
+}
+
+func BenchmarkPut(b *testing.B) {
+	list := benchKeys()
+	b.Run("sharded", func(b *testing.B) {
+		st := New(DefaultShards)
+		st.Load(list...)
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				st.Put(list[i%benchIDs], Options{Accumulate: true})
+			}
+		})
+	})
+	b.Run("mutex", func(b *testing.B) {
+		ms := &mutexStore{series: make(map[string]metric.Metric)}
+		for _, m := range list {
+			ms.put(m)
+		}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				ms.put(list[i%benchIDs])
+			}
+		})
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	list := benchKeys()
+	keys := make([]string, len(list))
+	for i, m := range list {
+		keys[i] = m.Key()
+	}
+	b.Run("sharded", func(b *testing.B) {
+		st := New(DefaultShards)
+		st.Load(list...)
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				st.Get(keys[i%benchIDs])
+			}
+		})
+	})
+	b.Run("mutex", func(b *testing.B) {
+		ms := &mutexStore{series: make(map[string]metric.Metric)}
+		for _, m := range list {
+			ms.put(m)
+		}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				ms.get(keys[i%benchIDs])
+			}
+		})
+	})
+}
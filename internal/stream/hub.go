@@ -0,0 +1,193 @@
+package stream
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// Event is a single applied metric change
+type Event struct {
+	ID     uint64        `json:"id"`
+	Time   time.Time     `json:"time"`
+	Metric metric.Metric `json:"metric"`
+}
+
+// Filter selects the events a subscriber gets, an empty filter selects everything
+type Filter struct {
+	// IDs are path.Match patterns of metric IDs
+	IDs   []string
+	Types []metric.MetricType
+}
+
+// ParseFilter builds a filter from comma separated ID patterns and types
+func ParseFilter(ids, types string) Filter {
+	f := Filter{}
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			f.IDs = append(f.IDs, id)
+		}
+	}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.Types = append(f.Types, metric.MetricType(t))
+		}
+	}
+	return f
+}
+
+func (f Filter) Match(m metric.Metric) bool {
+	if len(f.Types) > 0 {
+		ok := false
+		for _, t := range f.Types {
+			if t == m.MType {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(f.IDs) == 0 {
+		return true
+	}
+	for _, p := range f.IDs {
+		if ok, _ := path.Match(p, m.ID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriber receives events on C until it unsubscribes or falls behind.
+// C is closed by the hub in both cases; Dropped tells them apart.
+type Subscriber struct {
+	C       <-chan Event
+	c       chan Event
+	filter  Filter
+	dropped bool
+}
+
+// Dropped reports whether the hub disconnected the subscriber for being too slow.
+// It is only meaningful after C has been closed.
+func (s *Subscriber) Dropped() bool {
+	return s.dropped
+}
+
+// Hub fans applied updates out to subscribers.
+// Each subscriber has its own buffer; one that lets it fill up is dropped
+// instead of slowing down the update handlers. The last events are kept
+// so that reconnecting clients can resume from their last event ID.
+type Hub struct {
+	mu      sync.Mutex
+	nextID  uint64
+	backlog []Event
+	head    int
+	size    int
+	buffer  int
+	subs    map[*Subscriber]struct{}
+}
+
+func NewHub(backlog, buffer int) *Hub {
+	if backlog < 0 {
+		backlog = 0
+	}
+	if buffer <= 0 {
+		buffer = 1
+	}
+	return &Hub{
+		// IDs continue from the start time, so an ID from before a restart
+		// is always older than the backlog and never mistaken for a current one
+		nextID:  uint64(time.Now().UnixNano()),
+		backlog: make([]Event, backlog),
+		buffer:  buffer,
+		subs:    make(map[*Subscriber]struct{}),
+	}
+}
+
+// Publish hands m to every matching subscriber
+func (h *Hub) Publish(m metric.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	ev := Event{ID: h.nextID, Time: time.Now(), Metric: m}
+	if len(h.backlog) > 0 {
+		h.backlog[(h.head+h.size)%len(h.backlog)] = ev
+		if h.size < len(h.backlog) {
+			h.size++
+		} else {
+			h.head = (h.head + 1) % len(h.backlog)
+		}
+	}
+
+	for s := range h.subs {
+		if !s.filter.Match(m) {
+			continue
+		}
+		select {
+		case s.c <- ev:
+		default:
+			s.dropped = true
+			h.remove(s)
+		}
+	}
+}
+
+// Subscribe registers a subscriber. With resume set, the kept events after
+// lastID are replayed first; complete is false when some of them are gone.
+func (h *Hub) Subscribe(f Filter, lastID uint64, resume bool) (s *Subscriber, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var replay []Event
+	complete = true
+	if resume {
+		if h.size > 0 && h.backlog[h.head].ID > lastID+1 {
+			complete = false
+		}
+		if h.size == 0 && h.nextID > lastID {
+			complete = false
+		}
+		for i := 0; i < h.size; i++ {
+			ev := h.backlog[(h.head+i)%len(h.backlog)]
+			if ev.ID > lastID && f.Match(ev.Metric) {
+				replay = append(replay, ev)
+			}
+		}
+	}
+
+	c := make(chan Event, h.buffer+len(replay))
+	for _, ev := range replay {
+		c <- ev
+	}
+	s = &Subscriber{C: c, c: c, filter: f}
+	h.subs[s] = struct{}{}
+	return s, complete
+}
+
+// Unsubscribe removes s and closes its channel
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+func (h *Hub) remove(s *Subscriber) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	close(s.c)
+}
+
+// Subscribers returns the number of connected subscribers
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
@@ -0,0 +1,79 @@
+package stream
+
+import (
+	"testing"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, v float64) metric.Metric {
+	return metric.Metric{ID: id, MType: metric.MetricTypeGauge, Value: v}
+}
+
+func TestFanOutWithFilter(t *testing.T) {
+	h := NewHub(16, 8)
+	all, _ := h.Subscribe(Filter{}, 0, false)
+	heap, _ := h.Subscribe(ParseFilter("Heap*", "gauge"), 0, false)
+	counters, _ := h.Subscribe(ParseFilter("", "counter"), 0, false)
+
+	h.Publish(gauge("HeapInuse", 1))
+	h.Publish(gauge("Alloc", 2))
+	h.Publish(metric.Metric{ID: "PollCount", MType: metric.MetricTypeCounter, Delta: 3})
+
+	assert.Len(t, all.C, 3)
+	require.Len(t, heap.C, 1)
+	assert.Equal(t, "HeapInuse", (<-heap.C).Metric.ID)
+	require.Len(t, counters.C, 1)
+	assert.Equal(t, "PollCount", (<-counters.C).Metric.ID)
+}
+
+func TestSlowConsumerIsDropped(t *testing.T) {
+	h := NewHub(16, 2)
+	slow, _ := h.Subscribe(Filter{}, 0, false)
+	fast, _ := h.Subscribe(Filter{}, 0, false)
+
+	for i := 0; i < 3; i++ {
+		h.Publish(gauge("Alloc", float64(i)))
+		<-fast.C
+	}
+
+	// the buffered events are still delivered before the close
+	assert.Equal(t, 0.0, (<-slow.C).Metric.Value)
+	assert.Equal(t, 1.0, (<-slow.C).Metric.Value)
+	_, ok := <-slow.C
+	assert.False(t, ok)
+	assert.True(t, slow.Dropped())
+	assert.Equal(t, 1, h.Subscribers())
+
+	h.Unsubscribe(fast)
+	_, ok = <-fast.C
+	assert.False(t, ok)
+	assert.False(t, fast.Dropped())
+}
+
+func TestResume(t *testing.T) {
+	h := NewHub(4, 8)
+	sub, _ := h.Subscribe(Filter{}, 0, false)
+	for i := 0; i < 3; i++ {
+		h.Publish(gauge("Alloc", float64(i)))
+	}
+	first := <-sub.C
+	h.Unsubscribe(sub)
+
+	// reconnect after the first event
+	sub, complete := h.Subscribe(Filter{}, first.ID, true)
+	assert.True(t, complete)
+	require.Len(t, sub.C, 2)
+	assert.Equal(t, first.ID+1, (<-sub.C).ID)
+	assert.Equal(t, first.ID+2, (<-sub.C).ID)
+
+	// the backlog holds 4 events, so the first ones are gone after 6
+	for i := 0; i < 3; i++ {
+		h.Publish(gauge("Alloc", float64(i)))
+	}
+	sub, complete = h.Subscribe(Filter{}, first.ID, true)
+	assert.False(t, complete)
+	assert.Len(t, sub.C, 4)
+}
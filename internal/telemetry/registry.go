@@ -0,0 +1,281 @@
+package telemetry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kind is the Prometheus type of a metric family
+type Kind string
+
+const (
+	KindCounter   Kind = "counter"
+	KindGauge     Kind = "gauge"
+	KindHistogram Kind = "histogram"
+)
+
+// DefaultBuckets suit latencies in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is a value read by a Func family at scrape time
+type Sample struct {
+	// LabelValues follow the label names of the family
+	LabelValues []string
+	Value       float64
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// counts holds the observations per bucket, not cumulated
+	counts []uint64
+	count  uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    Kind
+	labels  []string
+	buckets []float64
+	fn      func() []Sample
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("%s: got %d label values for %d labels", f.name, len(values), len(f.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), values...)}
+		if f.kind == KindHistogram {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Registry keeps the server's own metrics, apart from the metrics it stores
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+func (reg *Registry) register(f *family) *family {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.families[f.name]; ok {
+		panic("telemetry: " + f.name + " registered twice")
+	}
+	f.series = make(map[string]*series)
+	reg.families[f.name] = f
+	return f
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct{ f *family }
+
+// Counter is a counter with fixed label values
+type Counter struct {
+	f *family
+	s *series
+}
+
+// Counter registers a counter with the given label names
+func (reg *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{reg.register(&family{name: name, help: help, kind: KindCounter, labels: labels})}
+}
+
+// With returns the counter for the label values, in the order of the label names
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{f: v.f, s: v.f.with(values)}
+}
+
+// Add increases the counter, negative values are ignored
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.f.mu.Lock()
+	c.s.value += v
+	c.f.mu.Unlock()
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct{ f *family }
+
+// Gauge is a gauge with fixed label values
+type Gauge struct {
+	f *family
+	s *series
+}
+
+// Gauge registers a gauge with the given label names
+func (reg *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{reg.register(&family{name: name, help: help, kind: KindGauge, labels: labels})}
+}
+
+// With returns the gauge for the label values, in the order of the label names
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{f: v.f, s: v.f.with(values)}
+}
+
+func (g *Gauge) Set(v float64) {
+	g.f.mu.Lock()
+	g.s.value = v
+	g.f.mu.Unlock()
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct{ f *family }
+
+// Histogram is a histogram with fixed label values
+type Histogram struct {
+	f *family
+	s *series
+}
+
+// Histogram registers a histogram with the given upper bounds, DefaultBuckets when nil
+func (reg *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{reg.register(&family{name: name, help: help, kind: KindHistogram, labels: labels, buckets: buckets})}
+}
+
+// With returns the histogram for the label values, in the order of the label names
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{f: v.f, s: v.f.with(values)}
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.f.buckets, v)
+	h.f.mu.Lock()
+	h.s.counts[i]++
+	h.s.count++
+	h.s.value += v
+	h.f.mu.Unlock()
+}
+
+// Func registers a counter or gauge whose samples fn reads at scrape time
+func (reg *Registry) Func(name, help string, kind Kind, fn func() []Sample, labels ...string) {
+	reg.register(&family{name: name, help: help, kind: kind, labels: labels, fn: fn})
+}
+
+// WriteText writes every family in the Prometheus text format, ordered by name
+func (reg *Registry) WriteText(w io.Writer) error {
+	reg.mu.Lock()
+	families := make([]*family, 0, len(reg.families))
+	for _, f := range reg.families {
+		families = append(families, f)
+	}
+	reg.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (f *family) write(w *bufio.Writer) {
+	var list []series
+	if f.fn != nil {
+		for _, s := range f.fn() {
+			list = append(list, series{labelValues: s.LabelValues, value: s.Value})
+		}
+	} else {
+		f.mu.Lock()
+		for _, s := range f.series {
+			s := *s
+			s.counts = append([]uint64(nil), s.counts...)
+			list = append(list, s)
+		}
+		f.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].labelValues, "\xff") < strings.Join(list[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range list {
+		if f.kind != KindHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labels(f.labels, s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labels(f.labels, s.labelValues, formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labels(f.labels, s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels(f.labels, s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels(f.labels, s.labelValues, ""), s.count)
+	}
+}
+
+// labels renders a label set, le is added for histogram buckets
+func labels(names, values []string, le string) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escape(values[i], true))
+	}
+	if le != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "le=\"%s\"", le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,79 @@
+package telemetry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteText(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("requests_total", "Requests.", "path")
+	c.With(`/a"b`).Inc()
+	c.With("/").Add(2)
+	c.With("/").Add(-5)
+	reg.Gauge("temperature", "Line\nbreak.").With().Set(21.5)
+	h := reg.Histogram("latency_seconds", "Latency.", []float64{1, 0.1}, "op")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.With("save").Observe(v)
+	}
+	reg.Func("series", "Series.", KindGauge, func() []Sample {
+		return []Sample{{LabelValues: []string{"b"}, Value: 2}, {LabelValues: []string{"a"}, Value: 1}}
+	}, "tenant")
+
+	var b strings.Builder
+	require.NoError(t, reg.WriteText(&b))
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="save",le="0.1"} 2
+latency_seconds_bucket{op="save",le="1"} 3
+latency_seconds_bucket{op="save",le="+Inf"} 4
+latency_seconds_sum{op="save"} 3.65
+latency_seconds_count{op="save"} 4
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{path="/"} 2
+requests_total{path="/a\"b"} 1
+# HELP series Series.
+# TYPE series gauge
+series{tenant="a"} 1
+series{tenant="b"} 2
+# HELP temperature Line\nbreak.
+# TYPE temperature gauge
+temperature 21.5
+`, b.String())
+
+	assert.Panics(t, func() { reg.Gauge("temperature", "") })
+	assert.Panics(t, func() { c.With("a", "b") })
+}
+
+func TestMiddleware(t *testing.T) {
+	srv := NewServer(NewRegistry())
+	mux := chi.NewRouter()
+	mux.Use(srv.Middleware)
+	mux.Route("/value", func(mux chi.Router) {
+		mux.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+		mux.Get("/{type}/{id}", func(w http.ResponseWriter, r *http.Request) {
+			if chi.URLParam(r, "id") == "missing" {
+				http.NotFound(w, r)
+			}
+		})
+	})
+	for _, url := range []string{"/value/", "/value/gauge/a", "/value/gauge/b", "/value/gauge/missing", "/nope"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+
+	var b strings.Builder
+	require.NoError(t, srv.Registry.WriteText(&b))
+	out := b.String()
+	assert.Contains(t, out, `metrics_http_requests_total{route="/value/{type}/{id}",method="GET",status="200"} 2`)
+	assert.Contains(t, out, `metrics_http_requests_total{route="/value/{type}/{id}",method="GET",status="404"} 1`)
+	assert.Contains(t, out, `metrics_http_requests_total{route="/value/",method="GET",status="200"} 1`)
+	assert.Contains(t, out, `metrics_http_requests_total{route="unmatched",method="GET",status="404"} 1`)
+	assert.Contains(t, out, `metrics_http_request_duration_seconds_count{route="/value/{type}/{id}",method="GET"} 3`)
+}
@@ -0,0 +1,82 @@
+package telemetry
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Server holds the metrics the server keeps about itself
+type Server struct {
+	Registry *Registry
+
+	Requests *CounterVec
+	Latency  *HistogramVec
+
+	Updates         *CounterVec
+	PersistDuration *HistogramVec
+	PersistErrors   *CounterVec
+	RestoredSeries  *GaugeVec
+	RestoreDuration *GaugeVec
+}
+
+// NewServer registers the server metrics in reg
+func NewServer(reg *Registry) *Server {
+	return &Server{
+		Registry: reg,
+		Requests: reg.Counter("metrics_http_requests_total",
+			"HTTP requests by route, method and status.", "route", "method", "status"),
+		Latency: reg.Histogram("metrics_http_request_duration_seconds",
+			"HTTP request latency by route and method.", nil, "route", "method"),
+		Updates: reg.Counter("metrics_updates_total",
+			"Accepted metric updates by tenant and type.", "tenant", "type"),
+		PersistDuration: reg.Histogram("metrics_persist_duration_seconds",
+			"Time spent writing the store file by tenant and operation.", nil, "tenant", "op"),
+		PersistErrors: reg.Counter("metrics_persist_errors_total",
+			"Failed writes of the store file by tenant and operation.", "tenant", "op"),
+		RestoredSeries: reg.Gauge("metrics_restore_series",
+			"Series restored from the store file at startup.", "tenant"),
+		RestoreDuration: reg.Gauge("metrics_restore_duration_seconds",
+			"Time spent restoring the store file at startup.", "tenant"),
+	}
+}
+
+// Middleware counts the requests and their latency per route pattern.
+// Requests matching no route share the "unmatched" route.
+func (srv *Server) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			// subrouter roots come out as "/stream//"
+			route = rctx.RoutePattern()
+			for strings.Contains(route, "//") {
+				route = strings.ReplaceAll(route, "//", "/")
+			}
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		srv.Requests.With(route, r.Method, strconv.Itoa(status)).Inc()
+		srv.Latency.With(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Handler serves the registry in the Prometheus text format
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := reg.WriteText(w); err != nil {
+			log.Println(err)
+		}
+	})
+}
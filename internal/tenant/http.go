@@ -0,0 +1,170 @@
+package tenant
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/validate"
+)
+
+// TokenHeader carries the tenant token, a bearer token is accepted as well
+const TokenHeader = "X-Tenant-Token"
+
+func tokenFromRequest(r *http.Request) string {
+	if tok := r.Header.Get(TokenHeader); tok != "" {
+		return tok
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// Middleware resolves the tenant of the request from its token.
+// With a single tenant every request belongs to it and no token is needed.
+func (reg *Registry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !reg.Multi() {
+			svc, _ := reg.Service(Default)
+			next.ServeHTTP(w, r.WithContext(WithService(r.Context(), Default, svc)))
+			return
+		}
+		name, svc, ok := reg.Resolve(tokenFromRequest(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			apierr.Error(w, "missing or unknown tenant token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithService(r.Context(), name, svc)))
+	})
+}
+
+// Handle adapts a service method expression, e.g. (*config.Service).GetMetricsAll,
+// into a handler running against the service of the request's tenant
+func Handle(h func(*config.Service, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, svc, ok := FromContext(r.Context())
+		if !ok {
+			apierr.Error(w, "no tenant", http.StatusInternalServerError)
+			return
+		}
+		h(svc, w, r)
+	}
+}
+
+// AdminOnly guards the admin routes with a static admin token.
+// An empty token disables them.
+func AdminOnly(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got := tokenFromRequest(r)
+			if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				apierr.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type tokenResponse struct {
+	Tenant string `json:"tenant"`
+	ID     string `json:"id"`
+	// Token is the secret, it is only ever shown in this response
+	Token string `json:"token"`
+}
+
+type tenantView struct {
+	Name             string   `json:"name"`
+	MaxMetrics       int      `json:"maxMetrics"`
+	UpdatesPerSecond float64  `json:"updatesPerSecond"`
+	Tokens           []string `json:"tokens"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func adminError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrUnknownTenant, ErrUnknownToken:
+		apierr.Error(w, err.Error(), http.StatusNotFound)
+	case ErrTenantExists:
+		apierr.Error(w, err.Error(), http.StatusConflict)
+	case ErrInvalidName:
+		apierr.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println(err)
+		apierr.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// GetTenants lists tenants and their token IDs via GET /admin/tenants
+func (reg *Registry) GetTenants(w http.ResponseWriter, r *http.Request) {
+	list := reg.List()
+	views := make([]tenantView, 0, len(list))
+	for _, t := range list {
+		v := tenantView{Name: t.Name, MaxMetrics: t.MaxMetrics, UpdatesPerSecond: t.UpdatesPerSecond, Tokens: []string{}}
+		for _, tok := range t.Tokens {
+			v.Tokens = append(v.Tokens, tok.ID)
+		}
+		views = append(views, v)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// PostTenant creates a tenant and its first token via POST /admin/tenants
+// The body holds name, maxMetrics and updatesPerSecond.
+func (reg *Registry) PostTenant(w http.ResponseWriter, r *http.Request) {
+	if !reg.Multi() {
+		apierr.Error(w, "tenancy is disabled", http.StatusNotFound)
+		return
+	}
+	t := Tenant{}
+	// the admin API is strict, a mistyped quota must not go unnoticed
+	dec := validate.Decoder{DisallowUnknownFields: true}
+	if verr := dec.Decode(dec.Body(w, r), &t); verr != nil {
+		apierr.Write(w, verr)
+		return
+	}
+	tok, secret, err := reg.Create(t)
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, tokenResponse{Tenant: t.Name, ID: tok.ID, Token: secret})
+}
+
+// PostToken issues another token via POST /admin/tenants/{name}/tokens
+func (reg *Registry) PostToken(w http.ResponseWriter, r *http.Request) {
+	if !reg.Multi() {
+		apierr.Error(w, "tenancy is disabled", http.StatusNotFound)
+		return
+	}
+	name := chi.URLParam(r, "name")
+	tok, secret, err := reg.Issue(name)
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, tokenResponse{Tenant: name, ID: tok.ID, Token: secret})
+}
+
+// DeleteToken revokes a token via DELETE /admin/tenants/{name}/tokens/{id}
+func (reg *Registry) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	if err := reg.Revoke(chi.URLParam(r, "name"), chi.URLParam(r, "id")); err != nil {
+		adminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,325 @@
+package tenant
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+)
+
+// Default is the tenant every request belongs to when tenancy is disabled
+const Default = "default"
+
+var (
+	ErrUnknownTenant = errors.New("unknown tenant")
+	ErrTenantExists  = errors.New("tenant already exists")
+	ErrUnknownToken  = errors.New("unknown token")
+	ErrInvalidName   = errors.New("tenant name must match [a-zA-Z0-9_-]{1,64}")
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Token is an API token of a tenant. Only the SHA-256 hash of the secret is kept.
+type Token struct {
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// Tenant is an isolated keyspace with its own tokens and quotas
+type Tenant struct {
+	Name string `json:"name"`
+	// MaxMetrics caps the number of series, zero means no cap
+	MaxMetrics int `json:"maxMetrics"`
+	// UpdatesPerSecond caps the update rate, zero means no cap
+	UpdatesPerSecond float64 `json:"updatesPerSecond"`
+	Tokens           []Token `json:"tokens"`
+}
+
+// Factory builds the service holding the data of a tenant
+type Factory func(t Tenant) *config.Service
+
+type entry struct {
+	Tenant
+	svc *config.Service
+}
+
+// Registry maps tokens to tenants and keeps one service per tenant.
+// Tenants are saved to a JSON file on every change.
+type Registry struct {
+	mu      sync.RWMutex
+	path    string
+	factory Factory
+	tenants map[string]*entry
+	byHash  map[string]string
+	// creating holds the names of tenants whose service is being built
+	creating map[string]bool
+}
+
+// NewSingle returns a registry with only the default tenant, which every request belongs to
+func NewSingle(factory Factory) *Registry {
+	reg := &Registry{
+		factory:  factory,
+		tenants:  make(map[string]*entry),
+		byHash:   make(map[string]string),
+		creating: make(map[string]bool),
+	}
+	reg.add(Tenant{Name: Default})
+	return reg
+}
+
+// Load reads the tenants file, a missing file starts with the default tenant only
+func Load(path string, factory Factory) (*Registry, error) {
+	reg := &Registry{
+		path:     path,
+		factory:  factory,
+		tenants:  make(map[string]*entry),
+		byHash:   make(map[string]string),
+		creating: make(map[string]bool),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tenants []Tenant `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	for _, t := range file.Tenants {
+		if !validName.MatchString(t.Name) {
+			return nil, fmt.Errorf("%s: %q: %w", path, t.Name, ErrInvalidName)
+		}
+		reg.add(t)
+	}
+	// the default tenant always exists, it keeps the server wide store file
+	if _, ok := reg.tenants[Default]; !ok {
+		reg.add(Tenant{Name: Default})
+	}
+	return reg, nil
+}
+
+// Multi reports whether requests have to present a tenant token
+func (reg *Registry) Multi() bool {
+	return reg.path != ""
+}
+
+func (reg *Registry) add(t Tenant) *entry {
+	return reg.insert(t, reg.factory(t))
+}
+
+func (reg *Registry) insert(t Tenant, svc *config.Service) *entry {
+	e := &entry{Tenant: t, svc: svc}
+	reg.tenants[t.Name] = e
+	for _, tok := range t.Tokens {
+		reg.byHash[tok.Hash] = t.Name
+	}
+	return e
+}
+
+func (reg *Registry) save() error {
+	if reg.path == "" {
+		return nil
+	}
+	var file struct {
+		Tenants []Tenant `json:"tenants"`
+	}
+	for _, e := range reg.tenants {
+		file.Tenants = append(file.Tenants, e.Tenant)
+	}
+	sort.Slice(file.Tenants, func(i, j int) bool { return file.Tenants[i].Name < file.Tenants[j].Name })
+	data, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write aside and rename, so a crash never leaves a truncated file
+	tmp := reg.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, reg.path)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken draws the ID apart from the secret, IDs are listed and logged
+func newToken() (id, secret string, err error) {
+	buf := make([]byte, 4+24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(buf[:4]), hex.EncodeToString(buf[4:]), nil
+}
+
+// Create adds a tenant and returns its first token secret
+func (reg *Registry) Create(t Tenant) (Token, string, error) {
+	if !validName.MatchString(t.Name) {
+		return Token{}, "", ErrInvalidName
+	}
+	reg.mu.Lock()
+	if _, ok := reg.tenants[t.Name]; ok || reg.creating[t.Name] {
+		reg.mu.Unlock()
+		return Token{}, "", ErrTenantExists
+	}
+	reg.creating[t.Name] = true
+	reg.mu.Unlock()
+
+	// the factory opens files, lookups of other tenants go on meanwhile
+	t.Tokens = nil
+	svc := reg.factory(t)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.creating, t.Name)
+	e := reg.insert(t, svc)
+	tok, secret, err := reg.issue(e)
+	if err != nil {
+		delete(reg.tenants, t.Name)
+		return Token{}, "", err
+	}
+	return tok, secret, nil
+}
+
+// Issue creates another token for the tenant and returns its secret
+func (reg *Registry) Issue(name string) (Token, string, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	e, ok := reg.tenants[name]
+	if !ok {
+		return Token{}, "", ErrUnknownTenant
+	}
+	return reg.issue(e)
+}
+
+func (reg *Registry) issue(e *entry) (Token, string, error) {
+	id, secret, err := newToken()
+	if err != nil {
+		return Token{}, "", err
+	}
+	tok := Token{ID: id, Hash: hashToken(secret), Created: time.Now().UTC()}
+	e.Tokens = append(e.Tokens, tok)
+	reg.byHash[tok.Hash] = e.Name
+	if err := reg.save(); err != nil {
+		e.Tokens = e.Tokens[:len(e.Tokens)-1]
+		delete(reg.byHash, tok.Hash)
+		return Token{}, "", err
+	}
+	return tok, secret, nil
+}
+
+// Revoke removes a token of the tenant, requests using it are rejected right away
+func (reg *Registry) Revoke(name, id string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	e, ok := reg.tenants[name]
+	if !ok {
+		return ErrUnknownTenant
+	}
+	for i, tok := range e.Tokens {
+		if tok.ID == id {
+			e.Tokens = append(e.Tokens[:i:i], e.Tokens[i+1:]...)
+			delete(reg.byHash, tok.Hash)
+			return reg.save()
+		}
+	}
+	return ErrUnknownToken
+}
+
+// List returns the tenants ordered by name
+func (reg *Registry) List() []Tenant {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	list := make([]Tenant, 0, len(reg.tenants))
+	for _, e := range reg.tenants {
+		list = append(list, e.Tenant)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Service returns the service of the named tenant
+func (reg *Registry) Service(name string) (*config.Service, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	e, ok := reg.tenants[name]
+	if !ok {
+		return nil, false
+	}
+	return e.svc, true
+}
+
+// Each calls f for the service of every tenant
+func (reg *Registry) Each(f func(name string, svc *config.Service)) {
+	reg.mu.RLock()
+	list := make([]*entry, 0, len(reg.tenants))
+	for _, e := range reg.tenants {
+		list = append(list, e)
+	}
+	reg.mu.RUnlock()
+	for _, e := range list {
+		f(e.Name, e.svc)
+	}
+}
+
+// Resolve returns the tenant owning the token secret
+func (reg *Registry) Resolve(secret string) (string, *config.Service, bool) {
+	if secret == "" {
+		return "", nil, false
+	}
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	name, ok := reg.byHash[hashToken(secret)]
+	if !ok {
+		return "", nil, false
+	}
+	return name, reg.tenants[name].svc, true
+}
+
+// StoreFile derives the persistence file of a tenant from the server one,
+// e.g. /tmp/metrics.json becomes /tmp/metrics.team-a.json.
+// The default tenant keeps the server file.
+func StoreFile(base, name string) string {
+	if base == "" || name == Default {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "." + name + ext
+}
+
+type ctxKey struct{}
+
+type scope struct {
+	name string
+	svc  *config.Service
+}
+
+// WithService returns a context carrying the tenant and its service
+func WithService(ctx context.Context, name string, svc *config.Service) context.Context {
+	return context.WithValue(ctx, ctxKey{}, scope{name: name, svc: svc})
+}
+
+// FromContext returns the tenant the request was resolved to
+func FromContext(ctx context.Context) (string, *config.Service, bool) {
+	sc, ok := ctx.Value(ctxKey{}).(scope)
+	return sc.name, sc.svc, ok
+}
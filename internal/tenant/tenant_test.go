@@ -0,0 +1,130 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFactory(t Tenant) *config.Service {
+	s := config.NewService(&config.ConfigServer{})
+	s.MaxMetrics = t.MaxMetrics
+	return s
+}
+
+func TestRegistryTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	reg, err := Load(path, testFactory)
+	require.NoError(t, err)
+	assert.True(t, reg.Multi())
+
+	_, _, err = reg.Create(Tenant{Name: "bad name"})
+	assert.Equal(t, ErrInvalidName, err)
+
+	tok, secret, err := reg.Create(Tenant{Name: "team-a", MaxMetrics: 10})
+	require.NoError(t, err)
+	// the ID is listed, it gives nothing of the secret away
+	assert.Len(t, tok.ID, 8)
+	assert.False(t, strings.Contains(secret, tok.ID))
+	_, _, err = reg.Create(Tenant{Name: "team-a"})
+	assert.Equal(t, ErrTenantExists, err)
+
+	name, svc, ok := reg.Resolve(secret)
+	require.True(t, ok)
+	assert.Equal(t, "team-a", name)
+	assert.Equal(t, 10, svc.MaxMetrics)
+	def, _ := reg.Service(Default)
+	assert.NotSame(t, def, svc)
+
+	_, secret2, err := reg.Issue("team-a")
+	require.NoError(t, err)
+
+	// tenants and token hashes survive a restart, secrets are never stored
+	reg, err = Load(path, testFactory)
+	require.NoError(t, err)
+	list := reg.List()
+	require.Len(t, list, 2)
+	assert.Equal(t, "team-a", list[1].Name)
+	assert.Len(t, list[1].Tokens, 2)
+	assert.NotEqual(t, secret, list[1].Tokens[0].Hash)
+
+	require.NoError(t, reg.Revoke("team-a", tok.ID))
+	_, _, ok = reg.Resolve(secret)
+	assert.False(t, ok)
+	_, _, ok = reg.Resolve(secret2)
+	assert.True(t, ok)
+	assert.Equal(t, ErrUnknownToken, reg.Revoke("team-a", tok.ID))
+}
+
+func TestMiddleware(t *testing.T) {
+	var got string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _, _ = FromContext(r.Context())
+	})
+
+	single := NewSingle(testFactory)
+	rec := httptest.NewRecorder()
+	single.Middleware(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, Default, got)
+
+	reg, err := Load(filepath.Join(t.TempDir(), "tenants.json"), testFactory)
+	require.NoError(t, err)
+	_, secret, err := reg.Create(Tenant{Name: "team-a"})
+	require.NoError(t, err)
+
+	got = ""
+	rec = httptest.NewRecorder()
+	reg.Middleware(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Empty(t, got)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	rec = httptest.NewRecorder()
+	reg.Middleware(next).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "team-a", got)
+}
+
+func TestStoreFile(t *testing.T) {
+	assert.Equal(t, "/tmp/db.json", StoreFile("/tmp/db.json", Default))
+	assert.Equal(t, "/tmp/db.team-a.json", StoreFile("/tmp/db.json", "team-a"))
+	assert.Equal(t, "", StoreFile("", "team-a"))
+}
+
+func TestCreateOutsideLock(t *testing.T) {
+	building, release := make(chan struct{}), make(chan struct{})
+	reg, err := Load(filepath.Join(t.TempDir(), "tenants.json"), func(t Tenant) *config.Service {
+		if t.Name == "slow" {
+			close(building)
+			<-release
+		}
+		return testFactory(t)
+	})
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, _, err := reg.Create(Tenant{Name: "slow"})
+		done <- err
+	}()
+	<-building
+
+	// lookups go on while the service is built, the name is taken already
+	_, ok := reg.Service(Default)
+	assert.True(t, ok)
+	_, _, err = reg.Create(Tenant{Name: "slow"})
+	assert.Equal(t, ErrTenantExists, err)
+
+	close(release)
+	require.NoError(t, <-done)
+	_, ok = reg.Service("slow")
+	assert.True(t, ok)
+}
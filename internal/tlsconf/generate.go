@@ -0,0 +1,122 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Pair is a certificate with its private key
+type Pair struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// NewCA generates a self-signed CA valid for ttl
+func NewCA(cn string, ttl time.Duration) (*Pair, error) {
+	tmpl, err := template(cn, ttl)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	return sign(tmpl, nil)
+}
+
+// Server issues a server certificate for hosts, IPs and DNS names alike
+func (ca *Pair) Server(cn string, hosts []string, ttl time.Duration) (*Pair, error) {
+	tmpl, err := template(cn, ttl)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return sign(tmpl, ca)
+}
+
+// Client issues a client certificate, cn becomes the agent identity
+func (ca *Pair) Client(cn string, ttl time.Duration) (*Pair, error) {
+	tmpl, err := template(cn, ttl)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return sign(tmpl, ca)
+}
+
+// CertPEM encodes the certificate
+func (p *Pair) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.Cert.Raw})
+}
+
+// KeyPEM encodes the private key
+func (p *Pair) KeyPEM() ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(p.Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// Write saves the certificate and the key, the key readable by the owner only
+func (p *Pair) Write(certFile, keyFile string) error {
+	key, err := p.KeyPEM()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, p.CertPEM(), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, key, 0600)
+}
+
+func template(cn string, ttl time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(ttl),
+	}, nil
+}
+
+// sign self-signs tmpl when ca is nil
+func sign(tmpl *x509.Certificate, ca *Pair) (*Pair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	parent, parentKey := tmpl, key
+	if ca != nil {
+		parent, parentKey = ca.Cert, ca.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Pair{Cert: cert, Key: key}, nil
+}
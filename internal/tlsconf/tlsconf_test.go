@@ -0,0 +1,73 @@
+package tlsconf
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/agents"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	ca, err := NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, ca.Write(path("ca.pem"), path("ca-key.pem")))
+	server, err := ca.Server("server", []string{"127.0.0.1", "localhost"}, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, server.Write(path("server.pem"), path("server-key.pem")))
+	client, err := ca.Client("agent-1", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, client.Write(path("agent.pem"), path("agent-key.pem")))
+
+	conf, err := Server(path("server.pem"), path("server-key.pem"), path("ca.pem"))
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(agents.CertIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(agents.HeaderID)))
+	})))
+	ts.TLS = conf
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(conf *clientFiles) (string, error) {
+		tc, err := Client(conf.ca, conf.cert, conf.key)
+		require.NoError(t, err)
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set(agents.HeaderID, "spoofed")
+		resp, err := c.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// the certificate's common name wins over the header
+	id, err := get(&clientFiles{path("ca.pem"), path("agent.pem"), path("agent-key.pem")})
+	require.NoError(t, err)
+	assert.Equal(t, "agent-1", id)
+
+	// no client certificate
+	_, err = get(&clientFiles{ca: path("ca.pem")})
+	assert.Error(t, err)
+
+	// server not trusted
+	_, err = get(&clientFiles{cert: path("agent.pem"), key: path("agent-key.pem")})
+	assert.Error(t, err)
+
+	_, err = LoadPool(path("agent-key.pem"))
+	assert.ErrorIs(t, err, ErrNoCerts)
+}
+
+type clientFiles struct {
+	ca, cert, key string
+}
@@ -0,0 +1,272 @@
+package validate
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/goethesum/-go-musthave-devops-tpl/internal/apierr"
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+)
+
+// Codes of validation errors
+const (
+	CodeMalformedJSON = "malformed_json"
+	CodeUnknownField  = "unknown_field"
+	CodeInvalidID     = "invalid_id"
+	CodeMissingType   = "missing_type"
+	CodeUnknownType   = "unknown_type"
+	CodeMissingDelta  = "missing_delta"
+	CodeMissingValue  = "missing_value"
+	CodeInvalidValue  = "invalid_value"
+	CodeInvalidLabel  = "invalid_label"
+)
+
+const (
+	MaxIDLength         = 255
+	MaxLabels           = 32
+	MaxLabelValueLength = 1024
+	// DefaultMaxBodyBytes bounds request bodies unless configured otherwise
+	DefaultMaxBodyBytes = 1 << 20
+)
+
+var (
+	validID    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.:/-]*$`)
+	validLabel = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+)
+
+func invalid(code, field, format string, args ...interface{}) *apierr.Err {
+	return apierr.New(http.StatusBadRequest, code, field, fmt.Sprintf(format, args...))
+}
+
+// ID checks a metric ID: 1 to 255 letters, digits, "_", ".", ":", "/" or "-",
+// not starting with a digit or punctuation other than "_"
+func ID(id string) *apierr.Err {
+	switch {
+	case id == "":
+		return invalid(CodeInvalidID, "id", "id is required")
+	case len(id) > MaxIDLength:
+		return invalid(CodeInvalidID, "id", "id is longer than %d bytes", MaxIDLength)
+	case !validID.MatchString(id):
+		return invalid(CodeInvalidID, "id", "id %q has characters outside [A-Za-z0-9_.:/-] or doesn't start with a letter or _", id)
+	}
+	return nil
+}
+
+// Type checks that t is a known metric type
+func Type(t metric.MetricType) *apierr.Err {
+	switch t {
+	case metric.MetricTypeGauge, metric.MetricTypeCounter:
+		return nil
+	case "":
+		return invalid(CodeMissingType, "type", "type is required")
+	}
+	return apierr.New(http.StatusNotImplemented, CodeUnknownType, "type", fmt.Sprintf("unknown type %q, want gauge or counter", t))
+}
+
+// Labels checks label names and value sizes
+func Labels(l metric.Labels) *apierr.Err {
+	if len(l) > MaxLabels {
+		return invalid(CodeInvalidLabel, "labels", "more than %d labels", MaxLabels)
+	}
+	for k, v := range l {
+		if !validLabel.MatchString(k) || len(k) > MaxIDLength {
+			return invalid(CodeInvalidLabel, "labels."+k, "label name %q is not valid", k)
+		}
+		if len(v) > MaxLabelValueLength {
+			return invalid(CodeInvalidLabel, "labels."+k, "label value is longer than %d bytes", MaxLabelValueLength)
+		}
+	}
+	return nil
+}
+
+// Metric checks everything a stored metric must satisfy
+func Metric(m metric.Metric) *apierr.Err {
+	if err := ID(m.ID); err != nil {
+		return err
+	}
+	if err := Type(m.MType); err != nil {
+		return err
+	}
+	if m.MType == metric.MetricTypeGauge && (math.IsNaN(m.Value) || math.IsInf(m.Value, 0)) {
+		return invalid(CodeInvalidValue, "value", "value must be a finite number")
+	}
+	return Labels(m.Labels)
+}
+
+// Decoder reads JSON request bodies
+type Decoder struct {
+	// MaxBodyBytes bounds the body, DefaultMaxBodyBytes when zero
+	MaxBodyBytes int64
+	// DisallowUnknownFields rejects fields the API doesn't know
+	DisallowUnknownFields bool
+}
+
+// Body limits the body of r to the configured size
+func (d Decoder) Body(w http.ResponseWriter, r *http.Request) io.ReadCloser {
+	max := d.MaxBodyBytes
+	if max <= 0 {
+		max = DefaultMaxBodyBytes
+	}
+	return http.MaxBytesReader(w, r.Body, max)
+}
+
+// Decode reads a JSON value from body into v
+func (d Decoder) Decode(body io.Reader, v interface{}) *apierr.Err {
+	dec := json.NewDecoder(body)
+	if d.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return jsonError(err)
+	}
+	return nil
+}
+
+// jsonError turns a decoding error into its API error
+func jsonError(err error) *apierr.Err {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	msg := err.Error()
+	switch {
+	// http.MaxBytesReader has no error type of its own before Go 1.19
+	case strings.Contains(msg, "request body too large"):
+		return apierr.New(http.StatusRequestEntityTooLarge, apierr.CodeBodyTooLarge, "", "request body is too large")
+	case errors.As(err, &typ):
+		return invalid(CodeInvalidValue, typ.Field, "%s must be a %s, not %s", typ.Field, typ.Type, typ.Value)
+	case strings.HasPrefix(msg, "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`)
+		return invalid(CodeUnknownField, field, "unknown field %q", field)
+	case errors.As(err, &syntax):
+		return invalid(CodeMalformedJSON, "", "malformed JSON at offset %d: %s", syntax.Offset, msg)
+	case err == io.EOF:
+		return invalid(CodeMalformedJSON, "", "empty body")
+	}
+	return invalid(CodeMalformedJSON, "", "malformed JSON: %s", msg)
+}
+
+// update is the wire form of a metric, pointers tell missing values from zeros
+type update struct {
+	ID     string            `json:"id"`
+	MType  metric.MetricType `json:"type"`
+	Delta  *int64            `json:"delta"`
+	Value  *float64          `json:"value"`
+	Labels metric.Labels     `json:"labels"`
+	Unit   string            `json:"unit"`
+	Help   string            `json:"help"`
+}
+
+// metric checks presence and converts u, prefix names the field in errors
+func (u update) metric(prefix string) (metric.Metric, *apierr.Err) {
+	m := metric.Metric{ID: u.ID, MType: u.MType, Labels: u.Labels, Unit: u.Unit, Help: u.Help}
+	switch u.MType {
+	case metric.MetricTypeCounter:
+		if u.Delta == nil {
+			return m, invalid(CodeMissingDelta, prefix+"delta", "counters need a delta")
+		}
+		m.Delta = *u.Delta
+	case metric.MetricTypeGauge:
+		if u.Value == nil {
+			return m, invalid(CodeMissingValue, prefix+"value", "gauges need a value")
+		}
+		m.Value = *u.Value
+	}
+	if err := Metric(m); err != nil {
+		if prefix != "" {
+			err.Field = prefix + err.Field
+		}
+		return m, err
+	}
+	return m, nil
+}
+
+// Update reads and checks a single metric update
+func (d Decoder) Update(w http.ResponseWriter, r *http.Request) (metric.Metric, *apierr.Err) {
+	u := update{}
+	if err := d.Decode(d.Body(w, r), &u); err != nil {
+		return metric.Metric{}, err
+	}
+	return u.metric("")
+}
+
+// Batch reads and checks a list of metric updates, an error names the offending index
+func (d Decoder) Batch(w http.ResponseWriter, r *http.Request) ([]metric.Metric, *apierr.Err) {
+	var list []update
+	if err := d.Decode(d.Body(w, r), &list); err != nil {
+		return nil, err
+	}
+	batch := make([]metric.Metric, 0, len(list))
+	for i, u := range list {
+		m, err := u.metric(fmt.Sprintf("[%d].", i))
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, m)
+	}
+	return batch, nil
+}
+
+// Lookup reads the id, type and labels identifying a metric
+func (d Decoder) Lookup(w http.ResponseWriter, r *http.Request) (metric.Metric, *apierr.Err) {
+	u := update{}
+	if err := d.Decode(d.Body(w, r), &u); err != nil {
+		return metric.Metric{}, err
+	}
+	m := metric.Metric{ID: u.ID, MType: u.MType, Labels: u.Labels}
+	if err := ID(m.ID); err != nil {
+		return m, err
+	}
+	if err := Type(m.MType); err != nil {
+		// reading an unknown type is a plain bad request
+		err.Status = http.StatusBadRequest
+		return m, err
+	}
+	return m, nil
+}
+
+// URL reads and checks an update from the /update/{type}/{id}/{value} path
+func URL(r *http.Request) (metric.Metric, *apierr.Err) {
+	m, err := metric.ParseMetricEntityFromURL(r)
+	if err != nil {
+		switch err {
+		case metric.ErrMissmatchedType:
+			return m, apierr.New(http.StatusNotImplemented, CodeUnknownType, "type", "Wrong type")
+		case metric.ErrDeltaAssign:
+			return m, invalid(CodeInvalidValue, "value", "Wrong delta")
+		case metric.ErrValueAssign:
+			return m, invalid(CodeInvalidValue, "value", "Wrong value")
+		}
+		return m, apierr.New(http.StatusBadRequest, apierr.CodeBadRequest, "", err.Error())
+	}
+	if verr := Metric(m); verr != nil {
+		return m, verr
+	}
+	return m, nil
+}
+
+// Gunzip inflates request bodies sent with Content-Encoding: gzip.
+// Body limits set later apply to the inflated body.
+func Gunzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			apierr.Error(w, "bad gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		r.Body = gz
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
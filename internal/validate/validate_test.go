@@ -0,0 +1,75 @@
+package validate
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	metric "github.com/goethesum/-go-musthave-devops-tpl/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestID(t *testing.T) {
+	for _, id := range []string{"Alloc", "_x", "checkout.requests", "svc/http:latency-ms"} {
+		assert.Nil(t, ID(id), id)
+	}
+	for _, id := range []string{"", "1abc", ".x", "a b", "a\"b", strings.Repeat("a", MaxIDLength+1)} {
+		err := ID(id)
+		require.NotNil(t, err, id)
+		assert.Equal(t, CodeInvalidID, err.Code)
+	}
+}
+
+func TestMetric(t *testing.T) {
+	assert.Nil(t, Metric(metric.Metric{ID: "a", MType: metric.MetricTypeGauge, Value: 1, Labels: metric.Labels{"host.name": "x"}}))
+	assert.Equal(t, CodeInvalidValue, Metric(metric.Metric{ID: "a", MType: metric.MetricTypeGauge, Value: math.NaN()}).Code)
+	assert.Equal(t, CodeInvalidValue, Metric(metric.Metric{ID: "a", MType: metric.MetricTypeGauge, Value: math.Inf(-1)}).Code)
+	assert.Equal(t, CodeMissingType, Metric(metric.Metric{ID: "a"}).Code)
+	err := Metric(metric.Metric{ID: "a", MType: "histogram"})
+	assert.Equal(t, CodeUnknownType, err.Code)
+	assert.Equal(t, http.StatusNotImplemented, err.Status)
+	assert.Equal(t, CodeInvalidLabel, Metric(metric.Metric{ID: "a", MType: metric.MetricTypeCounter, Labels: metric.Labels{"a b": "x"}}).Code)
+}
+
+func TestDecoder(t *testing.T) {
+	decode := func(d Decoder, body string) (metric.Metric, string, int) {
+		r := httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(body))
+		m, err := d.Update(httptest.NewRecorder(), r)
+		if err != nil {
+			return m, err.Code, err.Status
+		}
+		return m, "", http.StatusOK
+	}
+
+	m, code, _ := decode(Decoder{}, `{"id":"PollCount","type":"counter","delta":0,"extra":1}`)
+	assert.Empty(t, code)
+	assert.Equal(t, metric.Metric{ID: "PollCount", MType: metric.MetricTypeCounter}, m)
+
+	for _, tt := range []struct {
+		d      Decoder
+		body   string
+		code   string
+		status int
+	}{
+		{Decoder{}, `{"id":"PollCount","type":"counter"}`, CodeMissingDelta, http.StatusBadRequest},
+		{Decoder{}, `{"id":"Alloc","type":"gauge","delta":1}`, CodeMissingValue, http.StatusBadRequest},
+		{Decoder{}, `{"id":"Alloc","value":1}`, CodeMissingType, http.StatusBadRequest},
+		{Decoder{}, `{"id":"Alloc","type":"gauge","value":"1"}`, CodeInvalidValue, http.StatusBadRequest},
+		{Decoder{}, `{"id":"Alloc",`, CodeMalformedJSON, http.StatusBadRequest},
+		{Decoder{}, ``, CodeMalformedJSON, http.StatusBadRequest},
+		{Decoder{DisallowUnknownFields: true}, `{"id":"Alloc","type":"gauge","value":1,"extra":1}`, CodeUnknownField, http.StatusBadRequest},
+		{Decoder{MaxBodyBytes: 16}, `{"id":"Alloc","type":"gauge","value":1}`, "body_too_large", http.StatusRequestEntityTooLarge},
+	} {
+		_, code, status := decode(tt.d, tt.body)
+		assert.Equal(t, tt.code, code, tt.body)
+		assert.Equal(t, tt.status, status, tt.body)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id":"a","type":"gauge","value":1},{"id":"b","type":"counter"}]`))
+	_, err := Decoder{}.Batch(httptest.NewRecorder(), r)
+	require.NotNil(t, err)
+	assert.Equal(t, "[1].delta", err.Field)
+}